@@ -8,16 +8,21 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
 
 	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/dhcp"
 	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/utils"
 	"github.com/cafebazaar/blacksmith/web"
+	"github.com/cafebazaar/blacksmith/workspace"
 )
 
 //go:generate esc -o pxe/pxelinux_autogen.go -prefix=pxe -pkg pxe -ignore=README.md pxe/pxelinux
@@ -28,8 +33,11 @@ const (
 		/config/bootparams/main
 		/config/cloudconfig/main
 		/config/ignition/main
+		/bootloaders/efi64/{syslinux.efi,ldlinux.e64}
 		/images/{core-os-version}/coreos_production_pxe_image.cpio.gz
 		/images/{core-os-version}/coreos_production_pxe.vmlinuz
+		/images/{image}/manifest.yaml
+		/tftp/{file,file.tmpl}
 		/initial.yaml
 `
 	httpListenFlagDefaultTCPAddress = "interface-ip:8000"
@@ -41,12 +49,19 @@ var (
 	listenIFFlag      = flag.String("if", "", "Interface name for DHCP and PXE to listen on")
 	httpListenFlag    = flag.String("http-listen", httpListenFlagDefaultTCPAddress, "IP range to listen on for web requests")
 	workspacePathFlag = flag.String("workspace", "/workspaces/current", workspacePathHelp)
+	retentionFlag     = flag.Int("workspace-retention", 5, "How many of the newest workspace versions are kept, besides the active one and the ones machines last booted from")
+	workspaceMaxFlag  = flag.Int64("workspace-max-size", utils.DefaultUntarLimits.MaxBytes, "The maximum size of a workspace in bytes, both of its uploaded tarball and of its extracted files")
 	etcdFlag          = flag.String("etcd", "", "Etcd endpoints")
+	datastoreFlag     = flag.String("datastore", "etcd", "Where the data is kept: etcd, etcd2 for the deprecated v2 api of etcd, or local for a BoltDB file on a single node")
+	datastorePathFlag = flag.String("datastore-path", "/var/lib/blacksmith/blacksmith.db", "Path to the BoltDB file of the local datastore")
+	migrateEtcd2Flag  = flag.Bool("migrate-etcd2", false, "Copy the data of the cluster from the v2 store of etcd into the v3 store, and exit")
 	clusterNameFlag   = flag.String("cluster-name", "blacksmith", "The name of this cluster. Will be used as etcd path prefixes.")
 	dnsAddressesFlag  = flag.String("dns", "8.8.8.8", "comma separated IPs which will be used as default nameservers for skydns.")
 
 	leaseStartFlag = flag.String("lease-start", "", "Begining of lease starting IP")
 	leaseRangeFlag = flag.Int("lease-range", 0, "Lease range")
+	leaseGraceFlag = flag.Duration("lease-grace", time.Hour, "How long an expired lease is kept before its IP is reclaimed")
+	proxyDHCPFlag  = flag.Bool("proxy-dhcp", false, "Serve as a proxyDHCP, only answer the PXE clients and let another DHCP server assign the IPs")
 
 	version   string
 	commit    string
@@ -104,6 +119,50 @@ func gracefulShutdown(etcdDataSource datasource.DataSource) {
 	os.Exit(0)
 }
 
+func newEtcd2Client() etcd.Client {
+	etcdClient, err := etcd.New(etcd.Config{
+		Endpoints:               strings.Split(*etcdFlag, ","),
+		HeaderTimeoutPerRequest: 5 * time.Second,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		os.Exit(1)
+	}
+	return etcdClient
+}
+
+func newEtcdClient() *clientv3.Client {
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(*etcdFlag, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		os.Exit(1)
+	}
+	return etcdClient
+}
+
+// migrateEtcd2 copies the data of the cluster from the v2 store of etcd into
+// the v3 store
+func migrateEtcd2() {
+	if *etcdFlag == "" {
+		fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints\n")
+		os.Exit(1)
+	}
+	etcdClient := newEtcdClient()
+	defer etcdClient.Close()
+
+	copied, err := datasource.MigrateEtcd2(etcd.NewKeysAPI(newEtcd2Client()),
+		etcdClient, *clusterNameFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while migrating the data to etcd v3 (%d keys are copied): %s\n",
+			copied, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d keys are copied into the v3 store of etcd\n", copied)
+}
+
 func main() {
 	var err error
 	flag.Parse()
@@ -122,11 +181,33 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	// etcd config
-	if etcdFlag == nil || clusterNameFlag == nil {
-		fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints\n")
+	// datastore config
+	switch *datastoreFlag {
+	case "etcd", "etcd2":
+		if *etcdFlag == "" {
+			fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints\n")
+			os.Exit(1)
+		}
+	case "local":
+		if *datastorePathFlag == "" {
+			fmt.Fprint(os.Stderr, "\nPlease specify the path of the local datastore\n")
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "\nUnknown datastore: %s\n", *datastoreFlag)
+		os.Exit(1)
+	}
+
+	if *workspaceMaxFlag <= 0 {
+		fmt.Fprint(os.Stderr, "\nPlease specify a positive workspace max size\n")
 		os.Exit(1)
 	}
+	utils.DefaultUntarLimits.MaxBytes = *workspaceMaxFlag
+
+	if *migrateEtcd2Flag {
+		migrateEtcd2()
+		os.Exit(0)
+	}
 
 	// finding interface by interface name
 	var dhcpIF *net.Interface
@@ -192,41 +273,48 @@ func main() {
 		}
 	}
 
-	if leaseStart == nil {
-		fmt.Fprint(os.Stderr, "\nPlease specify the lease start ip\n")
-		os.Exit(1)
-	}
-	if leaseRange <= 1 {
-		fmt.Fprint(os.Stderr, "\nLease range should be greater that 1\n")
-		os.Exit(1)
+	if !*proxyDHCPFlag {
+		if leaseStart == nil {
+			fmt.Fprint(os.Stderr, "\nPlease specify the lease start ip\n")
+			os.Exit(1)
+		}
+		if leaseRange <= 1 {
+			fmt.Fprint(os.Stderr, "\nLease range should be greater that 1\n")
+			os.Exit(1)
+		}
 	}
 
 	fmt.Printf("Interface IP:    %s\n", serverIP.String())
 	fmt.Printf("Interface Name:  %s\n", dhcpIF.Name)
 
 	// datasources
-	etcdClient, err := etcd.New(etcd.Config{
-		Endpoints:               strings.Split(*etcdFlag, ","),
-		HeaderTimeoutPerRequest: 5 * time.Second,
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
-		os.Exit(1)
-	}
-	kapi := etcd.NewKeysAPI(etcdClient)
-
 	selfInfo := datasource.InstanceInfo{
 		IP:               serverIP,
 		Nic:              dhcpIF.HardwareAddr,
 		WebPort:          webAddr.Port,
+		HTTPBooterPort:   httpBooterAddr.Port,
 		Version:          version,
 		Commit:           commit,
 		BuildTime:        buildTime,
 		ServiceStartTime: time.Now().UTC().Unix(),
 	}
-	etcdDataSource, err := datasource.NewEtcdDataSource(kapi, etcdClient,
-		leaseStart, leaseRange, *clusterNameFlag, *workspacePathFlag,
-		dnsIPStrings, selfInfo)
+	var etcdDataSource datasource.DataSource
+	switch *datastoreFlag {
+	case "local":
+		etcdDataSource, err = datasource.NewLocalDataSource(*datastorePathFlag,
+			leaseStart, leaseRange, *clusterNameFlag, *workspacePathFlag, selfInfo)
+	case "etcd2":
+		etcdClient := newEtcd2Client()
+		kapi := etcd.NewKeysAPI(etcdClient)
+
+		etcdDataSource, err = datasource.NewEtcdDataSource(kapi, etcdClient,
+			leaseStart, leaseRange, *clusterNameFlag, *workspacePathFlag,
+			dnsIPStrings, selfInfo)
+	default:
+		etcdDataSource, err = datasource.NewEtcdV3DataSource(newEtcdClient(),
+			leaseStart, leaseRange, *clusterNameFlag, *workspacePathFlag,
+			dnsIPStrings, selfInfo)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nCouldn't create runtime configuration: %s\n", err)
 		os.Exit(1)
@@ -234,10 +322,21 @@ func main() {
 
 	// serving api
 	go func() {
-		err := web.ServeWeb(etcdDataSource, webAddr)
+		err := web.ServeWeb(etcdDataSource, webAddr, *retentionFlag)
 		log.Fatalf("\nError while serving api: %s\n", err)
 	}()
 
+	// serving http booter, on the standby instances too, so the machines
+	// which are booting survive the failover of the master
+	go func() {
+		err := pxe.ServeHTTPBooter(context.Background(), httpBooterAddr, etcdDataSource, webAddr.Port)
+		log.Fatalf("\nError while serving http booter: %s\n", err)
+	}()
+	booters := pxe.NewBooters(etcdDataSource, httpBooterAddr)
+
+	// pulling the active workspace, when it's uploaded to another instance
+	go workspace.Sync(context.Background(), etcdDataSource, *retentionFlag)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -246,52 +345,88 @@ func main() {
 		}
 	}()
 
-	// waiting till we're officially the master instance
-	for etcdDataSource.WhileMaster() != nil {
+	for {
+		// waiting till we're officially the master instance
 		log.WithFields(log.Fields{
 			"where":  "blacksmith.main",
 			"action": "debug",
 		}).Debug("Not master, waiting to be promoted...")
-		time.Sleep(datasource.StandbyMasterUpdateTime)
-	}
-
-	log.WithFields(log.Fields{
-		"where":  "blacksmith.main",
-		"action": "debug",
-	}).Debug("Now we're the master instance. Starting the services...")
+		leadership, err := etcdDataSource.Campaign(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError while waiting to be the master: %s\n", err)
+			os.Exit(1)
+		}
 
-	// serving http booter
-	go func() {
-		err := pxe.ServeHTTPBooter(httpBooterAddr, etcdDataSource, webAddr.Port)
-		log.Fatalf("\nError while serving http booter: %s\n", err)
-	}()
+		log.WithFields(log.Fields{
+			"where":  "blacksmith.main",
+			"action": "debug",
+		}).Debugf("Now we're the master instance (token %d). Starting the services...",
+			leadership.Token)
 
-	// serving tftp
-	go func() {
-		err := pxe.ServeTFTP(tftpAddr)
-		log.Fatalf("\nError while serving tftp: %s\n", err)
-	}()
+		serveAsMaster(leadership, etcdDataSource, serverIP, dhcpIF.Name,
+			booters, tftpAddr, pxeAddr)
+	}
+}
 
-	// pxe protocol
-	go func() {
-		err := pxe.ServePXE(pxeAddr, serverIP, httpBooterAddr)
-		log.Fatalf("\nError while serving pxe: %s\n", err)
-	}()
+// serviceStopTimeout is the time the services have to stop after the
+// mastership is lost
+const serviceStopTimeout = 5 * time.Second
+
+// serveAsMaster runs the services which only run on the master, and blocks
+// until the leadership is lost and they're stopped
+func serveAsMaster(leadership *datasource.Leadership, ds datasource.DataSource,
+	serverIP net.IP, dhcpIFName string, booters *pxe.Booters,
+	tftpAddr net.UDPAddr, pxeAddr net.UDPAddr) {
+	ctx := leadership.Context()
+
+	var wg sync.WaitGroup
+	run := func(name string, service func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := service()
+			if err != nil && leadership.Valid() == nil {
+				log.Fatalf("\nError while %s: %s\n", name, err)
+			}
+		}()
+	}
 
-	// serving dhcp
-	go func() {
-		err := dhcp.StartDHCP(dhcpIF.Name, serverIP, etcdDataSource)
-		log.Fatalf("\nError while serving dhcp: %s\n", err)
-	}()
+	run("serving tftp", func() error {
+		return pxe.ServeTFTP(ctx, tftpAddr, ds)
+	})
+	run("serving pxe", func() error {
+		return pxe.ServePXE(ctx, pxeAddr, serverIP, booters)
+	})
 
-	for etcdDataSource.WhileMaster() == nil {
-		time.Sleep(datasource.ActiveMasterUpdateTime)
+	if *proxyDHCPFlag {
+		// serving proxy dhcp, the IPs are assigned by another dhcp server
+		run("serving proxy dhcp", func() error {
+			return dhcp.StartProxyDHCP(leadership, dhcpIFName, serverIP, booters, ds)
+		})
+	} else {
+		run("serving dhcp", func() error {
+			return dhcp.StartDHCP(leadership, dhcpIFName, serverIP, booters, ds)
+		})
+		run("reclaiming leases", func() error {
+			return dhcp.StartLeaseReclaimer(ctx, ds, *leaseGraceFlag)
+		})
 	}
 
+	<-ctx.Done()
 	log.WithFields(log.Fields{
-		"where":  "blacksmith.main",
+		"where":  "blacksmith.serveAsMaster",
 		"action": "debug",
-	}).Debug("Now we're NOT the master. Terminating. Hoping to be restarted by the service manager.")
+	}).WithError(leadership.Valid()).Warn("Now we're NOT the master. Stopping the services...")
 
-	gracefulShutdown(etcdDataSource)
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(serviceStopTimeout):
+		log.Fatalf("\nThe services didn't stop in %s after the mastership is lost\n",
+			serviceStopTimeout)
+	}
 }
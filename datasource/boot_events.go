@@ -0,0 +1,183 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Types of the boot events
+const (
+	// BootEventConfig is recorded when the machine fetches its pxelinux
+	// config or iPXE script, which is the start of a boot attempt
+	BootEventConfig = "config"
+	// BootEventKernel is recorded when the kernel of an image is served
+	BootEventKernel = "kernel"
+	// BootEventCloudConfig is recorded when the cloudconfig is served
+	BootEventCloudConfig = "cloudconfig"
+	// BootEventIgnition is recorded when the ignition is served
+	BootEventIgnition = "ignition"
+	// BootEventBooted is recorded when the machine reports that it's booted
+	// successfully, after it has fetched its config
+	BootEventBooted = "booted"
+	// BootEventActionChanged is recorded when the boot action of the machine
+	// is changed through the api
+	BootEventActionChanged = "action-changed"
+)
+
+const (
+	// bootEventsDirName is the folder of the boot events inside the folder
+	// of each machine
+	bootEventsDirName = "_boot_events"
+	// bootEventsTTL is how long the boot events are kept, which is the
+	// longest acceptable value for SpecialKeyBootLoopWindow
+	bootEventsTTL = 24 * time.Hour
+
+	defaultBootLoopThreshold = 5
+	defaultBootLoopWindow    = time.Hour
+)
+
+// BootEvent is a step of booting a machine, which is recorded by the http
+// booter and the template endpoints
+type BootEvent struct {
+	Type string `json:"type"`
+	Time int64  `json:"time"`
+}
+
+// BootLoopPolicy specifies when a machine is considered to be in a boot
+// loop, and what is done about it
+type BootLoopPolicy struct {
+	// Threshold is the number of the accepted boot attempts in Window
+	Threshold int
+	Window    time.Duration
+	// Action is the boot action which the machine is switched to, when it's
+	// detected to be in a boot loop. If it's empty, the machine is only
+	// flagged.
+	Action string
+}
+
+// BootLoopPolicyOf returns the policy of the machine, from the
+// boot-loop-* variables of the machine or the cluster
+func BootLoopPolicyOf(machineInterface MachineInterface) (*BootLoopPolicy, error) {
+	policy := &BootLoopPolicy{
+		Threshold: defaultBootLoopThreshold,
+		Window:    defaultBootLoopWindow,
+	}
+
+	threshold, err := machineInterface.GetVariable(SpecialKeyBootLoopThreshold)
+	if err != nil {
+		return nil, err
+	}
+	if threshold != "" {
+		policy.Threshold, _ = strconv.Atoi(threshold)
+	}
+
+	window, err := machineInterface.GetVariable(SpecialKeyBootLoopWindow)
+	if err != nil {
+		return nil, err
+	}
+	if window != "" {
+		policy.Window, _ = time.ParseDuration(window)
+	}
+
+	policy.Action, err = machineInterface.GetVariable(SpecialKeyBootLoopAction)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// BootAttempts counts the boot attempts since the given time, which haven't
+// been followed by a report of a successful boot, or by changing the boot
+// action. Serving the cloudconfig or the ignition doesn't end the attempts,
+// since it's fetched on every boot, even if the machine crashes afterwards.
+// The events are expected to be sorted by their time.
+func BootAttempts(events []BootEvent, since time.Time) int {
+	attempts := 0
+	for _, event := range events {
+		if event.Time < since.Unix() {
+			continue
+		}
+		switch event.Type {
+		case BootEventConfig:
+			attempts++
+		case BootEventBooted, BootEventActionChanged:
+			attempts = 0
+		}
+	}
+	return attempts
+}
+
+// InBootLoop reports whether the machine has exceeded the threshold of the
+// policy with the given events. A zero Threshold disables the detection.
+func (p *BootLoopPolicy) InBootLoop(events []BootEvent, now time.Time) bool {
+	if p.Threshold <= 0 {
+		return false
+	}
+	return BootAttempts(events, now.Add(-p.Window)) > p.Threshold
+}
+
+// validateBootLoopWindow checks the value of SpecialKeyBootLoopWindow
+func validateBootLoopWindow(value string) error {
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if window <= 0 || window > bootEventsTTL {
+		return fmt.Errorf("boot loop window should be in (0, %s]", bootEventsTTL)
+	}
+	return nil
+}
+
+// RecordBootEvent stores a boot event of the given type for the machine. The
+// events are kept for bootEventsTTL.
+func (m *etcdMachineInterface) RecordBootEvent(eventType string) error {
+	event, err := json.Marshal(&BootEvent{
+		Type: eventType,
+		Time: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.keysAPI.CreateInOrder(ctx, m.prefixifyForMachine(bootEventsDirName),
+		string(event), &etcd.CreateInOrderOptions{TTL: bootEventsTTL})
+	if err != nil {
+		return fmt.Errorf("error while recording the boot event: %s", err)
+	}
+	return nil
+}
+
+// BootEvents returns the recorded boot events of the machine, sorted by
+// their time
+func (m *etcdMachineInterface) BootEvents() ([]BootEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := m.keysAPI.Get(ctx, m.prefixifyForMachine(bootEventsDirName),
+		&etcd.GetOptions{Sort: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	events := make([]BootEvent, 0, len(response.Node.Nodes))
+	for _, n := range response.Node.Nodes {
+		var event BootEvent
+		if err := json.Unmarshal([]byte(n.Value), &event); err != nil {
+			return nil, fmt.Errorf("error while parsing the boot event %s: %s",
+				path.Base(n.Key), err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,67 @@
+package datasource
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBootLoop(t *testing.T) {
+	now := time.Unix(10000, 0)
+	ago := func(minutes int64) int64 {
+		return now.Unix() - minutes*60
+	}
+
+	tests := []struct {
+		events   []BootEvent
+		attempts int
+	}{
+		{nil, 0},
+		{[]BootEvent{
+			{BootEventConfig, ago(50)},
+			{BootEventKernel, ago(50)},
+			{BootEventConfig, ago(40)},
+			{BootEventConfig, ago(30)},
+		}, 3},
+		// the config is fetched on every boot, even in a loop
+		{[]BootEvent{
+			{BootEventConfig, ago(50)},
+			{BootEventIgnition, ago(49)},
+			{BootEventConfig, ago(30)},
+			{BootEventCloudConfig, ago(29)},
+			{BootEventConfig, ago(10)},
+		}, 3},
+		// booted
+		{[]BootEvent{
+			{BootEventConfig, ago(50)},
+			{BootEventIgnition, ago(49)},
+			{BootEventBooted, ago(45)},
+			{BootEventConfig, ago(30)},
+		}, 1},
+		// out of the window
+		{[]BootEvent{
+			{BootEventConfig, ago(90)},
+			{BootEventConfig, ago(70)},
+			{BootEventConfig, ago(30)},
+		}, 1},
+		{[]BootEvent{
+			{BootEventConfig, ago(30)},
+			{BootEventActionChanged, ago(20)},
+		}, 0},
+	}
+
+	policy := &BootLoopPolicy{Threshold: 2, Window: time.Hour}
+	for i, tt := range tests {
+		attempts := BootAttempts(tt.events, now.Add(-policy.Window))
+		if attempts != tt.attempts {
+			t.Errorf("#%d: expected %d attempts, got %d", i, tt.attempts, attempts)
+		}
+		if policy.InBootLoop(tt.events, now) != (tt.attempts > policy.Threshold) {
+			t.Errorf("#%d: unexpected boot loop detection", i)
+		}
+	}
+
+	policy.Threshold = 0
+	if policy.InBootLoop(tests[1].events, now) {
+		t.Error("expecting the detection to be disabled")
+	}
+}
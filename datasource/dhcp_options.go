@@ -0,0 +1,219 @@
+package datasource
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Types of the values of DHCPOption
+const (
+	DHCPOptionTypeIP      = "ip"      // "10.0.0.1"
+	DHCPOptionTypeIPs     = "ips"     // ["10.0.0.1", "10.0.0.2"]
+	DHCPOptionTypeString  = "string"  // "tftp.example.com"
+	DHCPOptionTypeUint8   = "uint8"   // 64
+	DHCPOptionTypeUint16  = "uint16"  // 9000
+	DHCPOptionTypeUint32  = "uint32"  // 3600
+	DHCPOptionTypeBool    = "bool"    // true
+	DHCPOptionTypeDomains = "domains" // ["example.com", "corp.example.com"]
+	DHCPOptionTypeHex     = "hex"     // "0104c0a80001"
+)
+
+// defaultDHCPOptionTypes is used for the options which their type is not
+// specified explicitly
+var defaultDHCPOptionTypes = map[byte]string{
+	1:   DHCPOptionTypeIP,      // Subnet Mask
+	3:   DHCPOptionTypeIPs,     // Router
+	4:   DHCPOptionTypeIPs,     // Time Server
+	6:   DHCPOptionTypeIPs,     // Domain Name Server
+	12:  DHCPOptionTypeString,  // Host Name
+	15:  DHCPOptionTypeString,  // Domain Name
+	23:  DHCPOptionTypeUint8,   // Default IP Time-to-live
+	26:  DHCPOptionTypeUint16,  // Interface MTU
+	28:  DHCPOptionTypeIP,      // Broadcast Address
+	42:  DHCPOptionTypeIPs,     // NTP Servers
+	43:  DHCPOptionTypeHex,     // Vendor Specific Information
+	44:  DHCPOptionTypeIPs,     // NetBIOS Name Servers
+	60:  DHCPOptionTypeString,  // Vendor Class Identifier
+	66:  DHCPOptionTypeString,  // TFTP Server Name
+	67:  DHCPOptionTypeString,  // Bootfile Name
+	119: DHCPOptionTypeDomains, // Domain Search
+	150: DHCPOptionTypeIPs,     // TFTP Server Address
+}
+
+// reservedDHCPOptionCodes are managed by the DHCP server itself
+var reservedDHCPOptionCodes = map[byte]bool{
+	0:   true, // Pad
+	50:  true, // Requested IP Address
+	51:  true, // IP Address Lease Time
+	53:  true, // DHCP Message Type
+	54:  true, // Server Identifier
+	55:  true, // Parameter Request List
+	255: true, // End
+}
+
+// DHCPOption is a custom option which is added to the DHCP replies
+type DHCPOption struct {
+	Code byte `json:"code"`
+	// Type of the Value, if it's empty, it's determined by the Code
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// DHCPOptions is the value of SpecialKeyDHCPOptions
+type DHCPOptions []DHCPOption
+
+// UnmarshalDHCPOptions returns the DHCPOptions encoded in the given string,
+// after validating them. The empty string is considered as no options.
+func UnmarshalDHCPOptions(dhcpOptionsStr string) (DHCPOptions, error) {
+	var dhcpOptions DHCPOptions
+	if strings.TrimSpace(dhcpOptionsStr) == "" {
+		return dhcpOptions, nil
+	}
+	if err := json.Unmarshal([]byte(dhcpOptionsStr), &dhcpOptions); err != nil {
+		return nil, err
+	}
+	if _, err := dhcpOptions.Encode(); err != nil {
+		return nil, err
+	}
+	return dhcpOptions, nil
+}
+
+// Encode returns the options formatted according to their types, keyed by
+// their codes. For the repeated codes, the last one wins.
+func (o DHCPOptions) Encode() (map[byte][]byte, error) {
+	encoded := make(map[byte][]byte)
+	for _, option := range o {
+		value, err := option.encode()
+		if err != nil {
+			return nil, fmt.Errorf("invalid dhcp option %d: %s", option.Code, err)
+		}
+		encoded[option.Code] = value
+	}
+	return encoded, nil
+}
+
+func (o *DHCPOption) encode() ([]byte, error) {
+	if reservedDHCPOptionCodes[o.Code] {
+		return nil, errors.New("option is managed by the dhcp server")
+	}
+
+	typ := o.Type
+	if typ == "" {
+		var known bool
+		if typ, known = defaultDHCPOptionTypes[o.Code]; !known {
+			return nil, errors.New("type should be specified for this option")
+		}
+	}
+
+	var ret []byte
+	switch typ {
+	case DHCPOptionTypeIP:
+		var ipStr string
+		if err := json.Unmarshal(o.Value, &ipStr); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(ipStr).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ipv4: %q", ipStr)
+		}
+		ret = ip
+	case DHCPOptionTypeIPs:
+		var ipStrs []string
+		if err := json.Unmarshal(o.Value, &ipStrs); err != nil {
+			return nil, err
+		}
+		for _, ipStr := range ipStrs {
+			ip := net.ParseIP(ipStr).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ipv4: %q", ipStr)
+			}
+			ret = append(ret, ip...)
+		}
+	case DHCPOptionTypeString:
+		var str string
+		if err := json.Unmarshal(o.Value, &str); err != nil {
+			return nil, err
+		}
+		ret = []byte(str)
+	case DHCPOptionTypeUint8:
+		var n uint8
+		if err := json.Unmarshal(o.Value, &n); err != nil {
+			return nil, err
+		}
+		ret = []byte{n}
+	case DHCPOptionTypeUint16:
+		var n uint16
+		if err := json.Unmarshal(o.Value, &n); err != nil {
+			return nil, err
+		}
+		ret = make([]byte, 2)
+		binary.BigEndian.PutUint16(ret, n)
+	case DHCPOptionTypeUint32:
+		var n uint32
+		if err := json.Unmarshal(o.Value, &n); err != nil {
+			return nil, err
+		}
+		ret = make([]byte, 4)
+		binary.BigEndian.PutUint32(ret, n)
+	case DHCPOptionTypeBool:
+		var b bool
+		if err := json.Unmarshal(o.Value, &b); err != nil {
+			return nil, err
+		}
+		ret = []byte{0}
+		if b {
+			ret[0] = 1
+		}
+	case DHCPOptionTypeDomains:
+		var domains []string
+		if err := json.Unmarshal(o.Value, &domains); err != nil {
+			return nil, err
+		}
+		for _, domain := range domains {
+			encoded, err := encodeDomainName(domain)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, encoded...)
+		}
+	case DHCPOptionTypeHex:
+		var hexStr string
+		if err := json.Unmarshal(o.Value, &hexStr); err != nil {
+			return nil, err
+		}
+		var err error
+		ret, err = hex.DecodeString(hexStr)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown type: %q", typ)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("empty value")
+	}
+	if len(ret) > 255 {
+		return nil, errors.New("value is longer than 255 bytes")
+	}
+	return ret, nil
+}
+
+// encodeDomainName formats the domain as specified in rfc1035 (section
+// 3.1), without compression
+func encodeDomainName(domain string) ([]byte, error) {
+	var ret []byte
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain: %q", domain)
+		}
+		ret = append(ret, byte(len(label)))
+		ret = append(ret, label...)
+	}
+	return append(ret, 0), nil
+}
@@ -12,6 +12,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
 	"golang.org/x/net/context"
 	"gopkg.in/yaml.v2"
 )
@@ -21,11 +22,19 @@ const (
 	etcdCluserVarsDirName    = "cluster-variables"
 	etcdConfigurationDirName = "configuration"
 	etcdFilesDirName         = "files"
+	etcdSubnetsDirName       = "subnets"
+	etcdIPsDirName           = "ips"
+	etcdProfilesDirName      = "profiles"
+	etcdWorkspaceSyncDirName = "workspace-sync"
 )
 
 // ActiveWorkspaceHashKey is cluster variable key of active workspace hash
 const ActiveWorkspaceHashKey = "active-workspace-hash"
 
+// BootedWorkspaceHashKey is the machine variable key of the hash of the
+// workspace which the machine last booted from
+const BootedWorkspaceHashKey = "booted-workspace-hash"
+
 // EtcdDataSource implements MasterDataSource interface using etcd as it's
 // datasource
 // Implements MasterDataSource interface
@@ -37,8 +46,18 @@ type EtcdDataSource struct {
 	clusterName     string
 	workspacePath   string
 	dhcpAssignLock  *sync.Mutex
-	instanceEtcdKey string // HA
+	ipCursors       map[string]int // per subnet, guarded by dhcpAssignLock
+	instanceEtcdKey string         // HA
+	instanceToken   uint64         // the created index of instanceEtcdKey
 	selfInfo        InstanceInfo
+	// alwaysMaster is set for the local datastore, which can't be shared by
+	// other instances
+	alwaysMaster bool
+	// v3 is set when the v3 api of etcd is used, through v3KeysAPI
+	v3 *etcdV3
+
+	leadershipLock sync.Mutex // guards leadership
+	leadership     *Leadership
 }
 
 // WorkspacePath returns the path to the workspace
@@ -82,6 +101,23 @@ func (ds *EtcdDataSource) MachineInterface(mac net.HardwareAddr) MachineInterfac
 	}
 }
 
+// MachineInterfaceByIP returns the MachineInterface of the machine which the
+// given IP is assigned to, using the ip index
+func (ds *EtcdDataSource) MachineInterfaceByIP(ip net.IP) (MachineInterface, error) {
+	owner, err := ds.ipOwner(ip)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up the owner of %s: %s", ip.String(), err)
+	}
+	if owner == "" || owner == quarantinedIPOwner {
+		return nil, fmt.Errorf("no machine is assigned the IP %s", ip.String())
+	}
+	mac, err := net.ParseMAC(owner)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing the owner of %s: %s", ip.String(), err)
+	}
+	return ds.MachineInterface(mac), nil
+}
+
 // Add prefix for cluster variable keys
 func (ds *EtcdDataSource) prefixifyForClusterVariables(key string) string {
 	return path.Join(ds.ClusterName(), etcdCluserVarsDirName, key)
@@ -101,7 +137,12 @@ func (ds *EtcdDataSource) get(keyPath string) (string, error) {
 
 // set expects absolute key path
 func (ds *EtcdDataSource) set(keyPath string, value string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return ds.setContext(context.Background(), keyPath, value)
+}
+
+// setContext is set with the given parent context, which may be fenced
+func (ds *EtcdDataSource) setContext(parent context.Context, keyPath string, value string) error {
+	ctx, cancel := context.WithTimeout(parent, 3*time.Second)
 	defer cancel()
 	_, err := ds.keysAPI.Set(ctx, keyPath, value, nil)
 	return err
@@ -109,7 +150,12 @@ func (ds *EtcdDataSource) set(keyPath string, value string) error {
 
 // delete expects absolute key path
 func (ds *EtcdDataSource) delete(keyPath string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return ds.deleteContext(context.Background(), keyPath)
+}
+
+// deleteContext is delete with the given parent context, which may be fenced
+func (ds *EtcdDataSource) deleteContext(parent context.Context, keyPath string) error {
+	ctx, cancel := context.WithTimeout(parent, 3*time.Second)
 	defer cancel()
 	_, err := ds.keysAPI.Delete(ctx, keyPath, nil)
 	return err
@@ -153,7 +199,7 @@ func (ds *EtcdDataSource) ListConfigurations() (map[string]string, error) {
 
 // SetClusterVariable sets a cluster variable inside etcd
 func (ds *EtcdDataSource) SetClusterVariable(key string, value string) error {
-	err := validateVariable(key, value)
+	err := ValidateVariable(key, value)
 	if err != nil {
 		return err
 	}
@@ -173,6 +219,12 @@ func (ds *EtcdDataSource) ClusterName() string {
 // EtcdMembers returns a string suitable for `-initial-cluster`
 // This is the etcd the Blacksmith instance is using as its datastore
 func (ds *EtcdDataSource) EtcdMembers() (string, error) {
+	if ds.v3 != nil {
+		return ds.v3Members()
+	}
+	if ds.client == nil {
+		return "", nil // the local datastore
+	}
 	membersAPI := etcd.NewMembersAPI(ds.client)
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -193,26 +245,66 @@ func (ds *EtcdDataSource) EtcdMembers() (string, error) {
 	return strings.Join(peers, ","), err
 }
 
+// v3Members is EtcdMembers for the v3 api
+func (ds *EtcdDataSource) v3Members() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	resp, err := ds.v3.client.MemberList(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Error while checking etcd members: %s", err)
+	}
+
+	var peers []string
+	for _, member := range resp.Members {
+		for _, peer := range member.PeerURLs {
+			peers = append(peers, fmt.Sprintf("%s=%s", member.Name, peer))
+		}
+	}
+
+	return strings.Join(peers, ","), nil
+}
+
 // NewEtcdDataSource gives blacksmith the ability to use an etcd endpoint as
-// a MasterDataSource
+// a MasterDataSource, through the v2 api of etcd. It's deprecated in favor of
+// NewEtcdV3DataSource.
 func NewEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
 	leaseRange int, clusterName, workspacePath string, defaultNameServers []string,
 	selfInfo InstanceInfo) (DataSource, error) {
 
-	ds := &EtcdDataSource{
-		keysAPI:         kapi,
-		client:          client,
-		clusterName:     clusterName,
-		leaseStart:      leaseStart,
-		leaseRange:      leaseRange,
-		workspacePath:   workspacePath,
-		dhcpAssignLock:  &sync.Mutex{},
-		instanceEtcdKey: invalidEtcdKey,
-		selfInfo:        selfInfo,
+	ds := newEtcdDataSource(kapi, client, leaseStart, leaseRange, clusterName,
+		workspacePath, selfInfo)
+
+	ds.FillEtcdFromWorkspace()
+	ds.configureSkydns(defaultNameServers)
+
+	if err := ds.prepare(); err != nil {
+		return nil, err
 	}
+	return ds, nil
+}
+
+// NewEtcdV3DataSource gives blacksmith the ability to use an etcd endpoint as
+// a MasterDataSource, through the v3 api of etcd
+func NewEtcdV3DataSource(client *clientv3.Client, leaseStart net.IP,
+	leaseRange int, clusterName, workspacePath string, defaultNameServers []string,
+	selfInfo InstanceInfo) (DataSource, error) {
+
+	ds := newEtcdDataSource(newV3KeysAPI(client), nil, leaseStart, leaseRange,
+		clusterName, workspacePath, selfInfo)
+	ds.v3 = &etcdV3{client: client}
 
 	ds.FillEtcdFromWorkspace()
+	ds.configureSkydns(defaultNameServers)
+
+	if err := ds.prepare(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
 
+// configureSkydns sets the config of skydns, under /skydns
+func (ds *EtcdDataSource) configureSkydns(defaultNameServers []string) {
 	// TODO: Integrate DNS service into Blacksmith
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel2()
@@ -227,17 +319,46 @@ func NewEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
 	}
 	commaSeparatedQouteEnclosedNameservers := strings.Join(quoteEnclosedNameservers, ",")
 
-	skydnsconfig := fmt.Sprintf(`{"dns_addr":"0.0.0.0:53","nameservers":[%s],"domain":"%s."}`, commaSeparatedQouteEnclosedNameservers, clusterName)
+	skydnsconfig := fmt.Sprintf(`{"dns_addr":"0.0.0.0:53","nameservers":[%s],"domain":"%s."}`, commaSeparatedQouteEnclosedNameservers, ds.clusterName)
 	ctx4, cancel4 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel4()
 	ds.keysAPI.Set(ctx4, "skydns/config", skydnsconfig, nil)
+}
+
+func newEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
+	leaseRange int, clusterName, workspacePath string,
+	selfInfo InstanceInfo) *EtcdDataSource {
+	return &EtcdDataSource{
+		keysAPI:         kapi,
+		client:          client,
+		clusterName:     clusterName,
+		leaseStart:      leaseStart,
+		leaseRange:      leaseRange,
+		workspacePath:   workspacePath,
+		dhcpAssignLock:  &sync.Mutex{},
+		ipCursors:       make(map[string]int),
+		instanceEtcdKey: invalidEtcdKey,
+		selfInfo:        selfInfo,
+	}
+}
 
-	_, err := ds.MachineInterface(selfInfo.Nic).Machine(true, selfInfo.IP)
+// prepare indexes the IPs of the machines, and records this instance as a
+// machine, if its interface has a hardware address
+func (ds *EtcdDataSource) prepare() error {
+	err := ds.indexMachineIPs()
 	if err != nil {
-		return nil, fmt.Errorf("error while creating the machine representation of self: %s", err)
+		return fmt.Errorf("error while indexing the IPs of the machines: %s", err)
 	}
 
-	return ds, nil
+	if len(ds.selfInfo.Nic) == 0 {
+		// i.e. the loopback interface, which has no hardware address
+		return nil
+	}
+	_, err = ds.MachineInterface(ds.selfInfo.Nic).Machine(true, ds.selfInfo.IP)
+	if err != nil {
+		return fmt.Errorf("error while creating the machine representation of self: %s", err)
+	}
+	return nil
 }
 
 func (ds *EtcdDataSource) FillEtcdFromWorkspace() {
@@ -5,13 +5,25 @@ import (
 	"testing"
 )
 
-func TestCoreOSVersion(t *testing.T) {
-	ds, err := ForTest(nil)
-	if err != nil {
-		t.Error("error in getting a DataSource instance for our test:", err)
-		return
+// forEachBackend runs the test with a DataSource on each of ForTestBackends
+func forEachBackend(t *testing.T, params *ForTestParams, test func(t *testing.T, ds DataSource)) {
+	for _, backend := range ForTestBackends() {
+		ds, cleanup, err := ForTest(backend, params)
+		if err != nil {
+			t.Errorf("error in getting a %s DataSource instance for our test: %s", backend, err)
+			continue
+		}
+		t.Log("backend:", backend)
+		test(t, ds)
+		cleanup()
 	}
+}
+
+func TestCoreOSVersion(t *testing.T) {
+	forEachBackend(t, nil, testCoreOSVersion)
+}
 
+func testCoreOSVersion(t *testing.T, ds DataSource) {
 	version, err := ds.GetClusterVariable("coreos-version")
 	if err != nil {
 		t.Error("error while getting coreos version:", err)
@@ -23,19 +35,25 @@ func TestCoreOSVersion(t *testing.T) {
 }
 
 func TestEtcdMembers(t *testing.T) {
-	ds, err := ForTest(nil)
-	if err != nil {
-		t.Error("error in getting a DataSource instance for our test:", err)
-		return
-	}
-
-	got, err := ds.EtcdMembers()
-	if err != nil {
-		t.Error("error while EtcdMembers:", err)
-	}
+	for _, backend := range ForTestBackends() {
+		if backend == ForTestLocal {
+			// the local datastore has no members
+			continue
+		}
+		ds, cleanup, err := ForTest(backend, nil)
+		if err != nil {
+			t.Errorf("error in getting a %s DataSource instance for our test: %s", backend, err)
+			continue
+		}
+		got, err := ds.EtcdMembers()
+		if err != nil {
+			t.Error("error while EtcdMembers:", err)
+		}
 
-	// It's not easy to know the exact value in all the test environment
-	if !(strings.Contains(got, "etcd0=") && strings.HasSuffix(got, "80")) {
-		t.Error("expecting EtcdMembers result to conatins etcd0= and ends with 80, got:", got)
+		// It's not easy to know the exact value in all the test environment
+		if !(strings.Contains(got, "etcd0=") && strings.HasSuffix(got, "80")) {
+			t.Error("expecting EtcdMembers result to conatins etcd0= and ends with 80, got:", got)
+		}
+		cleanup()
 	}
 }
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
-	"github.com/krolaw/dhcp4"
 	"golang.org/x/net/context"
 )
 
@@ -67,17 +66,75 @@ func (m *etcdMachineInterface) Machine(createIfNeeded bool,
 			IP:        createWithIP, // to be assigned automatically
 			FirstSeen: time.Now().Unix(),
 		}
-		err := m.store(&machine)
+		err := m.store(context.Background(), &machine)
 		if err != nil {
 			return machine, fmt.Errorf("error while storing _machine: %s", err)
 		}
 		return machine, nil
 	}
 	json.Unmarshal([]byte(resp), &machine)
+
+	if machine.IP == nil && createIfNeeded {
+		// The previous IP of this machine is reclaimed, ask for a new one
+		err := m.store(context.Background(), &machine)
+		if err != nil {
+			return machine, fmt.Errorf("error while storing _machine: %s", err)
+		}
+	}
 	return machine, nil
 }
 
-func (m *etcdMachineInterface) store(machine *Machine) error {
+// MachineInSubnet is like Machine(true, nil), but a newly created machine
+// is assigned an IP from the lease pool of the given subnet (the default pool
+// if subnet is nil). If a MTNormal machine has an IP from another subnet
+// (e.g. it's moved to another rack), a new IP is assigned to it. The writes
+// are fenced by the leadership of the master.
+func (m *etcdMachineInterface) MachineInSubnet(subnet *Subnet) (Machine, error) {
+	var machine Machine
+	ctx := m.etcdDS.fenced(context.Background())
+
+	subnetName := ""
+	if subnet != nil {
+		subnetName = subnet.Name
+	}
+
+	resp, err := m.selfGet("_machine")
+	if err != nil {
+		if !etcd.IsKeyNotFound(err) {
+			return machine, fmt.Errorf("error while retrieving _machine: %s", err)
+		}
+
+		machine = Machine{
+			FirstSeen: time.Now().Unix(),
+			Subnet:    subnetName,
+		}
+		if err := m.store(ctx, &machine); err != nil {
+			return machine, fmt.Errorf("error while storing _machine: %s", err)
+		}
+		return machine, nil
+	}
+	json.Unmarshal([]byte(resp), &machine)
+
+	if machine.Type == MTNormal && (machine.IP == nil || machine.Subnet != subnetName) {
+		previousIP := machine.IP
+		machine.IP = nil
+		machine.Subnet = subnetName
+		if err := m.store(ctx, &machine); err != nil {
+			return machine, fmt.Errorf("error while storing _machine: %s", err)
+		}
+		if previousIP != nil {
+			if err := m.etcdDS.releaseIP(ctx, previousIP, m.mac); err != nil {
+				return machine, fmt.Errorf("error while releasing the previous IP: %s", err)
+			}
+		}
+	}
+	return machine, nil
+}
+
+// store records the machine, and claims its IP, or allocates one if it has
+// none. The writes are made with the parent context, and the allocations are
+// fenced too.
+func (m *etcdMachineInterface) store(parent context.Context, machine *Machine) error {
 	if machine.Type == 0 {
 		if machine.IP == nil {
 			machine.Type = MTNormal
@@ -89,58 +146,26 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 	m.etcdDS.dhcpAssignLock.Lock()
 	defer m.etcdDS.dhcpAssignLock.Unlock()
 
-	machineInterfaces, err := m.etcdDS.MachineInterfaces()
-	if err != nil {
-		return fmt.Errorf("error while getting the machine interfaces: %s", err)
-	}
-	ipToMac := make(map[string]net.HardwareAddr)
-	for _, mi := range machineInterfaces {
-		machine, err := mi.Machine(false, nil)
-		if err != nil {
-			return fmt.Errorf("error while getting the machine for (%s): %s",
-				mi.Mac().String(), err)
-		}
-		ipToMac[machine.IP.String()] = mi.Mac()
-	}
-
+	allocated := false
 	if machine.IP == nil {
 		// To avoid concurrency problems
 		// We expect rhis part to be triggered only through DHCP, so we expect
-		// IsMaster() to returns true
-		if err := m.etcdDS.IsMaster(); err != nil {
+		// this instance to be the master, with a valid leadership
+		if err := m.etcdDS.checkFence(); err != nil {
 			return fmt.Errorf(
 				"only the master instance is allowed to store machine info: %s",
 				err)
 		}
 
-		counter := len(ipToMac) % m.etcdDS.leaseRange
-		firstCandidateIP := dhcp4.IPAdd(m.etcdDS.leaseStart, counter) // kickstarted
-		candidateIP := net.IPv4(
-			firstCandidateIP[0], firstCandidateIP[1],
-			firstCandidateIP[2], firstCandidateIP[3]) // copy
-
-		for _, isAssigned := ipToMac[candidateIP.String()]; isAssigned; {
-			candidateIP = dhcp4.IPAdd(candidateIP, 1)
-			counter++
-			if counter == m.etcdDS.leaseRange {
-				candidateIP = m.etcdDS.leaseStart
-				counter = 0
-			}
-			if firstCandidateIP.Equal(candidateIP) {
-				break
-			}
-		}
-
-		if _, isAssigned := ipToMac[candidateIP.String()]; isAssigned {
-			return fmt.Errorf("no unassigned IP was found")
+		ip, err := m.etcdDS.allocateIP(parent, machine.Subnet, m.mac)
+		if err != nil {
+			return err
 		}
-
-		machine.IP = candidateIP
+		machine.IP = ip
+		allocated = true
 	} else {
-		if m, isAssigned := ipToMac[machine.IP.String()]; isAssigned {
-			return fmt.Errorf(
-				"the requested IP(%s) is already assigned to another machine(%s)",
-				machine.IP.String(), m.String())
+		if err := m.etcdDS.claimIPContext(parent, machine.IP, m.mac); err != nil {
+			return err
 		}
 	}
 
@@ -148,14 +173,65 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 	if err != nil {
 		return fmt.Errorf("error while marshaling the machine: %s", err)
 	}
-	err = m.selfSet("_machine", string(jsonedStats))
+	err = m.selfSetContext(parent, "_machine", string(jsonedStats))
 	if err != nil {
+		if allocated {
+			m.etcdDS.releaseIP(parent, machine.IP, m.mac)
+			machine.IP = nil
+		}
 		return fmt.Errorf("error while setting the marshaled machine: %s", err)
 	}
 
 	return nil
 }
 
+// RecordExternalIP creates or updates the machine as a MTExternal one, with
+// the IP which is assigned to it by another DHCP server. The IP is taken from
+// its previous owner only if that's a MTExternal machine too (see
+// claimExternalIP). The writes are fenced by the leadership of the master.
+func (m *etcdMachineInterface) RecordExternalIP(ip net.IP) (Machine, error) {
+	var machine Machine
+	ctx := m.etcdDS.fenced(context.Background())
+
+	m.etcdDS.dhcpAssignLock.Lock()
+	defer m.etcdDS.dhcpAssignLock.Unlock()
+
+	resp, err := m.selfGet("_machine")
+	if err != nil {
+		if !etcd.IsKeyNotFound(err) {
+			return machine, fmt.Errorf("error while retrieving _machine: %s", err)
+		}
+		machine.FirstSeen = time.Now().Unix()
+	} else {
+		json.Unmarshal([]byte(resp), &machine)
+		if machine.Type == MTExternal && machine.IP.Equal(ip) {
+			return machine, nil
+		}
+	}
+
+	previousIP := machine.IP
+	machine.IP = ip
+	machine.Type = MTExternal
+	machine.Subnet = ""
+
+	if err := m.etcdDS.claimExternalIP(ctx, ip, m.mac); err != nil {
+		return machine, fmt.Errorf("error while recording the IP in index: %s", err)
+	}
+	jsonedStats, err := json.Marshal(machine)
+	if err != nil {
+		return machine, fmt.Errorf("error while marshaling the machine: %s", err)
+	}
+	if err := m.selfSetContext(ctx, "_machine", string(jsonedStats)); err != nil {
+		return machine, fmt.Errorf("error while setting the marshaled machine: %s", err)
+	}
+	if previousIP != nil && !previousIP.Equal(ip) {
+		if err := m.etcdDS.releaseIP(ctx, previousIP, m.mac); err != nil {
+			return machine, fmt.Errorf("error while releasing the previous IP: %s", err)
+		}
+	}
+	return machine, nil
+}
+
 // CheckIn updates the _last_seen field of the machine
 func (m *etcdMachineInterface) CheckIn() {
 	m.selfSet("_last_seen", strconv.FormatInt(time.Now().Unix(), 10))
@@ -171,14 +247,84 @@ func (m *etcdMachineInterface) LastSeen() (int64, error) {
 	return unixInt64, nil
 }
 
-// DeleteMachine deletes associated etcd folder of a machine entirely
+// RenewLease records that the IP of the machine is leased for the given
+// duration, starting from now. The write is fenced by the leadership of the
+// master.
+func (m *etcdMachineInterface) RenewLease(duration time.Duration) error {
+	expiry := time.Now().Add(duration).Unix()
+	return m.selfSetContext(m.etcdDS.fenced(context.Background()), "_lease_expiry",
+		strconv.FormatInt(expiry, 10))
+}
+
+// ReleaseLease marks the lease of the machine as expired
+func (m *etcdMachineInterface) ReleaseLease() error {
+	return m.RenewLease(0)
+}
+
+// LeaseExpiry returns the time the lease of the machine expires, 0 if no
+// lease is recorded for the machine
+func (m *etcdMachineInterface) LeaseExpiry() (int64, error) {
+	unixString, err := m.selfGet("_lease_expiry")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	unixInt64, _ := strconv.ParseInt(unixString, 10, 64)
+	return unixInt64, nil
+}
+
+// QuarantineIP marks the IP of the machine as unusable for the given
+// duration (e.g. because it's declined by the machine), and assigns a new IP
+// to the machine. The writes are fenced by the leadership of the master.
+func (m *etcdMachineInterface) QuarantineIP(duration time.Duration) (Machine, error) {
+	machine, err := m.Machine(false, nil)
+	if err != nil {
+		return machine, err
+	}
+	if machine.Type != MTNormal || machine.IP == nil {
+		return machine, errors.New("only the IP of a MTNormal machine can be quarantined")
+	}
+
+	ctx := m.etcdDS.fenced(context.Background())
+	err = m.etcdDS.quarantineIP(ctx, machine.IP, m.mac, duration)
+	if err != nil {
+		return machine, fmt.Errorf("error while quarantining %s: %s", machine.IP, err)
+	}
+	err = m.selfDeleteContext(ctx, "_lease_expiry")
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return machine, fmt.Errorf("error while deleting the lease expiry: %s", err)
+	}
+
+	machine.IP = nil
+	if err := m.store(ctx, &machine); err != nil {
+		return machine, fmt.Errorf("error while storing _machine: %s", err)
+	}
+	return machine, nil
+}
+
+// DeleteMachine deletes associated etcd folder of a machine entirely, and
+// releases its IP
 func (m *etcdMachineInterface) DeleteMachine() error {
+	machine, err := m.Machine(false, nil)
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.etcdDS.keysAPI.Delete(ctx,
+	_, err = m.etcdDS.keysAPI.Delete(ctx,
 		path.Join(m.etcdDS.ClusterName(), etcdMachinesDirName, m.Hostname()),
 		&etcd.DeleteOptions{Dir: true, Recursive: true})
-	return err
+	if err != nil {
+		return err
+	}
+
+	if machine.IP == nil {
+		return nil
+	}
+	return m.etcdDS.releaseIP(context.Background(), machine.IP, m.mac)
 }
 
 // ListFlags returns the list of all the flgas of a machine from Etcd
@@ -195,6 +341,9 @@ func (m *etcdMachineInterface) ListVariables() (map[string]string, error) {
 
 	flags := make(map[string]string)
 	for i := range response.Node.Nodes {
+		if response.Node.Nodes[i].Dir {
+			continue
+		}
 		_, k := path.Split(response.Node.Nodes[i].Key)
 		flags[k] = response.Node.Nodes[i].Value
 	}
@@ -202,38 +351,54 @@ func (m *etcdMachineInterface) ListVariables() (map[string]string, error) {
 	return flags, nil
 }
 
-// GetVariable Gets a machine's variable, or the global if it was not
-// set for the machine
+// GetVariable Gets a machine's variable, or the one of its profiles, or the
+// global if it was not set for the machine
 func (m *etcdMachineInterface) GetVariable(key string) (string, error) {
-	value, err := m.selfGet(key)
+	value, _, err := m.LookupVariable(key)
+	return value, err
+}
 
-	if err != nil {
-		if !etcd.IsKeyNotFound(err) {
-			return "", fmt.Errorf(
-				"error while getting variable key=%s for machine=%s: %s",
-				key, m.mac, err)
-		}
+// LookupVariable is like GetVariable, and also returns the source which the
+// variable is resolved from, which is empty if the variable is not set
+func (m *etcdMachineInterface) LookupVariable(key string) (value string, source string, err error) {
+	value, err = m.selfGet(key)
+	if err == nil {
+		return value, VariableSourceMachine, nil
+	}
+	if !etcd.IsKeyNotFound(err) {
+		return "", "", fmt.Errorf(
+			"error while getting variable key=%s for machine=%s: %s",
+			key, m.mac, err)
+	}
 
-		// Key was not found for the machine
-		value, err := m.etcdDS.GetClusterVariable(key)
+	// Key was not found for the machine, look it up in its profiles
+	if key != SpecialKeyProfiles {
+		value, source, err := m.profileVariable(key)
 		if err != nil {
-			if !etcd.IsKeyNotFound(err) {
-				return "", fmt.Errorf(
-					"error while getting variable key=%s for machine=%s (global check): %s",
-					key, m.mac, err)
-
-			}
-			return "", nil // Not set, not for machine, nor globally
+			return "", "", fmt.Errorf(
+				"error while getting variable key=%s for machine=%s (profiles check): %s",
+				key, m.mac, err)
+		}
+		if source != "" {
+			return value, source, nil
 		}
-		return value, nil
 	}
 
-	return value, nil
+	value, err = m.etcdDS.GetClusterVariable(key)
+	if err != nil {
+		if !etcd.IsKeyNotFound(err) {
+			return "", "", fmt.Errorf(
+				"error while getting variable key=%s for machine=%s (global check): %s",
+				key, m.mac, err)
+		}
+		return "", "", nil // Not set, not for machine, nor globally
+	}
+	return value, VariableSourceCluster, nil
 }
 
 // SetVariable sets the value of the specified key
 func (m *etcdMachineInterface) SetVariable(key, value string) error {
-	err := validateVariable(key, value)
+	err := ValidateVariable(key, value)
 	if err != nil {
 		return err
 	}
@@ -258,27 +423,41 @@ func (m *etcdMachineInterface) selfSet(key, value string) error {
 	return m.etcdDS.set(m.prefixifyForMachine(key), value)
 }
 
+func (m *etcdMachineInterface) selfSetContext(parent context.Context, key, value string) error {
+	return m.etcdDS.setContext(parent, m.prefixifyForMachine(key), value)
+}
+
 func (m *etcdMachineInterface) selfDelete(key string) error {
 	err := m.etcdDS.delete(m.prefixifyForMachine(key))
 	return err
 }
 
+func (m *etcdMachineInterface) selfDeleteContext(parent context.Context, key string) error {
+	return m.etcdDS.deleteContext(parent, m.prefixifyForMachine(key))
+}
+
 func macFromName(name string) (net.HardwareAddr, error) {
 	name = strings.Split(name, ".")[0]
-	return net.ParseMAC(colonLessMacToMac(name))
+	coloned, err := colonLessMacToMac(name)
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseMAC(coloned)
 }
 
-func colonLessMacToMac(colonLess string) string {
-	coloned := colonLess
-	if strings.Index(colonLess, ":") == -1 {
-		var tmpmac bytes.Buffer
-		for i := 0; i < 12; i++ { // colon-less mac address length
-			tmpmac.WriteString(colonLess[i : i+1])
-			if i%2 == 1 {
-				tmpmac.WriteString(":")
-			}
+func colonLessMacToMac(colonLess string) (string, error) {
+	if strings.Index(colonLess, ":") != -1 {
+		return colonLess, nil
+	}
+	if len(colonLess) != 12 { // colon-less mac address length
+		return "", fmt.Errorf("invalid colon-less mac address: %q", colonLess)
+	}
+	var tmpmac bytes.Buffer
+	for i := 0; i < 12; i++ {
+		tmpmac.WriteString(colonLess[i : i+1])
+		if i%2 == 1 && i != 11 {
+			tmpmac.WriteString(":")
 		}
-		coloned = tmpmac.String()[:len(tmpmac.String())-1]
 	}
-	return coloned
+	return tmpmac.String(), nil
 }
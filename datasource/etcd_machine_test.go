@@ -1,17 +1,17 @@
 package datasource
 
 import (
+	"fmt"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestAssign(t *testing.T) {
-	ds, err := ForTest(nil)
-	if err != nil {
-		t.Error("error in getting a DataSource instance for our test:", err)
-		return
-	}
+	forEachBackend(t, nil, testAssign)
+}
 
+func testAssign(t *testing.T, ds DataSource) {
 	if err := ds.WhileMaster(); err != nil {
 		t.Error("failed to register as the master instance:", err)
 	}
@@ -93,14 +93,15 @@ func TestAssign(t *testing.T) {
 	}
 }
 
+// leaseRangeForTest is the lease range of testLeaseRange
+const leaseRangeForTest = 10
+
 func TestLeaseRange(t *testing.T) {
-	testLeaseRange := 10
-	ds, err := ForTest(&ForTestParams{leaseRange: &testLeaseRange})
-	if err != nil {
-		t.Error("error in getting a DataSource instance for our test:", err)
-		return
-	}
+	leaseRange := leaseRangeForTest
+	forEachBackend(t, &ForTestParams{leaseRange: &leaseRange}, testLeaseRange)
+}
 
+func testLeaseRange(t *testing.T, ds DataSource) {
 	if err := ds.WhileMaster(); err != nil {
 		t.Error("failed to register as the master instance:", err)
 	}
@@ -110,7 +111,7 @@ func TestLeaseRange(t *testing.T) {
 		}
 	}()
 
-	for i := 1; i <= testLeaseRange; i++ {
+	for i := 1; i <= leaseRangeForTest; i++ {
 		mac := net.HardwareAddr{1, 1, 1, 1, 1, byte(i)}
 		_, err := ds.MachineInterface(mac).Machine(true, nil)
 		// TODO: check if the given IP is valid
@@ -120,10 +121,432 @@ func TestLeaseRange(t *testing.T) {
 		}
 	}
 
-	mac := net.HardwareAddr{1, 1, 1, 1, 1, 11}
-	_, err = ds.MachineInterface(mac).Machine(true, nil)
+	mac := net.HardwareAddr{1, 1, 1, 1, 1, leaseRangeForTest + 1}
+	_, err := ds.MachineInterface(mac).Machine(true, nil)
 	if err == nil {
 		t.Error("expecting 'no unassigned IP was found' error")
 		return
 	}
 }
+
+func TestReclaimExpiredLeases(t *testing.T) {
+	forEachBackend(t, nil, testReclaimExpiredLeases)
+}
+
+func testReclaimExpiredLeases(t *testing.T, ds DataSource) {
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	expiredMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	activeMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FE")
+	staticMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FD")
+
+	expired := ds.MachineInterface(expiredMac)
+	if _, err := expired.Machine(true, nil); err != nil {
+		t.Error("error in creating the expired machine:", err)
+		return
+	}
+	if err := expired.RenewLease(-2 * time.Hour); err != nil {
+		t.Error("error in renewing the lease of the expired machine:", err)
+		return
+	}
+
+	active := ds.MachineInterface(activeMac)
+	if _, err := active.Machine(true, nil); err != nil {
+		t.Error("error in creating the active machine:", err)
+		return
+	}
+	if err := active.RenewLease(time.Hour); err != nil {
+		t.Error("error in renewing the lease of the active machine:", err)
+		return
+	}
+
+	static := ds.MachineInterface(staticMac)
+	if _, err := static.Machine(true, net.IPv4(127, 0, 0, 100)); err != nil {
+		t.Error("error in creating the static machine:", err)
+		return
+	}
+	if err := static.RenewLease(-2 * time.Hour); err != nil {
+		t.Error("error in renewing the lease of the static machine:", err)
+		return
+	}
+
+	n, err := ds.ReclaimExpiredLeases(time.Hour)
+	if err != nil {
+		t.Error("error in reclaiming expired leases:", err)
+		return
+	}
+	if n != 1 {
+		t.Error("expecting exactly one reclaimed lease, got:", n)
+		return
+	}
+
+	machine, err := expired.Machine(false, nil)
+	if err != nil {
+		t.Error("error in getting the expired machine:", err)
+		return
+	}
+	if machine.IP != nil {
+		t.Error("expecting the IP of the expired machine to be reclaimed, got:", machine.IP)
+		return
+	}
+
+	machine, err = expired.Machine(true, nil)
+	if err != nil {
+		t.Error("error in getting a new IP for the expired machine:", err)
+		return
+	}
+	if machine.IP == nil {
+		t.Error("expecting the expired machine to get a new IP")
+		return
+	}
+
+	for _, mi := range []MachineInterface{active, static} {
+		machine, err := mi.Machine(false, nil)
+		if err != nil {
+			t.Error("error in getting the machine:", err)
+			return
+		}
+		if machine.IP == nil {
+			t.Errorf("IP of %s shouldn't be reclaimed", mi.Mac())
+			return
+		}
+	}
+}
+
+func TestIPIndex(t *testing.T) {
+	forEachBackend(t, nil, testIPIndex)
+}
+
+func testIPIndex(t *testing.T, ds DataSource) {
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	etcdDS := ds.(*EtcdDataSource)
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	mi := ds.MachineInterface(mac)
+	machine, err := mi.Machine(true, nil)
+	if err != nil {
+		t.Error("error in creating machine:", err)
+		return
+	}
+
+	owner, err := etcdDS.ipOwner(machine.IP)
+	if err != nil {
+		t.Error("error in getting the owner of the IP:", err)
+		return
+	}
+	if owner != mac.String() {
+		t.Errorf("expecting %s to be indexed for %s, got %q", machine.IP, mac, owner)
+		return
+	}
+
+	otherMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FE")
+	if err := etcdDS.claimIP(machine.IP, otherMac); err == nil {
+		t.Error("expecting 'the requested IP is already assigned' error")
+		return
+	}
+
+	if err := mi.DeleteMachine(); err != nil {
+		t.Error("error in deleting machine:", err)
+		return
+	}
+
+	owner, err = etcdDS.ipOwner(machine.IP)
+	if err != nil {
+		t.Error("error in getting the owner of the IP:", err)
+		return
+	}
+	if owner != "" {
+		t.Errorf("expecting %s to be released, but it's indexed for %q", machine.IP, owner)
+		return
+	}
+}
+
+func TestQuarantineIP(t *testing.T) {
+	forEachBackend(t, nil, testQuarantineIP)
+}
+
+func testQuarantineIP(t *testing.T, ds DataSource) {
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	mi := ds.MachineInterface(mac)
+	machine, err := mi.Machine(true, nil)
+	if err != nil {
+		t.Error("error in creating machine:", err)
+		return
+	}
+
+	newMachine, err := mi.QuarantineIP(time.Hour)
+	if err != nil {
+		t.Error("error in quarantining the IP:", err)
+		return
+	}
+	if newMachine.IP == nil || newMachine.IP.Equal(machine.IP) {
+		t.Errorf("expecting a new IP instead of %s, got %s", machine.IP, newMachine.IP)
+		return
+	}
+
+	otherMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FE")
+	if err := ds.(*EtcdDataSource).claimIP(machine.IP, otherMac); err == nil {
+		t.Error("expecting the quarantined IP not to be assignable")
+		return
+	}
+}
+
+func TestRecordExternalIP(t *testing.T) {
+	forEachBackend(t, nil, testRecordExternalIP)
+}
+
+func testRecordExternalIP(t *testing.T, ds DataSource) {
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	mi := ds.MachineInterface(mac)
+	ip := net.IPv4(10, 100, 0, 10).To4()
+	machine, err := mi.RecordExternalIP(ip)
+	if err != nil {
+		t.Error("error in recording the IP:", err)
+		return
+	}
+	if machine.Type != MTExternal || !machine.IP.Equal(ip) {
+		t.Errorf("expecting an external machine with %s, got %v", ip, machine)
+		return
+	}
+
+	newIP := net.IPv4(10, 100, 0, 11).To4()
+	if _, err := mi.RecordExternalIP(newIP); err != nil {
+		t.Error("error in recording the new IP:", err)
+		return
+	}
+	owner, err := ds.(*EtcdDataSource).ipOwner(ip)
+	if err != nil {
+		t.Error("error in getting the owner of the previous IP:", err)
+		return
+	}
+	if owner != "" {
+		t.Error("expecting the previous IP to be released, owned by:", owner)
+	}
+
+	otherMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FE")
+	other := ds.MachineInterface(otherMac)
+	if _, err := other.RecordExternalIP(newIP); err != nil {
+		t.Error("error in moving the IP of an external machine:", err)
+		return
+	}
+	machine, err = mi.Machine(false, nil)
+	if err != nil {
+		t.Error("error in getting the previous owner:", err)
+		return
+	}
+	if machine.IP != nil {
+		t.Error("expecting the IP to be removed from the previous owner, got", machine.IP)
+	}
+
+	normalMac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FD")
+	normal, err := ds.MachineInterface(normalMac).Machine(true, nil)
+	if err != nil {
+		t.Error("error in creating a normal machine:", err)
+		return
+	}
+	if _, err := other.RecordExternalIP(normal.IP); err == nil {
+		t.Error("expecting the IP of a normal machine not to be taken")
+	}
+}
+
+func TestMachineState(t *testing.T) {
+	forEachBackend(t, nil, testMachineState)
+}
+
+func testMachineState(t *testing.T, ds DataSource) {
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	mi := ds.MachineInterface(mac)
+	if _, err := mi.Machine(true, nil); err != nil {
+		t.Error("error in creating the machine:", err)
+		return
+	}
+
+	if changed, err := mi.AdvanceState(StateDiscovered, "dhcp", ""); err != nil || !changed {
+		t.Error("expecting the machine to be discovered:", err)
+		return
+	}
+	if changed, err := mi.AdvanceState(StateProvisioned, "web", ""); err != nil || changed {
+		t.Error("expecting discovered not to be advanced to provisioned:", err)
+		return
+	}
+	if err := mi.SetState(StateMaintenance, "test", "broken disk"); err != nil {
+		t.Error("error in setting the state:", err)
+		return
+	}
+	if changed, _ := mi.AdvanceState(StateProvisioning, "http-booter", ""); changed {
+		t.Error("expecting the machines in maintenance not to be advanced")
+	}
+	if err := mi.SetState(StateFailed, "test", ""); err == nil {
+		t.Error("expecting maintenance not to be changed to failed")
+	}
+	if err := mi.SetState("unknown", "test", ""); err == nil {
+		t.Error("expecting an error for an unknown state")
+	}
+
+	history, err := mi.StateHistory()
+	if err != nil {
+		t.Error("error in getting the state history:", err)
+		return
+	}
+	if len(history) != 2 || history[1].From != StateDiscovered ||
+		history[1].To != StateMaintenance || history[1].Reason != "broken disk" {
+		t.Errorf("unexpected state history: %v", history)
+	}
+
+	for i := 0; i < stateHistoryLimit; i++ {
+		to := StateProvisioning
+		if i%2 == 1 {
+			to = StateProvisioned
+		}
+		if err := mi.SetState(to, "test", fmt.Sprint(i)); err != nil {
+			t.Error("error in setting the state:", err)
+			return
+		}
+	}
+	history, err = mi.StateHistory()
+	if err != nil {
+		t.Error("error in getting the state history:", err)
+		return
+	}
+	if len(history) != stateHistoryLimit || history[0].Reason != "0" ||
+		history[stateHistoryLimit-1].Reason != fmt.Sprint(stateHistoryLimit-1) {
+		t.Errorf("expecting the last %d state changes, got: %v", stateHistoryLimit, history)
+	}
+}
+
+func TestProfileVariables(t *testing.T) {
+	forEachBackend(t, nil, testProfileVariables)
+}
+
+func testProfileVariables(t *testing.T, ds DataSource) {
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	mi := ds.MachineInterface(mac)
+
+	ds.SetClusterVariable("disk", "sda")
+	ds.SetClusterVariable("role", "worker")
+	ds.SetProfileVariable("storage", "disk", "md0")
+	ds.SetProfileVariable("storage", "role", "storage")
+	ds.SetProfileVariable("fast", "disk", "nvme0n1")
+	mi.SetVariable("role", "etcd")
+
+	if value, _ := mi.GetVariable("disk"); value != "sda" {
+		t.Error("expecting the cluster value without profiles, got:", value)
+	}
+
+	if err := mi.SetVariable(SpecialKeyProfiles, "fast,storage"); err != nil {
+		t.Error("error in assigning the profiles:", err)
+		return
+	}
+	if value, _ := mi.GetVariable("disk"); value != "nvme0n1" {
+		t.Error("expecting the value of the first profile, got:", value)
+	}
+	if value, _ := mi.GetVariable("role"); value != "etcd" {
+		t.Error("expecting the value of the machine, got:", value)
+	}
+
+	resolved, err := mi.ListResolvedVariables()
+	if err != nil {
+		t.Error("error in listing the resolved variables:", err)
+		return
+	}
+	expected := map[string]ResolvedVariable{
+		"disk":             {"nvme0n1", VariableSourceProfile("fast")},
+		"role":             {"etcd", VariableSourceMachine},
+		SpecialKeyProfiles: {"fast,storage", VariableSourceMachine},
+	}
+	for key, variable := range expected {
+		if resolved[key] != variable {
+			t.Errorf("expecting %s=%v, got %v", key, variable, resolved[key])
+		}
+	}
+
+	if err := ds.SetProfileVariable("storage", SpecialKeyProfiles, "fast"); err == nil {
+		t.Error("expecting the profiles of a profile not to be accepted")
+	}
+}
+
+func TestMacFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		mac  string
+		err  bool
+	}{
+		{"0011223344ff", "00:11:22:33:44:ff", false},
+		{"00:11:22:33:44:ff", "00:11:22:33:44:ff", false},
+		{"0011223344ff.cluster", "00:11:22:33:44:ff", false},
+		{"_machine", "", true},
+		{"", "", true},
+	}
+	for i, tt := range tests {
+		mac, err := macFromName(tt.name)
+		if tt.err && err == nil {
+			t.Errorf("#%d: expected error, got %s", i, mac)
+		} else if !tt.err && (err != nil || mac.String() != tt.mac) {
+			t.Errorf("#%d: expected %s, got %s, %v", i, tt.mac, mac, err)
+		}
+	}
+}
+
+func TestHiddenMachineKeys(t *testing.T) {
+	forEachBackend(t, nil, testHiddenMachineKeys)
+}
+
+func testHiddenMachineKeys(t *testing.T, ds DataSource) {
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:EE")
+	mi := ds.MachineInterface(mac)
+	if _, err := mi.Machine(true, nil); err != nil {
+		t.Fatal("error while creating machine:", err)
+	}
+	mi.CheckIn()
+	mi.SetVariable("role", "worker")
+
+	variables, err := mi.ListVariables()
+	if err != nil {
+		t.Fatal("error while listing the variables:", err)
+	}
+	if len(variables) != 1 || variables["role"] != "worker" {
+		t.Error("expecting only the variables of the machine, got:", variables)
+	}
+}
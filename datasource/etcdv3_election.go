@@ -0,0 +1,206 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"golang.org/x/net/context"
+)
+
+// electionEtcdDir is the prefix of the election keys of the instances
+const electionEtcdDir = "election"
+
+var (
+	errNotMaster  = errors.New("this is not the master instance")
+	errLeaseLost  = errors.New("the lease of this instance is lost")
+	errObserveEnd = errors.New("stopped observing the election")
+)
+
+// etcdV3 elects the master instance through the election of the v3
+// concurrency package. Each instance has a session, whose lease is kept alive
+// by the client. The key of the instance under instancesEtcdDir, and its key
+// in the election are attached to the lease, so they are removed when the
+// instance stops sending the keepalives. The instances wait for the election
+// through watches, instead of polling.
+type etcdV3 struct {
+	client *clientv3.Client
+
+	lock     sync.Mutex // guards the fields below
+	session  *concurrency.Session
+	election *concurrency.Election
+	elected  bool
+}
+
+// ensureSession returns the current session, or creates a new one and
+// registers the instance with it, if the lease of the previous one is lost
+func (v *etcdV3) ensureSession(ds *EtcdDataSource) (*concurrency.Session, *concurrency.Election, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.session != nil {
+		select {
+		case <-v.session.Done():
+			v.session, v.election, v.elected = nil, nil, false
+		default:
+			return v.session, v.election, nil
+		}
+	}
+
+	session, err := concurrency.NewSession(v.client,
+		concurrency.WithTTL(int(masterTTLTime/time.Second)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while creating the session: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	instanceKey := path.Join("/", ds.ClusterName(), instancesEtcdDir,
+		fmt.Sprintf("%016x", session.Lease()))
+	_, err = v.client.Put(ctx, instanceKey, ds.selfInfo.String(),
+		clientv3.WithLease(session.Lease()))
+	if err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("error while registering the instance: %s", err)
+	}
+
+	v.session = session
+	v.election = concurrency.NewElection(session,
+		path.Join("/", ds.ClusterName(), electionEtcdDir))
+	return v.session, v.election, nil
+}
+
+// current returns the session and the election, if this instance is elected
+func (v *etcdV3) current() (*concurrency.Session, *concurrency.Election, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.session == nil || !v.elected {
+		return nil, nil, errNotMaster
+	}
+	return v.session, v.election, nil
+}
+
+// campaign blocks until this instance is elected, or ctx is done
+func (v *etcdV3) campaign(ctx context.Context, ds *EtcdDataSource) error {
+	session, election, err := v.ensureSession(ds)
+	if err != nil {
+		return err
+	}
+	if err := election.Campaign(ctx, ds.selfInfo.String()); err != nil {
+		return fmt.Errorf("error while campaigning: %s", err)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.session != session {
+		return errLeaseLost
+	}
+	v.elected = true
+	return nil
+}
+
+// selfToken returns the fencing token of this instance, which is the
+// revision of its key in the election, and the key
+func (v *etcdV3) selfToken() (uint64, string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.election == nil {
+		return 0, ""
+	}
+	return uint64(v.election.Rev()), v.election.Key()
+}
+
+// leader returns the fencing token of the leader of the election, and its
+// key
+func (v *etcdV3) leader(ctx context.Context) (uint64, string, error) {
+	v.lock.Lock()
+	election := v.election
+	v.lock.Unlock()
+	if election == nil {
+		return 0, "", errNotMaster
+	}
+
+	resp, err := election.Leader(ctx)
+	if err != nil {
+		return 0, "", fmt.Errorf("error while getting the leader: %s", err)
+	}
+	return uint64(resp.Kvs[0].CreateRevision), string(resp.Kvs[0].Key), nil
+}
+
+// isMaster checks that this instance is still the leader of the election
+func (v *etcdV3) isMaster(ctx context.Context) error {
+	session, election, err := v.current()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-session.Done():
+		return errLeaseLost
+	default:
+	}
+
+	_, key, err := v.leader(ctx)
+	if err != nil {
+		return err
+	}
+	if key != election.Key() {
+		return errNotMaster
+	}
+	return nil
+}
+
+// keepMaster blocks while this instance is the leader, by watching the
+// election and the session
+func (v *etcdV3) keepMaster(ctx context.Context) error {
+	session, election, err := v.current()
+	if err != nil {
+		return err
+	}
+
+	observeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaders := election.Observe(observeCtx)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.Done():
+			return errLeaseLost
+		case resp, ok := <-leaders:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return errObserveEnd
+			}
+			if string(resp.Kvs[0].Key) != election.Key() {
+				return fmt.Errorf("another instance is elected: %s", resp.Kvs[0].Value)
+			}
+		}
+	}
+}
+
+// shutdown resigns from the election, and revokes the lease of the session,
+// which removes the key of the instance
+func (v *etcdV3) shutdown() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.session == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	if v.elected {
+		if err := v.election.Resign(ctx); err != nil {
+			return fmt.Errorf("error while resigning: %s", err)
+		}
+	}
+	err := v.session.Close()
+	v.session, v.election, v.elected = nil, nil, false
+	return err
+}
@@ -0,0 +1,529 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+)
+
+// v3KeysAPI implements the etcd.KeysAPI on the etcd v3 api, so the
+// EtcdDataSource can keep its data in the v3 store. The keys are the same as
+// the v2 keys, i.e. /<cluster>/machines/<machine>/<key>, so a v2 tree can be
+// copied as is (see MigrateEtcd2). The v3 store has no directories: a key is
+// a directory if there are keys under it, and the empty directories don't
+// exist. Each call is done in a single transaction, with the
+// PrevExist/PrevValue/PrevIndex conditions as its comparisons, and the TTLs
+// are leases. The writes can be fenced by the context (see withV3Fence).
+type v3KeysAPI struct {
+	client *clientv3.Client
+}
+
+var (
+	errV3WatchClosed = errors.New("the watch channel is closed")
+	errV3Fenced      = errors.New("the write is fenced, the mastership is lost")
+)
+
+// v3Fence is a key, which the writes are conditioned on its existence with
+// the create revision rev, i.e. the key of the master in the election
+type v3Fence struct {
+	key string
+	rev int64
+}
+
+type v3FenceContextKey struct{}
+
+// withV3Fence returns a context which makes the writes of v3KeysAPI with it
+// conditioned on the fence
+func withV3Fence(ctx context.Context, key string, rev int64) context.Context {
+	return context.WithValue(ctx, v3FenceContextKey{}, v3Fence{key: key, rev: rev})
+}
+
+// fenceCmps returns the comparisons and the Else operations for the fence of
+// ctx, if it has any
+func fenceCmps(ctx context.Context) ([]clientv3.Cmp, []clientv3.Op) {
+	fence, fenced := ctx.Value(v3FenceContextKey{}).(v3Fence)
+	if !fenced {
+		return nil, nil
+	}
+	return []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(fence.key), "=", fence.rev)},
+		[]clientv3.Op{clientv3.OpGet(fence.key)}
+}
+
+// fenceHolds reports whether the fence of ctx has held in the failed
+// transaction, from the result of the Else operation of fenceCmps
+func fenceHolds(ctx context.Context, resp *clientv3.TxnResponse, i int) bool {
+	fence, fenced := ctx.Value(v3FenceContextKey{}).(v3Fence)
+	if !fenced {
+		return true
+	}
+	kvs := resp.Responses[i].GetResponseRange().Kvs
+	return len(kvs) > 0 && kvs[0].CreateRevision == fence.rev
+}
+
+func newV3KeysAPI(client *clientv3.Client) *v3KeysAPI {
+	return &v3KeysAPI{client: client}
+}
+
+// keysDirPrefix returns the prefix of the keys inside the directory
+func keysDirPrefix(dir string) string {
+	if dir == "/" {
+		return dir
+	}
+	return dir + "/"
+}
+
+func v3Node(kv *mvccpb.KeyValue) *etcd.Node {
+	return &etcd.Node{
+		Key:           string(kv.Key),
+		Value:         string(kv.Value),
+		CreatedIndex:  uint64(kv.CreateRevision),
+		ModifiedIndex: uint64(kv.ModRevision),
+	}
+}
+
+// v3DirNode builds the directory node of dir from the keys under it, up to
+// the given depth. A negative depth includes all the descendants. The hidden
+// nodes are left out with their descendants, as etcd v2 does (see
+// isHiddenKey).
+func v3DirNode(dir string, kvs []*mvccpb.KeyValue, depth int) *etcd.Node {
+	root := &etcd.Node{Key: dir, Dir: true}
+	dirs := map[string]*etcd.Node{dir: root}
+	prefix := keysDirPrefix(dir)
+
+	for _, kv := range kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		parent := root
+		for i, part := range parts {
+			if (depth >= 0 && i >= depth) || strings.HasPrefix(part, "_") {
+				break
+			}
+			if i == len(parts)-1 {
+				parent.Nodes = append(parent.Nodes, v3Node(kv))
+				break
+			}
+			childKey := path.Join(parent.Key, part)
+			child, found := dirs[childKey]
+			if !found {
+				child = &etcd.Node{
+					Key:           childKey,
+					Dir:           true,
+					CreatedIndex:  uint64(kv.CreateRevision),
+					ModifiedIndex: uint64(kv.ModRevision),
+				}
+				dirs[childKey] = child
+				parent.Nodes = append(parent.Nodes, child)
+			}
+			parent = child
+		}
+	}
+	return root
+}
+
+// v3CompareError returns the error for a failed comparison on the key, from
+// the current value of the key
+func v3CompareError(key string, kvs []*mvccpb.KeyValue, prevExist etcd.PrevExistType,
+	index uint64) error {
+	if len(kvs) == 0 {
+		return keysAPIError(etcd.ErrorCodeKeyNotFound, key, index)
+	}
+	if prevExist == etcd.PrevNoExist {
+		return keysAPIError(etcd.ErrorCodeNodeExist, key, index)
+	}
+	return keysAPIError(etcd.ErrorCodeTestFailed, key, index)
+}
+
+// grant creates a lease for the keys with the given TTL, rounded up to
+// seconds
+func (api *v3KeysAPI) grant(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, error) {
+	seconds := int64(ttl / time.Second)
+	if ttl%time.Second != 0 {
+		seconds++
+	}
+	resp, err := api.client.Grant(ctx, seconds)
+	if err != nil {
+		return clientv3.NoLease, fmt.Errorf("error while granting a lease: %s", err)
+	}
+	return resp.ID, nil
+}
+
+// v3GetBatchSize is the number of the keys which are read in each
+// transaction, below the default limit of the operations of a transaction
+const v3GetBatchSize = 64
+
+// Get retrieves a set of Nodes from the v3 store. The non-recursive listings
+// read the keys under the directory without their values, and then the
+// values of the children only, so the large subtrees, i.e. the boot events
+// of the machines, aren't loaded for them.
+func (api *v3KeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	key = normalizeKey(key)
+	recursive := opts != nil && opts.Recursive
+
+	childrenOpts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if !recursive {
+		childrenOpts = append(childrenOpts, clientv3.WithKeysOnly())
+	}
+	resp, err := api.client.Txn(ctx).Then(
+		clientv3.OpGet(key),
+		clientv3.OpGet(keysDirPrefix(key), childrenOpts...),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	index := uint64(resp.Header.Revision)
+
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		return &etcd.Response{Action: "get", Node: v3Node(kvs[0]), Index: index}, nil
+	}
+	children := resp.Responses[1].GetResponseRange().Kvs
+	if len(children) == 0 && key != "/" {
+		return nil, keysAPIError(etcd.ErrorCodeKeyNotFound, key, index)
+	}
+	if recursive {
+		return &etcd.Response{
+			Action: "get",
+			Node:   v3DirNode(key, children, -1),
+			Index:  index,
+		}, nil
+	}
+
+	node := v3DirNode(key, children, 1)
+	if err := api.fillValues(ctx, node.Nodes, resp.Header.Revision); err != nil {
+		return nil, err
+	}
+	return &etcd.Response{Action: "get", Node: node, Index: index}, nil
+}
+
+// fillValues reads the values of the nodes which are not directories, at
+// the given revision
+func (api *v3KeysAPI) fillValues(ctx context.Context, nodes etcd.Nodes, rev int64) error {
+	var leaves []*etcd.Node
+	for _, node := range nodes {
+		if !node.Dir {
+			leaves = append(leaves, node)
+		}
+	}
+	for start := 0; start < len(leaves); start += v3GetBatchSize {
+		batch := leaves[start:]
+		if len(batch) > v3GetBatchSize {
+			batch = batch[:v3GetBatchSize]
+		}
+		ops := make([]clientv3.Op, len(batch))
+		for i, node := range batch {
+			ops[i] = clientv3.OpGet(node.Key, clientv3.WithRev(rev))
+		}
+		resp, err := api.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		for i, node := range batch {
+			if kvs := resp.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+				node.Value = string(kvs[0].Value)
+			}
+		}
+	}
+	return nil
+}
+
+// Set assigns a new value to a Node identified by a given key, with the
+// conditions of opts. Since the directories are implicit, setting a
+// directory is a no-op.
+func (api *v3KeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	key = normalizeKey(key)
+	if opts == nil {
+		opts = &etcd.SetOptions{}
+	}
+	if key == "/" {
+		return nil, keysAPIError(etcd.ErrorCodeRootROnly, key, 0)
+	}
+	if opts.Dir {
+		return &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Dir: true}}, nil
+	}
+
+	var cmps []clientv3.Cmp
+	switch opts.PrevExist {
+	case etcd.PrevNoExist:
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+	case etcd.PrevExist:
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), ">", 0))
+	}
+	if opts.PrevValue != "" {
+		cmps = append(cmps, clientv3.Compare(clientv3.Value(key), "=", opts.PrevValue))
+	}
+	if opts.PrevIndex != 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(opts.PrevIndex)))
+	}
+	fenceCmp, fenceOps := fenceCmps(ctx)
+	cmps = append(cmps, fenceCmp...)
+
+	putOpts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	lease := clientv3.NoLease
+	if opts.TTL > 0 {
+		var err error
+		lease, err = api.grant(ctx, opts.TTL)
+		if err != nil {
+			return nil, err
+		}
+		putOpts = append(putOpts, clientv3.WithLease(lease))
+	}
+
+	resp, err := api.client.Txn(ctx).If(cmps...).Then(
+		clientv3.OpPut(key, value, putOpts...),
+	).Else(
+		append([]clientv3.Op{clientv3.OpGet(key)}, fenceOps...)...,
+	).Commit()
+	if err == nil && !resp.Succeeded {
+		if fenceHolds(ctx, resp, 1) {
+			err = v3CompareError(key, resp.Responses[0].GetResponseRange().Kvs,
+				opts.PrevExist, uint64(resp.Header.Revision))
+		} else {
+			err = errV3Fenced
+		}
+	}
+	if err != nil {
+		if lease != clientv3.NoLease {
+			api.client.Revoke(ctx, lease)
+		}
+		return nil, err
+	}
+
+	index := uint64(resp.Header.Revision)
+	ret := &etcd.Response{
+		Action: "set",
+		Node:   &etcd.Node{Key: key, Value: value, CreatedIndex: index, ModifiedIndex: index},
+		Index:  index,
+	}
+	if prev := resp.Responses[0].GetResponsePut().PrevKv; prev != nil {
+		ret.PrevNode = v3Node(prev)
+		ret.Node.CreatedIndex = uint64(prev.CreateRevision)
+	}
+	return ret, nil
+}
+
+// Delete removes a Node identified by the given key, with the conditions of
+// opts. The directories are removed only with opts.Recursive.
+func (api *v3KeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	key = normalizeKey(key)
+	if opts == nil {
+		opts = &etcd.DeleteOptions{}
+	}
+	if key == "/" {
+		return nil, keysAPIError(etcd.ErrorCodeRootROnly, key, 0)
+	}
+
+	var cmps []clientv3.Cmp
+	if opts.PrevValue != "" {
+		cmps = append(cmps, clientv3.Compare(clientv3.Value(key), "=", opts.PrevValue))
+	}
+	if opts.PrevIndex != 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(opts.PrevIndex)))
+	}
+	fenceCmp, fenceOps := fenceCmps(ctx)
+	cmps = append(cmps, fenceCmp...)
+
+	ops := []clientv3.Op{clientv3.OpDelete(key, clientv3.WithPrevKV())}
+	if opts.Recursive {
+		ops = append(ops, clientv3.OpDelete(keysDirPrefix(key), clientv3.WithPrefix()))
+	} else {
+		children, err := api.client.Get(ctx, keysDirPrefix(key), clientv3.WithPrefix(),
+			clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		if children.Count > 0 {
+			index := uint64(children.Header.Revision)
+			if opts.Dir {
+				return nil, keysAPIError(etcd.ErrorCodeDirNotEmpty, key, index)
+			}
+			return nil, keysAPIError(etcd.ErrorCodeNotFile, key, index)
+		}
+	}
+
+	resp, err := api.client.Txn(ctx).If(cmps...).Then(ops...).Else(
+		append([]clientv3.Op{clientv3.OpGet(key)}, fenceOps...)...,
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	index := uint64(resp.Header.Revision)
+	if !resp.Succeeded {
+		if !fenceHolds(ctx, resp, 1) {
+			return nil, errV3Fenced
+		}
+		return nil, v3CompareError(key, resp.Responses[0].GetResponseRange().Kvs,
+			etcd.PrevIgnore, index)
+	}
+
+	deleted := resp.Responses[0].GetResponseDeleteRange()
+	ret := &etcd.Response{
+		Action: "delete",
+		Node:   &etcd.Node{Key: key, ModifiedIndex: index},
+		Index:  index,
+	}
+	if len(deleted.PrevKvs) > 0 {
+		ret.PrevNode = v3Node(deleted.PrevKvs[0])
+		ret.Node.CreatedIndex = ret.PrevNode.CreatedIndex
+	} else if opts.Recursive && resp.Responses[1].GetResponseDeleteRange().Deleted > 0 {
+		ret.Node.Dir = true
+	} else {
+		return nil, keysAPIError(etcd.ErrorCodeKeyNotFound, key, index)
+	}
+	return ret, nil
+}
+
+// Create is an alias for Set w/ PrevExist=false
+func (api *v3KeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return api.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+}
+
+// CreateInOrder creates a key in the given directory, named after the
+// revision of the store, so the keys of the directory are sorted by their
+// creation. The keys which are copied from v2 are named after the v2
+// indexes, so the name is kept greater than the last key of the directory.
+func (api *v3KeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	dir = normalizeKey(dir)
+	prefix := keysDirPrefix(dir)
+
+	var putOpts []clientv3.OpOption
+	if opts != nil && opts.TTL > 0 {
+		lease, err := api.grant(ctx, opts.TTL)
+		if err != nil {
+			return nil, err
+		}
+		putOpts = append(putOpts, clientv3.WithLease(lease))
+	}
+
+	for {
+		last, err := api.client.Get(ctx, prefix, clientv3.WithLastKey()...)
+		if err != nil {
+			return nil, err
+		}
+		next := uint64(last.Header.Revision) + 1
+		if len(last.Kvs) > 0 {
+			name := strings.SplitN(strings.TrimPrefix(string(last.Kvs[0].Key), prefix), "/", 2)[0]
+			if lastIndex, err := strconv.ParseUint(name, 10, 64); err == nil && lastIndex >= next {
+				next = lastIndex + 1
+			}
+		}
+
+		key := path.Join(dir, fmt.Sprintf("%020d", next))
+		resp, err := api.client.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+		).Then(
+			clientv3.OpPut(key, value, putOpts...),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			index := uint64(resp.Header.Revision)
+			return &etcd.Response{
+				Action: "create",
+				Node:   &etcd.Node{Key: key, Value: value, CreatedIndex: index, ModifiedIndex: index},
+				Index:  index,
+			}, nil
+		}
+		// the key is created concurrently, trying the next one
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Update is an alias for Set w/ PrevExist=true
+func (api *v3KeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return api.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevExist})
+}
+
+// Watcher returns a Watcher which watches the key, or the keys under it if
+// opts.Recursive is set, through a v3 watch
+func (api *v3KeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	w := &v3Watcher{client: api.client, key: normalizeKey(key)}
+	if opts != nil {
+		w.recursive = opts.Recursive
+		w.afterIndex = opts.AfterIndex
+	}
+	return w
+}
+
+// v3Watcher converts the events of a v3 watch to the v2 responses. Like the
+// requests of the v2 watchers, each call to Next makes its own watch, which
+// is canceled when it returns, and the next call resumes after the events
+// which are already received.
+type v3Watcher struct {
+	client     *clientv3.Client
+	key        string
+	recursive  bool
+	afterIndex uint64
+
+	events []*clientv3.Event
+}
+
+// Next blocks until an event is received for the watched keys
+func (w *v3Watcher) Next(ctx context.Context) (*etcd.Response, error) {
+	var watchChan clientv3.WatchChan
+	for {
+		for len(w.events) > 0 {
+			event := w.events[0]
+			w.events = w.events[1:]
+
+			// the prefix of the key also matches its siblings, like /a for /ab
+			eventKey := string(event.Kv.Key)
+			if eventKey != w.key && !strings.HasPrefix(eventKey, keysDirPrefix(w.key)) {
+				continue
+			}
+
+			resp := &etcd.Response{
+				Action: "set",
+				Node:   v3Node(event.Kv),
+				Index:  uint64(event.Kv.ModRevision),
+			}
+			if event.PrevKv != nil {
+				resp.PrevNode = v3Node(event.PrevKv)
+			}
+			if event.Type == clientv3.EventTypeDelete {
+				resp.Action = "delete"
+			} else if event.IsCreate() {
+				resp.Action = "create"
+			}
+			return resp, nil
+		}
+
+		if watchChan == nil {
+			watchCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			watchOpts := []clientv3.OpOption{clientv3.WithPrevKV()}
+			if w.recursive {
+				watchOpts = append(watchOpts, clientv3.WithPrefix())
+			}
+			if w.afterIndex != 0 {
+				watchOpts = append(watchOpts, clientv3.WithRev(int64(w.afterIndex)+1))
+			}
+			watchChan = w.client.Watch(watchCtx, w.key, watchOpts...)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case watchResp, ok := <-watchChan:
+			if !ok {
+				return nil, errV3WatchClosed
+			}
+			if err := watchResp.Err(); err != nil {
+				return nil, err
+			}
+			w.events = watchResp.Events
+			if len(w.events) > 0 {
+				// the events of a revision are received together
+				w.afterIndex = uint64(w.events[len(w.events)-1].Kv.ModRevision)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package datasource
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// v3KeysAPIForTest returns a v3KeysAPI on the etcd at ETCD_ENDPOINT, and a
+// directory for the keys of the test, which is purged by the returned func.
+// The test is skipped if ETCD_ENDPOINT is not set.
+func v3KeysAPIForTest(t *testing.T) (*v3KeysAPI, string, func()) {
+	if os.Getenv("ETCD_ENDPOINT") == "" {
+		t.Skip("ETCD_ENDPOINT is not set")
+	}
+	client, err := etcdClietForTest()
+	if err != nil {
+		t.Fatal("etcd instance not found:", err)
+	}
+
+	forTestLock.Lock()
+	dir := fmt.Sprintf("/blacksmith-keys-%04d", forTestIndex)
+	forTestIndex++
+	forTestLock.Unlock()
+
+	purge := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+		client.Delete(ctx, keysDirPrefix(dir), clientv3.WithPrefix())
+	}
+	purge()
+	return newV3KeysAPI(client), dir, func() {
+		purge()
+		client.Close()
+	}
+}
+
+func TestV3KeysAPISet(t *testing.T) {
+	api, dir, cleanup := v3KeysAPIForTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	key := path.Join(dir, "k")
+
+	if _, err := api.Set(ctx, key, "v1", &etcd.SetOptions{PrevExist: etcd.PrevNoExist}); err != nil {
+		t.Fatal("error while creating the key:", err)
+	}
+	_, err := api.Set(ctx, key, "v2", &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if !isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+		t.Error("expecting the node exist error, got:", err)
+	}
+	_, err = api.Set(ctx, key, "v2", &etcd.SetOptions{PrevValue: "x"})
+	if !isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		t.Error("expecting the test failed error, got:", err)
+	}
+	_, err = api.Set(ctx, path.Join(dir, "missing"), "v", &etcd.SetOptions{PrevExist: etcd.PrevExist})
+	if !etcd.IsKeyNotFound(err) {
+		t.Error("expecting the key not found error, got:", err)
+	}
+
+	resp, err := api.Set(ctx, key, "v2", &etcd.SetOptions{PrevValue: "v1"})
+	if err != nil {
+		t.Fatal("error while setting the key:", err)
+	}
+	if resp.PrevNode == nil || resp.PrevNode.Value != "v1" {
+		t.Errorf("unexpected previous node: %v", resp.PrevNode)
+	}
+	_, err = api.Set(ctx, key, "v3", &etcd.SetOptions{PrevIndex: resp.Index + 1})
+	if !isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		t.Error("expecting the test failed error for the index, got:", err)
+	}
+
+	got, err := api.Get(ctx, key, nil)
+	if err != nil || got.Node.Value != "v2" {
+		t.Errorf("expecting v2, got: %v %v", got, err)
+	}
+
+	// the writes with the fence of a lost mastership fail
+	fenceKey := path.Join(dir, "fence")
+	put, err := api.client.Put(ctx, fenceKey, "")
+	if err != nil {
+		t.Fatal("error while creating the fence key:", err)
+	}
+	fenced := withV3Fence(ctx, fenceKey, put.Header.Revision)
+	if _, err := api.Set(fenced, key, "v3", nil); err != nil {
+		t.Error("expecting the fence to hold:", err)
+	}
+	fenced = withV3Fence(ctx, fenceKey, put.Header.Revision+1)
+	if _, err := api.Set(fenced, key, "v4", nil); err != errV3Fenced {
+		t.Error("expecting the write to be fenced, got:", err)
+	}
+	if _, err := api.Delete(fenced, key, nil); err != errV3Fenced {
+		t.Error("expecting the delete to be fenced, got:", err)
+	}
+}
+
+func TestV3KeysAPIGet(t *testing.T) {
+	api, dir, cleanup := v3KeysAPIForTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// more children than a batch of fillValues
+	for i := 0; i < v3GetBatchSize+6; i++ {
+		api.Set(ctx, path.Join(dir, "m", fmt.Sprintf("k%03d", i)), fmt.Sprint(i), nil)
+	}
+	api.Set(ctx, path.Join(dir, "m", "sub", "k"), "v", nil)
+	api.Set(ctx, path.Join(dir, "m", "_hidden"), "h", nil)
+
+	resp, err := api.Get(ctx, path.Join(dir, "m"), nil)
+	if err != nil {
+		t.Fatal("error while listing the directory:", err)
+	}
+	if len(resp.Node.Nodes) != v3GetBatchSize+7 {
+		t.Fatalf("expecting %d children, got %d", v3GetBatchSize+7, len(resp.Node.Nodes))
+	}
+	for i, node := range resp.Node.Nodes[:v3GetBatchSize+6] {
+		if node.Value != fmt.Sprint(i) {
+			t.Errorf("unexpected value of %s: %q", node.Key, node.Value)
+		}
+	}
+	if sub := resp.Node.Nodes[v3GetBatchSize+6]; !sub.Dir || len(sub.Nodes) != 0 {
+		t.Errorf("expecting the sub directory without its children, got: %v", sub)
+	}
+
+	resp, err = api.Get(ctx, path.Join(dir, "m", "_hidden"), nil)
+	if err != nil || resp.Node.Value != "h" {
+		t.Errorf("expecting the hidden key by its name, got: %v %v", resp, err)
+	}
+	if _, err := api.Get(ctx, path.Join(dir, "missing"), nil); !etcd.IsKeyNotFound(err) {
+		t.Error("expecting the key not found error, got:", err)
+	}
+}
+
+func TestV3KeysAPIDelete(t *testing.T) {
+	api, dir, cleanup := v3KeysAPIForTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	api.Set(ctx, path.Join(dir, "a"), "v", nil)
+	api.Set(ctx, path.Join(dir, "d", "b"), "v", nil)
+
+	_, err := api.Delete(ctx, path.Join(dir, "d"), nil)
+	if !isEtcdErrorCode(err, etcd.ErrorCodeNotFile) {
+		t.Error("expecting the not a file error, got:", err)
+	}
+	_, err = api.Delete(ctx, path.Join(dir, "d"), &etcd.DeleteOptions{Dir: true})
+	if !isEtcdErrorCode(err, etcd.ErrorCodeDirNotEmpty) {
+		t.Error("expecting the directory not empty error, got:", err)
+	}
+	resp, err := api.Delete(ctx, path.Join(dir, "d"), &etcd.DeleteOptions{Dir: true, Recursive: true})
+	if err != nil || !resp.Node.Dir {
+		t.Errorf("expecting the directory to be deleted, got: %v %v", resp, err)
+	}
+	if _, err := api.Get(ctx, path.Join(dir, "d", "b"), nil); !etcd.IsKeyNotFound(err) {
+		t.Error("expecting the children to be deleted, got:", err)
+	}
+
+	_, err = api.Delete(ctx, path.Join(dir, "a"), &etcd.DeleteOptions{PrevValue: "x"})
+	if !isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		t.Error("expecting the test failed error, got:", err)
+	}
+	resp, err = api.Delete(ctx, path.Join(dir, "a"), &etcd.DeleteOptions{PrevValue: "v"})
+	if err != nil || resp.PrevNode == nil || resp.PrevNode.Value != "v" {
+		t.Errorf("expecting the key to be deleted, got: %v %v", resp, err)
+	}
+	if _, err := api.Delete(ctx, path.Join(dir, "a"), nil); !etcd.IsKeyNotFound(err) {
+		t.Error("expecting the key not found error, got:", err)
+	}
+}
+
+func TestV3KeysAPICreateInOrder(t *testing.T) {
+	api, dir, cleanup := v3KeysAPIForTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	queue := path.Join(dir, "q")
+
+	var keys []string
+	for _, value := range []string{"1", "2", "3"} {
+		resp, err := api.CreateInOrder(ctx, queue, value, &etcd.CreateInOrderOptions{TTL: time.Minute})
+		if err != nil {
+			t.Fatal("error while creating in order:", err)
+		}
+		keys = append(keys, resp.Node.Key)
+	}
+	resp, err := api.Get(ctx, queue, &etcd.GetOptions{Sort: true})
+	if err != nil || len(resp.Node.Nodes) != 3 {
+		t.Fatalf("expecting 3 keys, got: %v %v", resp, err)
+	}
+	for i, node := range resp.Node.Nodes {
+		if node.Key != keys[i] || node.Value != fmt.Sprint(i+1) {
+			t.Errorf("unexpected key %d: %s=%s", i, node.Key, node.Value)
+		}
+	}
+
+	// the keys which are copied from v2 are named after the v2 indexes
+	api.Set(ctx, path.Join(queue, "00000000100000000000"), "v2", nil)
+	created, err := api.CreateInOrder(ctx, queue, "4", nil)
+	if err != nil || created.Node.Key != path.Join(queue, "00000000100000000001") {
+		t.Errorf("expecting the key after the copied one, got: %v %v", created, err)
+	}
+}
+
+func TestV3Watcher(t *testing.T) {
+	api, dir, cleanup := v3KeysAPIForTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	key := path.Join(dir, "w")
+
+	resp, err := api.Set(ctx, key, "0", nil)
+	if err != nil {
+		t.Fatal("error while setting the key:", err)
+	}
+	watcher := api.Watcher(key, &etcd.WatcherOptions{AfterIndex: resp.Index})
+	api.Set(ctx, key, "1", nil)
+	api.Set(ctx, key, "2", nil)
+
+	// each call makes its own watch, and resumes after the previous one
+	for _, value := range []string{"1", "2"} {
+		nextCtx, cancel := context.WithTimeout(ctx, etcdTimeout)
+		event, err := watcher.Next(nextCtx)
+		cancel()
+		if err != nil || event.Node.Value != value {
+			t.Fatalf("expecting the event of %s, got: %v %v", value, event, err)
+		}
+	}
+
+	nextCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if event, err := watcher.Next(nextCtx); err != context.DeadlineExceeded {
+		t.Errorf("expecting the deadline to be exceeded, got: %v %v", event, err)
+	}
+}
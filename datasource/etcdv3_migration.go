@@ -0,0 +1,131 @@
+package datasource
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// machineHiddenKeys are the hidden keys of each machine directory. etcd v2
+// leaves the hidden nodes out of the directory listings, so they're copied
+// by their names.
+var machineHiddenKeys = []string{
+	"_machine",
+	"_last_seen",
+	"_lease_expiry",
+	stateKey,
+	bootEventsDirName,
+	stateHistoryDirName,
+}
+
+// MigrateEtcd2 copies the data of the cluster, i.e. the machines, the
+// cluster variables and the instances, and the config of skydns from the v2
+// store of etcd into the v3 store. The keys are kept as they are, along with
+// their TTLs. It refuses to run if the v3 store already has any keys of the
+// cluster, since a partial copy, i.e. of an interrupted migration, can't be
+// told apart from the data which is written by the instances; such keys
+// should be deleted before running it again. It returns the number of the
+// copied keys.
+func MigrateEtcd2(kapi etcd.KeysAPI, client *clientv3.Client, clusterName string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	resp, err := client.Get(ctx, normalizeKey(clusterName)+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("error while checking the v3 store: %s", err)
+	}
+	if resp.Count > 0 {
+		return 0, fmt.Errorf("the v3 store already has %d keys under %s, delete them to migrate again",
+			resp.Count, normalizeKey(clusterName))
+	}
+	return copyKeys(kapi, newV3KeysAPI(client), clusterName, "skydns")
+}
+
+// copyKeys copies the keys of the given directories between the stores. The
+// hidden keys of the machines of the cluster directory (the first one) are
+// copied too.
+func copyKeys(from etcd.KeysAPI, to etcd.KeysAPI, clusterName string, dirs ...string) (int, error) {
+	copied := 0
+	for _, dir := range append([]string{clusterName}, dirs...) {
+		n, err := copyTree(from, to, dir)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	response, err := from.Get(ctx, path.Join(clusterName, etcdMachinesDirName), nil)
+	cancel()
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return copied, nil
+		}
+		return copied, fmt.Errorf("error while listing the machines: %s", err)
+	}
+	for _, machine := range response.Node.Nodes {
+		if !machine.Dir {
+			continue
+		}
+		for _, key := range machineHiddenKeys {
+			n, err := copyTree(from, to, path.Join(machine.Key, key))
+			copied += n
+			if err != nil {
+				return copied, err
+			}
+		}
+	}
+	return copied, nil
+}
+
+// copyTree copies the key, or the directory with its listed descendants,
+// between the stores
+func copyTree(from etcd.KeysAPI, to etcd.KeysAPI, key string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	response, err := from.Get(ctx, key, &etcd.GetOptions{Recursive: true, Sort: true})
+	cancel()
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error while reading %s: %s", key, err)
+	}
+	return copyNode(to, response.Node)
+}
+
+func copyNode(to etcd.KeysAPI, node *etcd.Node) (int, error) {
+	if node.Dir {
+		copied := 0
+		for _, child := range node.Nodes {
+			n, err := copyNode(to, child)
+			copied += n
+			if err != nil {
+				return copied, err
+			}
+		}
+		return copied, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := to.Set(ctx, node.Key, node.Value, &etcd.SetOptions{
+		PrevExist: etcd.PrevNoExist,
+		TTL:       time.Duration(node.TTL) * time.Second,
+	})
+	if err != nil {
+		if isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+			log.WithFields(log.Fields{
+				"where":  "datasource.MigrateEtcd2",
+				"action": "skip",
+				"object": node.Key,
+			}).Debug("already exists")
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error while copying %s: %s", node.Key, err)
+	}
+	return 1, nil
+}
@@ -0,0 +1,147 @@
+package datasource
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+)
+
+func localKeysAPIForTest(t *testing.T) (*localKeysAPI, func()) {
+	dbFile, err := ioutil.TempFile("", "blacksmith-local")
+	if err != nil {
+		t.Fatal("error while creating temp file:", err)
+	}
+	dbFile.Close()
+
+	kapi, err := newLocalKeysAPI(dbFile.Name())
+	if err != nil {
+		os.Remove(dbFile.Name())
+		t.Fatal("error while opening the local store:", err)
+	}
+	return kapi, func() {
+		kapi.Close()
+		os.Remove(dbFile.Name())
+	}
+}
+
+func TestCopyKeys(t *testing.T) {
+	from, closeFrom := localKeysAPIForTest(t)
+	defer closeFrom()
+	to, closeTo := localKeysAPIForTest(t)
+	defer closeTo()
+	ctx := context.Background()
+
+	// the hidden keys are left out of the listings of the source, as etcd v2
+	// does
+	from.Set(ctx, "c/machines/m1/_machine", `{"ip": "10.0.0.2"}`, nil)
+	from.Set(ctx, "c/machines/m1/_state", "provisioned", nil)
+	from.CreateInOrder(ctx, "c/machines/m1/_boot_events", "{}", nil)
+	from.Set(ctx, "c/machines/m1/k", "v", nil)
+	from.Set(ctx, "c/cluster-variables/k", "v", nil)
+	from.Set(ctx, "c/instances/i1", "{}", &etcd.SetOptions{TTL: time.Minute})
+	from.Set(ctx, "other/k", "v", nil)
+	to.Set(ctx, "c/cluster-variables/k", "kept", nil)
+
+	copied, err := copyKeys(from, to, "c", "skydns")
+	if err != nil {
+		t.Error("unexpected error:", err)
+		return
+	}
+	if copied != 5 {
+		t.Error("expecting 5 keys to be copied, got:", copied)
+	}
+
+	resp, err := to.Get(ctx, "c/machines/m1/_machine", nil)
+	if err != nil || resp.Node.Value != `{"ip": "10.0.0.2"}` {
+		t.Errorf("expecting the machine to be copied, got: %v %v", resp, err)
+	}
+	resp, err = to.Get(ctx, "c/machines/m1/_boot_events", nil)
+	if err != nil || len(resp.Node.Nodes) != 1 {
+		t.Errorf("expecting the boot events to be copied, got: %v %v", resp, err)
+	}
+	resp, err = to.Get(ctx, "c/cluster-variables/k", nil)
+	if err != nil || resp.Node.Value != "kept" {
+		t.Errorf("expecting the existing key to be kept, got: %v %v", resp, err)
+	}
+	resp, err = to.Get(ctx, "c/instances/i1", nil)
+	if err != nil || resp.Node.TTL <= 0 {
+		t.Errorf("expecting the TTL of the instance to be copied, got: %v %v", resp, err)
+	}
+	if _, err := to.Get(ctx, "other/k", nil); !etcd.IsKeyNotFound(err) {
+		t.Error("expecting the other keys not to be copied, got:", err)
+	}
+}
+
+func TestMigrateEtcd2(t *testing.T) {
+	api, cluster, cleanup := v3KeysAPIForTest(t)
+	defer cleanup()
+	etcdClient, err := etcd2ClietForTest()
+	if err != nil {
+		t.Fatal("etcd instance not found:", err)
+	}
+	kapi := etcd.NewKeysAPI(etcdClient)
+	ctx := context.Background()
+	defer kapi.Delete(ctx, cluster, &etcd.DeleteOptions{Dir: true, Recursive: true})
+
+	kapi.Set(ctx, cluster+"/machines/m1/_machine", `{"ip": "10.0.0.2"}`, nil)
+	kapi.CreateInOrder(ctx, cluster+"/machines/m1/_boot_events", "{}", nil)
+	kapi.Set(ctx, cluster+"/machines/m1/k", "v", nil)
+	kapi.Set(ctx, cluster+"/cluster-variables/k", "v", nil)
+
+	if _, err := MigrateEtcd2(kapi, api.client, cluster); err != nil {
+		t.Fatal("error while migrating:", err)
+	}
+	resp, err := api.Get(ctx, cluster+"/machines/m1/_machine", nil)
+	if err != nil || resp.Node.Value != `{"ip": "10.0.0.2"}` {
+		t.Errorf("expecting the machine to be migrated, got: %v %v", resp, err)
+	}
+	resp, err = api.Get(ctx, cluster+"/machines/m1/_boot_events", nil)
+	if err != nil || len(resp.Node.Nodes) != 1 {
+		t.Errorf("expecting the boot events to be migrated, got: %v %v", resp, err)
+	}
+	resp, err = api.Get(ctx, cluster+"/cluster-variables/k", nil)
+	if err != nil || resp.Node.Value != "v" {
+		t.Errorf("expecting the cluster variable to be migrated, got: %v %v", resp, err)
+	}
+
+	// the v3 tree is filled, so it's not migrated again
+	if _, err := MigrateEtcd2(kapi, api.client, cluster); err == nil {
+		t.Error("expecting the migration to refuse a filled v3 tree")
+	}
+}
+
+func TestV3DirNode(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/c/machines/_machine"), Value: []byte("{}")},
+		{Key: []byte("/c/machines/m1/_machine"), Value: []byte("{}")},
+		{Key: []byte("/c/machines/m1/_boot_events/01"), Value: []byte("e")},
+		{Key: []byte("/c/machines/m1/events/01"), Value: []byte("e")},
+		{Key: []byte("/c/machines/m1/k"), Value: []byte("v")},
+		{Key: []byte("/c/machines/m2/_machine"), Value: []byte("{}")},
+		{Key: []byte("/c/machines/name"), Value: []byte("x")},
+	}
+
+	node := v3DirNode("/c/machines", kvs, 1)
+	if len(node.Nodes) != 3 || !node.Nodes[0].Dir || node.Nodes[0].Key != "/c/machines/m1" ||
+		len(node.Nodes[0].Nodes) != 0 || !node.Nodes[1].Dir || node.Nodes[2].Value != "x" {
+		t.Errorf("unexpected children: %v", node.Nodes)
+		return
+	}
+
+	// the hidden nodes are left out, as etcd v2 does
+	node = v3DirNode("/c/machines", kvs, -1)
+	m1 := node.Nodes[0]
+	if len(m1.Nodes) != 2 || m1.Nodes[0].Key != "/c/machines/m1/events" ||
+		len(m1.Nodes[0].Nodes) != 1 || m1.Nodes[1].Value != "v" {
+		t.Errorf("unexpected descendants of m1: %v", m1.Nodes)
+	}
+	node = v3DirNode("/c/machines/m1/_boot_events", kvs[2:3], 1)
+	if len(node.Nodes) != 1 || node.Nodes[0].Value != "e" {
+		t.Errorf("expecting the children of the hidden directory, got: %v", node.Nodes)
+	}
+}
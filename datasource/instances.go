@@ -2,8 +2,11 @@ package datasource
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"path"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -35,6 +38,7 @@ func (ds *EtcdDataSource) registerOnEtcd() error {
 	}
 
 	ds.instanceEtcdKey = resp.Node.Key
+	ds.instanceToken = resp.Node.CreatedIndex
 	return nil
 }
 
@@ -49,10 +53,18 @@ func (ds *EtcdDataSource) etcdHeartbeat() error {
 	return err
 }
 
-// IsMaster checks for being master
-func (ds *EtcdDataSource) IsMaster() error {
+// masterToken returns the fencing token of the current master, and its key.
+// The master is the instance with the oldest key, so the token is the index
+// (or the revision, with etcd v3) which the key is created at.
+func (ds *EtcdDataSource) masterToken() (uint64, string, error) {
+	if ds.alwaysMaster {
+		return ds.instanceToken, ds.instanceEtcdKey, nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
 	defer cancel()
+	if ds.v3 != nil {
+		return ds.v3.leader(ctx)
+	}
 	masterGetOptions := etcd.GetOptions{
 		Recursive: true,
 		Quorum:    true,
@@ -60,39 +72,87 @@ func (ds *EtcdDataSource) IsMaster() error {
 	}
 	resp, err := ds.keysAPI.Get(ctx, path.Join(ds.ClusterName(), instancesEtcdDir), &masterGetOptions)
 	if err != nil {
-		return fmt.Errorf("error while getting the dir list from etcd: %s", err)
+		return 0, "", fmt.Errorf("error while getting the dir list from etcd: %s", err)
 	}
 	if len(resp.Node.Nodes) < 1 {
-		return fmt.Errorf("empty list while getting the dir list from etcd")
+		return 0, "", fmt.Errorf("empty list while getting the dir list from etcd")
+	}
+	return resp.Node.Nodes[0].CreatedIndex, resp.Node.Nodes[0].Key, nil
+}
+
+// IsMaster checks for being master
+func (ds *EtcdDataSource) IsMaster() error {
+	if ds.alwaysMaster {
+		return nil
+	}
+	if ds.v3 != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+		return ds.v3.isMaster(ctx)
+	}
+	_, key, err := ds.masterToken()
+	if err != nil {
+		return err
 	}
-	if resp.Node.Nodes[0].Key == ds.instanceEtcdKey {
+	if key == ds.instanceEtcdKey {
 		return nil
 	}
-	return fmt.Errorf("this is not the master instance")
+	return errNotMaster
 }
 
-// WhileMaster makes a heartbeat and returns IsMaster()
+// WhileMaster makes a heartbeat and returns IsMaster(). The leadership of
+// this instance is updated accordingly.
 func (ds *EtcdDataSource) WhileMaster() error {
-	var err error
+	err := ds.heartbeat()
+	if err == nil {
+		err = ds.IsMaster()
+	}
+	if err != nil {
+		ds.demote(err)
+		return err
+	}
+
+	if ds.v3 != nil {
+		token, fenceKey := ds.v3.selfToken()
+		ds.promote(token, fenceKey)
+	} else {
+		ds.promote(ds.instanceToken, "")
+	}
+	return nil
+}
+
+func (ds *EtcdDataSource) heartbeat() error {
+	if ds.v3 != nil {
+		// the lease is kept alive by the session, so it only campaigns if
+		// it's not elected yet
+		if ds.IsMaster() == nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+		return ds.v3.campaign(ctx, ds)
+	}
+
 	if ds.instanceEtcdKey == invalidEtcdKey {
-		err = ds.registerOnEtcd()
-		if err != nil {
+		if err := ds.registerOnEtcd(); err != nil {
 			return fmt.Errorf("error while registerOnEtcd: %s", err)
 		}
 	} else {
-		err = ds.etcdHeartbeat()
-		if err != nil {
+		if err := ds.etcdHeartbeat(); err != nil {
 			ds.instanceEtcdKey = invalidEtcdKey
 			return fmt.Errorf("error while updateOnEtcd: %s", err)
 		}
 	}
-
-	return ds.IsMaster()
+	return nil
 }
 
 // Shutdown removes the instance key from the list of instances, used to
 // gracefully shutdown the instance
 func (ds *EtcdDataSource) Shutdown() error {
+	ds.demote(errors.New("the instance is shutdown"))
+	if ds.v3 != nil {
+		return ds.v3.shutdown()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
 	defer cancel()
 	_, err := ds.keysAPI.Delete(ctx, ds.instanceEtcdKey, nil)
@@ -132,6 +192,12 @@ func (ds *EtcdDataSource) SelfInfo() InstanceInfo {
 	return ds.selfInfo
 }
 
+// WebAddr returns the address of the web server of the instance, which
+// identifies it
+func (ii *InstanceInfo) WebAddr() string {
+	return net.JoinHostPort(ii.IP.String(), strconv.Itoa(ii.WebPort))
+}
+
 func (ii *InstanceInfo) String() string {
 	marshaled, err := json.Marshal(ii)
 	if err != nil {
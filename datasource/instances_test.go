@@ -1,14 +1,16 @@
 package datasource
 
-import "testing"
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
 
 func TestInstances(t *testing.T) {
-	ds, err := ForTest(nil)
-	if err != nil {
-		t.Error("error in getting a DataSource instance for our test:", err)
-		return
-	}
+	forEachBackend(t, nil, testInstances)
+}
 
+func testInstances(t *testing.T, ds DataSource) {
 	if err := ds.WhileMaster(); err != nil {
 		t.Error("failed to register as the master instance:", err)
 	}
@@ -42,3 +44,39 @@ func TestInstances(t *testing.T) {
 		return
 	}
 }
+
+func TestCampaign(t *testing.T) {
+	forEachBackend(t, nil, testCampaign)
+}
+
+func testCampaign(t *testing.T, ds DataSource) {
+	etcdDS := ds.(*EtcdDataSource)
+
+	leadership, err := ds.Campaign(context.Background())
+	if err != nil {
+		t.Error("failed to campaign:", err)
+		return
+	}
+	if err := leadership.Valid(); err != nil {
+		t.Error("expecting the leadership to be valid:", err)
+	}
+	if err := etcdDS.checkFence(); err != nil {
+		t.Error("expecting the fence to pass:", err)
+	}
+
+	if err := ds.Shutdown(); err != nil {
+		t.Error("failed to shutdown:", err)
+	}
+	if err := leadership.Valid(); err == nil {
+		t.Error("expecting the leadership to be lost after shutdown")
+	}
+	select {
+	case <-leadership.Context().Done():
+	default:
+		t.Error("expecting the context of the leadership to be canceled")
+	}
+	// a local datastore can't be shared, so it's never fenced
+	if err := etcdDS.checkFence(); err == nil && !etcdDS.alwaysMaster {
+		t.Error("expecting the fence to fail after shutdown")
+	}
+}
@@ -0,0 +1,273 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+	"github.com/krolaw/dhcp4"
+	"golang.org/x/net/context"
+)
+
+// The ip index maps each assigned IP to the mac of the machine it's assigned
+// to, under <cluster>/ips/<ip>. Entries are created with PrevNoExist and
+// removed with PrevValue, so the index stays consistent even if more than one
+// instance is assigning IPs. With etcd v3, the writes of the DHCP path (the
+// index, the leases and the records of the machines) are also fenced by the
+// leadership of the master (see EtcdDataSource.fenced). With etcd2 the
+// leadership is only checked before the allocations, which is not atomic.
+
+// quarantinedIPOwner is the owner of the quarantined IPs in the index
+const quarantinedIPOwner = "quarantined"
+
+// ipAssignedError is returned when an IP is already assigned to another mac
+type ipAssignedError struct {
+	ip    net.IP
+	owner string
+}
+
+func (e *ipAssignedError) Error() string {
+	return fmt.Sprintf("the requested IP(%s) is already assigned to another machine(%s)",
+		e.ip.String(), e.owner)
+}
+
+func isEtcdErrorCode(err error, code int) bool {
+	etcdErr, ok := err.(etcd.Error)
+	return ok && etcdErr.Code == code
+}
+
+func (ds *EtcdDataSource) prefixifyForIPIndex(ip net.IP) string {
+	return path.Join(ds.ClusterName(), etcdIPsDirName, ip.String())
+}
+
+// ipOwner returns the mac the ip is assigned to, empty string if the ip is
+// not assigned
+func (ds *EtcdDataSource) ipOwner(ip net.IP) (string, error) {
+	owner, err := ds.get(ds.prefixifyForIPIndex(ip))
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return owner, nil
+}
+
+// claimIP atomically assigns the ip to the mac. An *ipAssignedError is
+// returned if the ip is assigned to another mac.
+func (ds *EtcdDataSource) claimIP(ip net.IP, mac net.HardwareAddr) error {
+	return ds.claimIPContext(context.Background(), ip, mac)
+}
+
+// claimIPContext is claimIP with the given parent context, which may be
+// fenced
+func (ds *EtcdDataSource) claimIPContext(parent context.Context, ip net.IP, mac net.HardwareAddr) error {
+	ctx, cancel := context.WithTimeout(parent, 3*time.Second)
+	defer cancel()
+
+	_, err := ds.keysAPI.Set(ctx, ds.prefixifyForIPIndex(ip), mac.String(),
+		&etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if err == nil {
+		return nil
+	}
+	if !isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+		return err
+	}
+
+	owner, err := ds.ipOwner(ip)
+	if err != nil {
+		return err
+	}
+	if owner == mac.String() {
+		return nil
+	}
+	return &ipAssignedError{ip: ip, owner: owner}
+}
+
+// claimExternalIP assigns the ip, which is recorded from another DHCP
+// server, to the mac. The request of a client is not a proof of the
+// assignment, so the ip is only moved from its current owner if that's a
+// MTExternal machine too, or a stale entry. The record of the previous owner
+// is updated, and an *ipAssignedError is returned for the IPs of the other
+// machines and the quarantined ones.
+func (ds *EtcdDataSource) claimExternalIP(parent context.Context, ip net.IP, mac net.HardwareAddr) error {
+	err := ds.claimIPContext(parent, ip, mac)
+	assignedErr, isAssigned := err.(*ipAssignedError)
+	if !isAssigned || assignedErr.owner == quarantinedIPOwner {
+		return err
+	}
+	ownerMac, parseErr := net.ParseMAC(assignedErr.owner)
+	if parseErr != nil {
+		return err
+	}
+
+	owner := ds.MachineInterface(ownerMac).(*etcdMachineInterface)
+	resp, getErr := owner.selfGet("_machine")
+	if getErr != nil && !etcd.IsKeyNotFound(getErr) {
+		return fmt.Errorf("error while retrieving the machine of %s: %s",
+			assignedErr.owner, getErr)
+	}
+	if getErr == nil {
+		var ownerMachine Machine
+		json.Unmarshal([]byte(resp), &ownerMachine)
+		if ownerMachine.IP.Equal(ip) {
+			if ownerMachine.Type != MTExternal {
+				return assignedErr
+			}
+			ownerMachine.IP = nil
+			jsonedStats, err := json.Marshal(ownerMachine)
+			if err != nil {
+				return fmt.Errorf("error while marshaling the machine: %s", err)
+			}
+			if err := owner.selfSetContext(parent, "_machine", string(jsonedStats)); err != nil {
+				return fmt.Errorf("error while setting the machine of %s: %s",
+					assignedErr.owner, err)
+			}
+		}
+	}
+
+	log.WithField("where", "datasource.claimExternalIP").Warnf(
+		"IP %s is moved from %s to %s", ip.String(), assignedErr.owner, mac.String())
+
+	ctx, cancel := context.WithTimeout(parent, 3*time.Second)
+	defer cancel()
+	_, err = ds.keysAPI.Set(ctx, ds.prefixifyForIPIndex(ip), mac.String(),
+		&etcd.SetOptions{PrevValue: assignedErr.owner})
+	return err
+}
+
+// releaseIP removes the ip from the index, if it's assigned to the mac. The
+// parent context may be fenced.
+func (ds *EtcdDataSource) releaseIP(parent context.Context, ip net.IP, mac net.HardwareAddr) error {
+	ctx, cancel := context.WithTimeout(parent, 3*time.Second)
+	defer cancel()
+
+	_, err := ds.keysAPI.Delete(ctx, ds.prefixifyForIPIndex(ip),
+		&etcd.DeleteOptions{PrevValue: mac.String()})
+	if err != nil && !etcd.IsKeyNotFound(err) &&
+		!isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		return err
+	}
+	return nil
+}
+
+// quarantineIP replaces the mac which the ip is assigned to with
+// quarantinedIPOwner for the given duration, so the ip is not assigned to
+// any machine in this period. The parent context may be fenced.
+func (ds *EtcdDataSource) quarantineIP(parent context.Context, ip net.IP, mac net.HardwareAddr, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(parent, 3*time.Second)
+	defer cancel()
+
+	key := ds.prefixifyForIPIndex(ip)
+	_, err := ds.keysAPI.Set(ctx, key, quarantinedIPOwner,
+		&etcd.SetOptions{PrevValue: mac.String(), TTL: duration})
+	if err != nil && etcd.IsKeyNotFound(err) {
+		_, err = ds.keysAPI.Set(ctx, key, quarantinedIPOwner,
+			&etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: duration})
+	}
+	return err
+}
+
+// assignedIPs returns the set of all the assigned IPs
+func (ds *EtcdDataSource) assignedIPs() (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	assigned := make(map[string]bool)
+	response, err := ds.keysAPI.Get(ctx, path.Join(ds.ClusterName(), etcdIPsDirName), nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return assigned, nil
+		}
+		return nil, err
+	}
+	for _, n := range response.Node.Nodes {
+		assigned[n.Key[strings.LastIndex(n.Key, "/")+1:]] = true
+	}
+	return assigned, nil
+}
+
+// allocateIP claims a free IP from the lease pool of the given subnet for the
+// mac. Usually the IP next to the previously allocated one is free, and it
+// takes a single round trip. Otherwise the index is listed once, and the
+// free IPs are tried in order. The claims are fenced, on top of the parent
+// context. The caller is expected to hold dhcpAssignLock.
+func (ds *EtcdDataSource) allocateIP(parent context.Context, subnetName string, mac net.HardwareAddr) (net.IP, error) {
+	leaseStart, leaseRange, err := ds.leasePool(subnetName)
+	if err != nil {
+		return nil, err
+	}
+
+	if leaseStart == nil || leaseRange < 1 {
+		return nil, fmt.Errorf("no lease pool is configured")
+	}
+
+	ctx := ds.fenced(parent)
+	cursor := ds.ipCursors[subnetName] % leaseRange
+	candidateIP := dhcp4.IPAdd(leaseStart, cursor)
+	err = ds.claimIPContext(ctx, candidateIP, mac)
+	if err == nil {
+		ds.ipCursors[subnetName] = cursor + 1
+		return candidateIP, nil
+	}
+	if _, isAssigned := err.(*ipAssignedError); !isAssigned {
+		return nil, err
+	}
+
+	assigned, err := ds.assignedIPs()
+	if err != nil {
+		return nil, fmt.Errorf("error while listing the assigned IPs: %s", err)
+	}
+	for i := 1; i < leaseRange; i++ {
+		offset := (cursor + i) % leaseRange
+		candidateIP = dhcp4.IPAdd(leaseStart, offset)
+		if assigned[candidateIP.String()] {
+			continue
+		}
+
+		err = ds.claimIPContext(ctx, candidateIP, mac)
+		if err == nil {
+			ds.ipCursors[subnetName] = offset + 1
+			return candidateIP, nil
+		}
+		if _, isAssigned := err.(*ipAssignedError); !isAssigned {
+			return nil, err
+		}
+		// assigned by another instance in the meantime
+	}
+
+	return nil, fmt.Errorf("no unassigned IP was found")
+}
+
+// indexMachineIPs adds the IPs of the machines which were assigned before
+// the ip index was introduced to the index
+func (ds *EtcdDataSource) indexMachineIPs() error {
+	machineInterfaces, err := ds.MachineInterfaces()
+	if err != nil {
+		return fmt.Errorf("error while getting the machine interfaces: %s", err)
+	}
+	for _, mi := range machineInterfaces {
+		machine, err := mi.Machine(false, nil)
+		if err != nil {
+			return fmt.Errorf("error while getting the machine for (%s): %s",
+				mi.Mac().String(), err)
+		}
+		if machine.IP == nil {
+			continue
+		}
+		err = ds.claimIP(machine.IP, mi.Mac())
+		if err != nil {
+			if _, isAssigned := err.(*ipAssignedError); !isAssigned {
+				return err
+			}
+			log.WithField("where", "datasource.indexMachineIPs").WithError(err).Warnf(
+				"duplicate IP for machine %s", mi.Mac().String())
+		}
+	}
+	return nil
+}
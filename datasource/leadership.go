@@ -0,0 +1,218 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// errNoLeadership is returned when this instance has never been the master
+var errNoLeadership = errors.New("this instance is not elected as the master")
+
+// Leadership is the mastership of this instance, which is obtained through
+// Campaign. Its context is canceled as soon as the mastership is lost, so the
+// services which only run on the master can stop with it.
+//
+// The mastership is checked every ActiveMasterUpdateTime, and each check
+// times out after etcdTimeout. Since the key of the master is kept for
+// masterTTLTime after its last successful heartbeat, the context is canceled
+// before another instance can be elected.
+type Leadership struct {
+	// Token is the fencing token of the mastership. The token of each master
+	// is greater than the tokens of the previous masters.
+	Token uint64
+
+	// fenceKey is the key of the master in the etcd v3 election. The writes
+	// which are fenced are conditioned on it in their transactions.
+	fenceKey string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock sync.Mutex // guards err
+	err  error
+}
+
+func newLeadership(parent context.Context, token uint64, fenceKey string) *Leadership {
+	ctx, cancel := context.WithCancel(parent)
+	return &Leadership{
+		Token:    token,
+		fenceKey: fenceKey,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Context returns the context of the mastership, which is canceled when it's
+// lost
+func (l *Leadership) Context() context.Context {
+	return l.ctx
+}
+
+// Valid returns nil while the mastership is held, and the reason it's lost
+// afterwards
+func (l *Leadership) Valid() error {
+	if l == nil {
+		return errNoLeadership
+	}
+	select {
+	case <-l.ctx.Done():
+	default:
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	return fmt.Errorf("the mastership (token %d) is lost: %s", l.Token, l.ctx.Err())
+}
+
+// lose cancels the context of the mastership, recording the reason
+func (l *Leadership) lose(err error) {
+	l.lock.Lock()
+	if l.err == nil && l.ctx.Err() == nil {
+		l.err = fmt.Errorf("the mastership (token %d) is lost: %s", l.Token, err)
+	}
+	l.lock.Unlock()
+	l.cancel()
+}
+
+// currentLeadership returns the leadership of this instance, nil if it has
+// never been elected
+func (ds *EtcdDataSource) currentLeadership() *Leadership {
+	ds.leadershipLock.Lock()
+	defer ds.leadershipLock.Unlock()
+	return ds.leadership
+}
+
+// promote records the leadership of this instance with the given token. The
+// current leadership is kept if it's valid and has the same token.
+func (ds *EtcdDataSource) promote(token uint64, fenceKey string) *Leadership {
+	ds.leadershipLock.Lock()
+	defer ds.leadershipLock.Unlock()
+
+	if ds.leadership != nil && ds.leadership.Token == token &&
+		ds.leadership.Valid() == nil {
+		return ds.leadership
+	}
+	if ds.leadership != nil {
+		ds.leadership.lose(fmt.Errorf("replaced by token %d", token))
+	}
+	ds.leadership = newLeadership(context.Background(), token, fenceKey)
+	return ds.leadership
+}
+
+// demote cancels the leadership of this instance, if any
+func (ds *EtcdDataSource) demote(err error) {
+	ds.leadershipLock.Lock()
+	defer ds.leadershipLock.Unlock()
+	if ds.leadership != nil {
+		ds.leadership.lose(err)
+	}
+}
+
+// Campaign blocks until this instance is the master, or ctx is done. The
+// returned leadership is kept until it's lost, or ctx is done.
+func (ds *EtcdDataSource) Campaign(ctx context.Context) (*Leadership, error) {
+	for {
+		var err error
+		if ds.v3 != nil {
+			// blocks on a watch of the previous candidate
+			err = ds.v3.campaign(ctx, ds)
+		}
+		if err == nil {
+			err = ds.WhileMaster()
+		}
+		if err == nil {
+			break
+		}
+		log.WithFields(log.Fields{
+			"where":  "datasource.Campaign",
+			"action": "debug",
+		}).WithError(err).Debug("Not master, waiting to be promoted...")
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(StandbyMasterUpdateTime):
+		}
+	}
+
+	leadership := ds.currentLeadership()
+	go ds.keepLeadership(ctx, leadership)
+	return leadership, nil
+}
+
+// keepLeadership checks the mastership every ActiveMasterUpdateTime, and
+// cancels the leadership as soon as a check fails. With etcd v3, the
+// election is watched in between, too.
+func (ds *EtcdDataSource) keepLeadership(ctx context.Context, leadership *Leadership) {
+	watchErrs := make(chan error, 1)
+	if ds.v3 != nil {
+		go func() {
+			watchErrs <- ds.v3.keepMaster(leadership.Context())
+		}()
+	}
+
+	ticker := time.NewTicker(ActiveMasterUpdateTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-leadership.Context().Done():
+			return
+		case <-ctx.Done():
+			leadership.lose(ctx.Err())
+			return
+		case err := <-watchErrs:
+			leadership.lose(err)
+			return
+		case <-ticker.C:
+			if err := ds.WhileMaster(); err != nil {
+				ds.demote(err)
+				return
+			}
+		}
+	}
+}
+
+// checkFence checks that this instance is the master, with the token of its
+// current leadership. It's called before the writes which are only allowed on
+// the master, like allocating IPs.
+func (ds *EtcdDataSource) checkFence() error {
+	if ds.alwaysMaster {
+		// nothing to fence on a single node
+		return nil
+	}
+	leadership := ds.currentLeadership()
+	if err := leadership.Valid(); err != nil {
+		return err
+	}
+
+	token, _, err := ds.masterToken()
+	if err != nil {
+		return fmt.Errorf("error while getting the token of the master: %s", err)
+	}
+	if token != leadership.Token {
+		err := fmt.Errorf("the master has the token %d", token)
+		ds.demote(err)
+		return leadership.Valid()
+	}
+	return nil
+}
+
+// fenced returns a context which makes the writes of v3KeysAPI conditioned on
+// the current leadership, so they fail if it's lost, even if checkFence has
+// passed. Other stores ignore it.
+func (ds *EtcdDataSource) fenced(ctx context.Context) context.Context {
+	leadership := ds.currentLeadership()
+	if leadership == nil || leadership.fenceKey == "" {
+		return ctx
+	}
+	return withV3Fence(ctx, leadership.fenceKey, int64(leadership.Token))
+}
@@ -0,0 +1,96 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// ReclaimExpiredLeases returns the IPs of the MTNormal machines whose lease
+// has expired more than grace ago to the pool, and returns the number of
+// reclaimed IPs. MTStatic and MTBMC machines are never reclaimed. Machines
+// without a recorded lease are left untouched. The writes are fenced by the
+// leadership of the master.
+func (ds *EtcdDataSource) ReclaimExpiredLeases(grace time.Duration) (int, error) {
+	if err := ds.checkFence(); err != nil {
+		return 0, fmt.Errorf(
+			"only the master instance is allowed to reclaim leases: %s", err)
+	}
+
+	machineInterfaces, err := ds.MachineInterfaces()
+	if err != nil {
+		return 0, fmt.Errorf("error while getting the machine interfaces: %s", err)
+	}
+
+	ctx := ds.fenced(context.Background())
+	deadline := time.Now().Add(-grace).Unix()
+	reclaimed := 0
+	for _, mi := range machineInterfaces {
+		ok, err := ds.reclaimIfExpired(ctx, mi.(*etcdMachineInterface), deadline)
+		if err != nil {
+			return reclaimed, err
+		}
+		if ok {
+			reclaimed++
+		}
+	}
+
+	return reclaimed, nil
+}
+
+// reclaimIfExpired reclaims the IP of the machine if its lease has expired
+// before the deadline, with the given context, which may be fenced
+func (ds *EtcdDataSource) reclaimIfExpired(ctx context.Context, m *etcdMachineInterface, deadline int64) (bool, error) {
+	ds.dhcpAssignLock.Lock()
+	defer ds.dhcpAssignLock.Unlock()
+
+	machine, err := m.Machine(false, nil)
+	if err != nil {
+		return false, fmt.Errorf("error while getting the machine for (%s): %s",
+			m.Mac().String(), err)
+	}
+	if machine.Type != MTNormal || machine.IP == nil {
+		return false, nil
+	}
+
+	expiry, err := m.LeaseExpiry()
+	if err != nil {
+		return false, fmt.Errorf("error while getting the lease expiry for (%s): %s",
+			m.Mac().String(), err)
+	}
+	if expiry == 0 || expiry > deadline {
+		return false, nil
+	}
+
+	reclaimedIP := machine.IP
+	machine.IP = nil
+	jsonedStats, err := json.Marshal(machine)
+	if err != nil {
+		return false, fmt.Errorf("error while marshaling the machine: %s", err)
+	}
+	err = m.selfSetContext(ctx, "_machine", string(jsonedStats))
+	if err != nil {
+		return false, fmt.Errorf("error while setting the marshaled machine: %s", err)
+	}
+	err = m.selfDeleteContext(ctx, "_lease_expiry")
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return true, fmt.Errorf("error while deleting the lease expiry: %s", err)
+	}
+	err = ds.releaseIP(ctx, reclaimedIP, m.Mac())
+	if err != nil {
+		return true, fmt.Errorf("error while releasing the IP: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"where":   "datasource.ReclaimExpiredLeases",
+		"action":  "reclaim",
+		"object":  m.Mac().String(),
+		"subject": reclaimedIP.String(),
+	}).Infof("lease expired at %s", time.Unix(expiry, 0).UTC())
+
+	return true, nil
+}
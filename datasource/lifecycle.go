@@ -0,0 +1,266 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// MachineState is the lifecycle state of a machine
+type MachineState string
+
+const (
+	// StateNone is the state of the machines which are recorded before the
+	// lifecycle states are introduced
+	StateNone MachineState = ""
+	// StateDiscovered is for the machines which have got an IP, but have not
+	// been provisioned yet
+	StateDiscovered MachineState = "discovered"
+	// StateProvisioning is for the machines which are booting an image to be
+	// provisioned
+	StateProvisioning MachineState = "provisioning"
+	// StateProvisioned is for the machines which have fetched their configs
+	StateProvisioned MachineState = "provisioned"
+	// StateFailed is for the machines which have failed to be provisioned,
+	// i.e. they're in a boot loop
+	StateFailed MachineState = "failed"
+	// StateMaintenance is for the machines which are taken out of service by
+	// the operators. They're not moved forward automatically.
+	StateMaintenance MachineState = "maintenance"
+	// StateDecommissioned is for the machines which are retired. They're put
+	// on hold when they boot through the network.
+	StateDecommissioned MachineState = "decommissioned"
+)
+
+const (
+	// stateKey is the key of the state inside the folder of each machine
+	stateKey = "_state"
+	// stateHistoryDirName is the folder of the state changes inside the
+	// folder of each machine
+	stateHistoryDirName = "_state_history"
+	// stateHistoryLimit is the number of the state changes which are kept
+	// for each machine, the older ones are removed
+	stateHistoryLimit = 50
+)
+
+// stateTransitions lists the states which each state can be changed to
+// through the api
+var stateTransitions = map[MachineState][]MachineState{
+	StateNone: {StateDiscovered, StateProvisioning, StateProvisioned,
+		StateFailed, StateMaintenance, StateDecommissioned},
+	StateDiscovered: {StateProvisioning, StateFailed, StateMaintenance,
+		StateDecommissioned},
+	StateProvisioning: {StateProvisioned, StateFailed, StateMaintenance,
+		StateDecommissioned},
+	StateProvisioned: {StateProvisioning, StateFailed, StateMaintenance,
+		StateDecommissioned},
+	StateFailed: {StateProvisioning, StateMaintenance, StateDecommissioned},
+	StateMaintenance: {StateDiscovered, StateProvisioning, StateProvisioned,
+		StateDecommissioned},
+	StateDecommissioned: {StateDiscovered},
+}
+
+// automaticStateTransitions lists the states which each state is moved
+// forward to by the DHCP server, the http booter and the template endpoints
+var automaticStateTransitions = map[MachineState][]MachineState{
+	StateNone:         {StateDiscovered, StateProvisioning},
+	StateDiscovered:   {StateProvisioning},
+	StateProvisioning: {StateProvisioned, StateFailed},
+	StateProvisioned:  {StateProvisioning},
+	StateFailed:       {StateProvisioning},
+}
+
+// StateChange is an entry of the audit trail of the state of a machine
+type StateChange struct {
+	From MachineState `json:"from"`
+	To   MachineState `json:"to"`
+	// Actor is who or what has changed the state, i.e. dhcp or api (1.2.3.4)
+	Actor  string `json:"actor"`
+	Reason string `json:"reason,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// IsValid reports whether the state is one of the known states
+func (s MachineState) IsValid() bool {
+	_, found := stateTransitions[s]
+	return found && s != StateNone
+}
+
+func transitionAllowed(transitions map[MachineState][]MachineState,
+	from MachineState, to MachineState) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the lifecycle state of the machine
+func (m *etcdMachineInterface) State() (MachineState, error) {
+	value, err := m.selfGet(stateKey)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return StateNone, nil
+		}
+		return StateNone, err
+	}
+	return MachineState(value), nil
+}
+
+// SetState changes the lifecycle state of the machine, if the transition
+// is allowed, and records the change in the audit trail
+func (m *etcdMachineInterface) SetState(to MachineState, actor string, reason string) error {
+	if !to.IsValid() {
+		return fmt.Errorf("invalid state: %q", to)
+	}
+	_, err := m.transitState(stateTransitions, to, actor, reason)
+	return err
+}
+
+// AdvanceState is like SetState, but it's used for the automatic
+// transitions. If the transition is not allowed, the state is kept, and false
+// is returned without an error.
+func (m *etcdMachineInterface) AdvanceState(to MachineState, actor string, reason string) (bool, error) {
+	changed, err := m.transitState(automaticStateTransitions, to, actor, reason)
+	if err != nil {
+		if _, ok := err.(*stateTransitionError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	if changed {
+		log.WithFields(log.Fields{
+			"where":   "datasource.AdvanceState",
+			"action":  "update",
+			"object":  m.mac.String(),
+			"subject": stateKey,
+		}).Infof("moved to %s by %s (%s)", to, actor, reason)
+	}
+	return changed, nil
+}
+
+// stateTransitionError is returned when the transition is not allowed
+type stateTransitionError struct {
+	from MachineState
+	to   MachineState
+}
+
+func (e *stateTransitionError) Error() string {
+	from := e.from
+	if from == StateNone {
+		from = "none"
+	}
+	return fmt.Sprintf("transition from %s to %s is not allowed", from, e.to)
+}
+
+// transitState changes the state of the machine atomically, if the
+// transition is in the given transitions. Setting the current state is a
+// no-op, and false is returned for it.
+func (m *etcdMachineInterface) transitState(transitions map[MachineState][]MachineState,
+	to MachineState, actor string, reason string) (bool, error) {
+	if _, err := m.Machine(false, nil); err != nil {
+		return false, err
+	}
+
+	from, err := m.State()
+	if err != nil {
+		return false, fmt.Errorf("error while getting the state: %s", err)
+	}
+	if from == to {
+		return false, nil
+	}
+	if !transitionAllowed(transitions, from, to) {
+		return false, &stateTransitionError{from: from, to: to}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	opts := &etcd.SetOptions{PrevValue: string(from)}
+	if from == StateNone {
+		opts = &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	}
+	_, err = m.keysAPI.Set(ctx, m.prefixifyForMachine(stateKey), string(to), opts)
+	if err != nil {
+		if isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) ||
+			isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+			return false, fmt.Errorf("the state is changed concurrently, from %s", from)
+		}
+		return false, fmt.Errorf("error while setting the state: %s", err)
+	}
+
+	change, err := json.Marshal(&StateChange{
+		From:   from,
+		To:     to,
+		Actor:  actor,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		return true, err
+	}
+	_, err = m.keysAPI.CreateInOrder(ctx, m.prefixifyForMachine(stateHistoryDirName),
+		string(change), nil)
+	if err != nil {
+		return true, fmt.Errorf("error while recording the state change: %s", err)
+	}
+	if err := m.trimStateHistory(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"where":   "datasource.transitState",
+			"action":  "delete",
+			"object":  m.mac.String(),
+			"subject": stateHistoryDirName,
+		}).WithError(err).Warn("failed to trim the state history")
+	}
+	return true, nil
+}
+
+// trimStateHistory removes the oldest state changes of the machine, so at
+// most stateHistoryLimit of them are kept
+func (m *etcdMachineInterface) trimStateHistory(ctx context.Context) error {
+	response, err := m.keysAPI.Get(ctx, m.prefixifyForMachine(stateHistoryDirName),
+		&etcd.GetOptions{Sort: true})
+	if err != nil {
+		return err
+	}
+
+	nodes := response.Node.Nodes
+	for i := 0; i < len(nodes)-stateHistoryLimit; i++ {
+		_, err := m.keysAPI.Delete(ctx, nodes[i].Key, nil)
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// StateHistory returns the audit trail of the state of the machine, the
+// oldest change first
+func (m *etcdMachineInterface) StateHistory() ([]StateChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := m.keysAPI.Get(ctx, m.prefixifyForMachine(stateHistoryDirName),
+		&etcd.GetOptions{Sort: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	history := make([]StateChange, 0, len(response.Node.Nodes))
+	for _, n := range response.Node.Nodes {
+		var change StateChange
+		if err := json.Unmarshal([]byte(n.Value), &change); err != nil {
+			return nil, fmt.Errorf("error while parsing the state change: %s", err)
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
@@ -0,0 +1,30 @@
+package datasource
+
+import (
+	"net"
+)
+
+// NewLocalDataSource gives blacksmith the ability to keep its data in a local
+// BoltDB file at dbPath, for the single-node deployments without an etcd
+// cluster. The file is locked by the instance which opens it, so the instance
+// is always the master.
+func NewLocalDataSource(dbPath string, leaseStart net.IP, leaseRange int,
+	clusterName, workspacePath string, selfInfo InstanceInfo) (DataSource, error) {
+
+	kapi, err := newLocalKeysAPI(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := newEtcdDataSource(kapi, nil, leaseStart, leaseRange, clusterName,
+		workspacePath, selfInfo)
+	ds.alwaysMaster = true
+
+	ds.FillEtcdFromWorkspace()
+
+	if err := ds.prepare(); err != nil {
+		kapi.Close()
+		return nil, err
+	}
+	return ds, nil
+}
@@ -0,0 +1,576 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// localKeysAPI implements the etcd.KeysAPI on a local BoltDB file, so the
+// EtcdDataSource can be used without an etcd cluster. The etcd v2 semantics
+// which are used by the datasource are kept: directories, TTLs, ordered keys,
+// and the PrevExist/PrevValue/PrevIndex conditions, which are atomic since
+// each call is done in a single bolt transaction. Watching is not supported.
+type localKeysAPI struct {
+	db *bolt.DB
+}
+
+var (
+	localNodesBucket = []byte("nodes")
+	localMetaBucket  = []byte("meta")
+	localIndexKey    = []byte("index")
+
+	errLocalWatchNotSupported = errors.New("watching is not supported by the local datastore")
+)
+
+// localNode is the stored representation of each key or directory
+type localNode struct {
+	Value      string `json:"value,omitempty"`
+	Dir        bool   `json:"dir,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"` // unix nano, 0 for never
+	Created    uint64 `json:"created"`
+	Modified   uint64 `json:"modified"`
+}
+
+func (n *localNode) expired(now time.Time) bool {
+	return n.Expiration != 0 && n.Expiration <= now.UnixNano()
+}
+
+// newLocalKeysAPI opens (or creates) the bolt file at dbPath
+func newLocalKeysAPI(dbPath string) (*localKeysAPI, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error while opening %s: %s", dbPath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(localNodesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(localMetaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error while initializing %s: %s", dbPath, err)
+	}
+	return &localKeysAPI{db: db}, nil
+}
+
+var keysAPIErrorMessages = map[int]string{
+	etcd.ErrorCodeKeyNotFound: "Key not found",
+	etcd.ErrorCodeTestFailed:  "Compare failed",
+	etcd.ErrorCodeNotFile:     "Not a file",
+	etcd.ErrorCodeNotDir:      "Not a directory",
+	etcd.ErrorCodeNodeExist:   "Key already exists",
+	etcd.ErrorCodeDirNotEmpty: "Directory not empty",
+	etcd.ErrorCodeRootROnly:   "Root is read only",
+}
+
+// keysAPIError returns the error which the etcd v2 api returns for the code.
+// It's shared by the KeysAPI implementations of this package.
+func keysAPIError(code int, key string, index uint64) error {
+	return etcd.Error{
+		Code:    code,
+		Message: keysAPIErrorMessages[code],
+		Cause:   key,
+		Index:   index,
+	}
+}
+
+// normalizeKey makes the key absolute and clean, as the keys of etcd v2
+func normalizeKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+// localTx wraps a bolt transaction with the tree operations
+type localTx struct {
+	tx    *bolt.Tx
+	nodes *bolt.Bucket
+	now   time.Time
+}
+
+func (api *localKeysAPI) view(fn func(t *localTx) error) error {
+	return api.db.View(func(tx *bolt.Tx) error {
+		return fn(&localTx{tx: tx, nodes: tx.Bucket(localNodesBucket), now: time.Now()})
+	})
+}
+
+func (api *localKeysAPI) update(fn func(t *localTx) error) error {
+	return api.db.Update(func(tx *bolt.Tx) error {
+		return fn(&localTx{tx: tx, nodes: tx.Bucket(localNodesBucket), now: time.Now()})
+	})
+}
+
+func (t *localTx) index() uint64 {
+	value := t.tx.Bucket(localMetaBucket).Get(localIndexKey)
+	if len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+func (t *localTx) nextIndex() (uint64, error) {
+	index := t.index() + 1
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, index)
+	return index, t.tx.Bucket(localMetaBucket).Put(localIndexKey, value)
+}
+
+// get returns the node of the key, nil if it doesn't exist or is expired.
+// The root always exists, as a directory.
+func (t *localTx) get(key string) (*localNode, error) {
+	if key == "/" {
+		return &localNode{Dir: true}, nil
+	}
+	value := t.nodes.Get([]byte(key))
+	if value == nil {
+		return nil, nil
+	}
+	var node localNode
+	if err := json.Unmarshal(value, &node); err != nil {
+		return nil, fmt.Errorf("error while parsing the node of %s: %s", key, err)
+	}
+	if node.expired(t.now) {
+		return nil, nil
+	}
+	return &node, nil
+}
+
+func (t *localTx) put(key string, node *localNode) error {
+	value, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	return t.nodes.Put([]byte(key), value)
+}
+
+// walk calls fn for the descendants of the directory, sorted by their keys.
+// Expired nodes are skipped, with their descendants.
+func (t *localTx) walk(dir string, fn func(key string, node *localNode) error) error {
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = "/"
+	}
+	var expiredPrefix string
+	c := t.nodes.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		key := string(k)
+		if expiredPrefix != "" && strings.HasPrefix(key, expiredPrefix) {
+			continue
+		}
+		var node localNode
+		if err := json.Unmarshal(v, &node); err != nil {
+			return fmt.Errorf("error while parsing the node of %s: %s", key, err)
+		}
+		if node.expired(t.now) {
+			expiredPrefix = key + "/"
+			continue
+		}
+		if err := fn(key, &node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTree removes the key and all of its descendants, expired or not
+func (t *localTx) deleteTree(key string) error {
+	var keys [][]byte
+	keys = append(keys, []byte(key))
+	prefix := []byte(key + "/")
+	c := t.nodes.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := t.nodes.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeExpired removes the expired children of the directory
+func (t *localTx) purgeExpired(dir string) error {
+	prefix := []byte(dir + "/")
+	var expired []string
+	c := t.nodes.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if strings.Contains(string(k[len(prefix):]), "/") {
+			continue
+		}
+		var node localNode
+		if json.Unmarshal(v, &node) == nil && node.expired(t.now) {
+			expired = append(expired, string(k))
+		}
+	}
+	for _, key := range expired {
+		if err := t.deleteTree(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureParents creates the missing parent directories of the key
+func (t *localTx) ensureParents(key string, index uint64) error {
+	dir := path.Dir(key)
+	if dir == "/" {
+		return nil
+	}
+	node, err := t.get(dir)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		if !node.Dir {
+			return keysAPIError(etcd.ErrorCodeNotDir, dir, t.index())
+		}
+		return nil
+	}
+	if err := t.ensureParents(dir, index); err != nil {
+		return err
+	}
+	// an expired directory is replaced, with its leftovers
+	if err := t.deleteTree(dir); err != nil {
+		return err
+	}
+	return t.put(dir, &localNode{Dir: true, Created: index, Modified: index})
+}
+
+// isHiddenKey reports whether the last segment of the key starts with _.
+// etcd v2 leaves the hidden nodes out of the directory listings, but they're
+// returned if they're asked for by their keys.
+func isHiddenKey(key string) bool {
+	return strings.HasPrefix(path.Base(key), "_")
+}
+
+// etcdNode converts the stored node to the one of the etcd client. The
+// children of the directories are included if depth is not zero, a negative
+// depth includes all the descendants. The hidden children are left out, with
+// their descendants.
+func (t *localTx) etcdNode(key string, node *localNode, depth int) (*etcd.Node, error) {
+	ret := &etcd.Node{
+		Key:           key,
+		Value:         node.Value,
+		Dir:           node.Dir,
+		CreatedIndex:  node.Created,
+		ModifiedIndex: node.Modified,
+	}
+	if node.Expiration != 0 {
+		expiration := time.Unix(0, node.Expiration)
+		ret.Expiration = &expiration
+		ret.TTL = int64(expiration.Sub(t.now)/time.Second) + 1
+	}
+	if !node.Dir || depth == 0 {
+		return ret, nil
+	}
+
+	children := make(map[string]*etcd.Node)
+	err := t.walk(key, func(childKey string, child *localNode) error {
+		if isHiddenKey(childKey) {
+			return nil
+		}
+		parent := path.Dir(childKey)
+		if parent == key {
+			childNode, err := t.etcdNode(childKey, child, 0)
+			if err != nil {
+				return err
+			}
+			ret.Nodes = append(ret.Nodes, childNode)
+			children[childKey] = childNode
+			return nil
+		}
+		if depth > 0 {
+			return nil
+		}
+		parentNode, found := children[parent]
+		if !found {
+			return nil
+		}
+		childNode, err := t.etcdNode(childKey, child, 0)
+		if err != nil {
+			return err
+		}
+		parentNode.Nodes = append(parentNode.Nodes, childNode)
+		children[childKey] = childNode
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Get retrieves a set of Nodes from the local store
+func (api *localKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	key = normalizeKey(key)
+	depth := 1
+	if opts != nil && opts.Recursive {
+		depth = -1
+	}
+
+	var resp *etcd.Response
+	err := api.view(func(t *localTx) error {
+		node, err := t.get(key)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return keysAPIError(etcd.ErrorCodeKeyNotFound, key, t.index())
+		}
+		etcdNode, err := t.etcdNode(key, node, depth)
+		if err != nil {
+			return err
+		}
+		resp = &etcd.Response{Action: "get", Node: etcdNode, Index: t.index()}
+		return nil
+	})
+	return resp, err
+}
+
+// Set assigns a new value to a Node identified by a given key, with the
+// conditions of opts
+func (api *localKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	key = normalizeKey(key)
+	if opts == nil {
+		opts = &etcd.SetOptions{}
+	}
+	if key == "/" {
+		return nil, keysAPIError(etcd.ErrorCodeRootROnly, key, 0)
+	}
+	if opts.Dir && value != "" {
+		return nil, errors.New("setting a value on a directory is not allowed")
+	}
+
+	var resp *etcd.Response
+	err := api.update(func(t *localTx) error {
+		prev, err := t.get(key)
+		if err != nil {
+			return err
+		}
+
+		action := "set"
+		switch opts.PrevExist {
+		case etcd.PrevExist:
+			if prev == nil {
+				return keysAPIError(etcd.ErrorCodeKeyNotFound, key, t.index())
+			}
+			action = "update"
+		case etcd.PrevNoExist:
+			if prev != nil {
+				return keysAPIError(etcd.ErrorCodeNodeExist, key, t.index())
+			}
+			action = "create"
+		}
+		if opts.PrevValue != "" || opts.PrevIndex != 0 {
+			if prev == nil {
+				return keysAPIError(etcd.ErrorCodeKeyNotFound, key, t.index())
+			}
+			if prev.Dir {
+				return keysAPIError(etcd.ErrorCodeNotFile, key, t.index())
+			}
+			if (opts.PrevValue != "" && prev.Value != opts.PrevValue) ||
+				(opts.PrevIndex != 0 && prev.Modified != opts.PrevIndex) {
+				return keysAPIError(etcd.ErrorCodeTestFailed, key, t.index())
+			}
+			action = "compareAndSwap"
+		}
+		if prev != nil && prev.Dir {
+			return keysAPIError(etcd.ErrorCodeNotFile, key, t.index())
+		}
+
+		index, err := t.nextIndex()
+		if err != nil {
+			return err
+		}
+		if err := t.ensureParents(key, index); err != nil {
+			return err
+		}
+
+		node := &localNode{
+			Value:    value,
+			Dir:      opts.Dir,
+			Created:  index,
+			Modified: index,
+		}
+		if prev != nil {
+			node.Created = prev.Created
+		} else if err := t.deleteTree(key); err != nil {
+			// leftovers of an expired node
+			return err
+		}
+		if opts.TTL > 0 {
+			node.Expiration = t.now.Add(opts.TTL).UnixNano()
+		}
+		if err := t.put(key, node); err != nil {
+			return err
+		}
+
+		resp = &etcd.Response{Action: action, Index: index}
+		if resp.Node, err = t.etcdNode(key, node, 0); err != nil {
+			return err
+		}
+		if prev != nil {
+			resp.PrevNode, err = t.etcdNode(key, prev, 0)
+		}
+		return err
+	})
+	return resp, err
+}
+
+// Delete removes a Node identified by the given key, with the conditions of
+// opts
+func (api *localKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	key = normalizeKey(key)
+	if opts == nil {
+		opts = &etcd.DeleteOptions{}
+	}
+	if key == "/" {
+		return nil, keysAPIError(etcd.ErrorCodeRootROnly, key, 0)
+	}
+
+	var resp *etcd.Response
+	err := api.update(func(t *localTx) error {
+		prev, err := t.get(key)
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			return keysAPIError(etcd.ErrorCodeKeyNotFound, key, t.index())
+		}
+
+		action := "delete"
+		if opts.PrevValue != "" || opts.PrevIndex != 0 {
+			if prev.Dir {
+				return keysAPIError(etcd.ErrorCodeNotFile, key, t.index())
+			}
+			if (opts.PrevValue != "" && prev.Value != opts.PrevValue) ||
+				(opts.PrevIndex != 0 && prev.Modified != opts.PrevIndex) {
+				return keysAPIError(etcd.ErrorCodeTestFailed, key, t.index())
+			}
+			action = "compareAndDelete"
+		}
+		if prev.Dir {
+			if !opts.Dir && !opts.Recursive {
+				return keysAPIError(etcd.ErrorCodeNotFile, key, t.index())
+			}
+			if !opts.Recursive {
+				empty := true
+				t.walk(key, func(string, *localNode) error {
+					empty = false
+					return nil
+				})
+				if !empty {
+					return keysAPIError(etcd.ErrorCodeDirNotEmpty, key, t.index())
+				}
+			}
+		} else if opts.Dir {
+			return keysAPIError(etcd.ErrorCodeNotDir, key, t.index())
+		}
+
+		index, err := t.nextIndex()
+		if err != nil {
+			return err
+		}
+		if err := t.deleteTree(key); err != nil {
+			return err
+		}
+
+		resp = &etcd.Response{Action: action, Index: index}
+		resp.PrevNode, err = t.etcdNode(key, prev, 0)
+		if err != nil {
+			return err
+		}
+		resp.Node = &etcd.Node{Key: key, Dir: prev.Dir, CreatedIndex: prev.Created, ModifiedIndex: index}
+		return nil
+	})
+	return resp, err
+}
+
+// Create is an alias for Set w/ PrevExist=false
+func (api *localKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return api.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+}
+
+// CreateInOrder creates a key in the given directory, named after the index
+// of the store, so the keys of the directory are sorted by their creation.
+// The expired keys of the directory are purged.
+func (api *localKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	dir = normalizeKey(dir)
+
+	var resp *etcd.Response
+	err := api.update(func(t *localTx) error {
+		node, err := t.get(dir)
+		if err != nil {
+			return err
+		}
+		if node != nil && !node.Dir {
+			return keysAPIError(etcd.ErrorCodeNotDir, dir, t.index())
+		}
+
+		index, err := t.nextIndex()
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			if err := t.ensureParents(dir, index); err != nil {
+				return err
+			}
+			if err := t.deleteTree(dir); err != nil {
+				return err
+			}
+			err := t.put(dir, &localNode{Dir: true, Created: index, Modified: index})
+			if err != nil {
+				return err
+			}
+		} else if err := t.purgeExpired(dir); err != nil {
+			return err
+		}
+
+		key := path.Join(dir, fmt.Sprintf("%020d", index))
+		child := &localNode{Value: value, Created: index, Modified: index}
+		if opts != nil && opts.TTL > 0 {
+			child.Expiration = t.now.Add(opts.TTL).UnixNano()
+		}
+		if err := t.put(key, child); err != nil {
+			return err
+		}
+
+		resp = &etcd.Response{Action: "create", Index: index}
+		resp.Node, err = t.etcdNode(key, child, 0)
+		return err
+	})
+	return resp, err
+}
+
+// Update is an alias for Set w/ PrevExist=true
+func (api *localKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return api.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevExist})
+}
+
+// Watcher returns a Watcher which always fails, since watching is not
+// supported by the local store
+func (api *localKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	return localWatcher{}
+}
+
+type localWatcher struct{}
+
+func (localWatcher) Next(context.Context) (*etcd.Response, error) {
+	return nil, errLocalWatchNotSupported
+}
+
+// Close closes the bolt file
+func (api *localKeysAPI) Close() error {
+	return api.db.Close()
+}
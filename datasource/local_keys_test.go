@@ -0,0 +1,98 @@
+package datasource
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestLocalKeysAPI(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "blacksmith-local")
+	if err != nil {
+		t.Error("error while creating temp file:", err)
+		return
+	}
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+
+	kapi, err := newLocalKeysAPI(dbFile.Name())
+	if err != nil {
+		t.Error("error while opening the local store:", err)
+		return
+	}
+	defer kapi.Close()
+	ctx := context.Background()
+
+	if _, err := kapi.Set(ctx, "a/b/c", "1", nil); err != nil {
+		t.Error("unexpected error:", err)
+		return
+	}
+	resp, err := kapi.Get(ctx, "a", nil)
+	if err != nil || !resp.Node.Dir || len(resp.Node.Nodes) != 1 ||
+		resp.Node.Nodes[0].Key != "/a/b" || len(resp.Node.Nodes[0].Nodes) != 0 {
+		t.Errorf("expecting the parents to be created, got: %v %v", resp, err)
+	}
+	resp, err = kapi.Get(ctx, "a", &etcd.GetOptions{Recursive: true})
+	if err != nil || resp.Node.Nodes[0].Nodes[0].Value != "1" {
+		t.Errorf("expecting the recursive get to include /a/b/c, got: %v %v", resp, err)
+	}
+
+	if _, err := kapi.Set(ctx, "a/b/c", "2", &etcd.SetOptions{PrevExist: etcd.PrevNoExist}); !isEtcdErrorCode(err, etcd.ErrorCodeNodeExist) {
+		t.Error("expecting a node exist error, got:", err)
+	}
+	if _, err := kapi.Set(ctx, "a/b/c", "2", &etcd.SetOptions{PrevValue: "0"}); !isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		t.Error("expecting a compare failed error, got:", err)
+	}
+	if _, err := kapi.Set(ctx, "a/b/c", "2", &etcd.SetOptions{PrevValue: "1"}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if _, err := kapi.Set(ctx, "a/b", "x", nil); !isEtcdErrorCode(err, etcd.ErrorCodeNotFile) {
+		t.Error("expecting a not a file error, got:", err)
+	}
+	if _, err := kapi.Delete(ctx, "a/b/c", &etcd.DeleteOptions{PrevValue: "1"}); !isEtcdErrorCode(err, etcd.ErrorCodeTestFailed) {
+		t.Error("expecting a compare failed error, got:", err)
+	}
+	if _, err := kapi.Delete(ctx, "a/b", &etcd.DeleteOptions{Dir: true}); !isEtcdErrorCode(err, etcd.ErrorCodeDirNotEmpty) {
+		t.Error("expecting a directory not empty error, got:", err)
+	}
+	if _, err := kapi.Delete(ctx, "a", &etcd.DeleteOptions{Dir: true, Recursive: true}); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if _, err := kapi.Get(ctx, "a/b/c", nil); !etcd.IsKeyNotFound(err) {
+		t.Error("expecting the recursive delete to remove /a/b/c, got:", err)
+	}
+
+	first, err := kapi.CreateInOrder(ctx, "q", "first", &etcd.CreateInOrderOptions{TTL: time.Hour})
+	if err != nil {
+		t.Error("unexpected error:", err)
+		return
+	}
+	kapi.CreateInOrder(ctx, "q", "second", nil)
+	kapi.Set(ctx, "q/expired", "x", &etcd.SetOptions{TTL: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	resp, err = kapi.Get(ctx, "q", &etcd.GetOptions{Sort: true})
+	if err != nil || len(resp.Node.Nodes) != 2 || resp.Node.Nodes[0].Key != first.Node.Key ||
+		resp.Node.Nodes[1].Value != "second" || resp.Node.Nodes[0].TTL <= 0 {
+		t.Errorf("expecting the keys in order, without the expired one, got: %v %v", resp, err)
+	}
+
+	// hidden nodes are left out of the listings, as etcd v2 does
+	kapi.Set(ctx, "h/_hidden", "x", nil)
+	kapi.Set(ctx, "h/_dir/child", "x", nil)
+	kapi.Set(ctx, "h/visible/_hidden", "x", nil)
+	resp, err = kapi.Get(ctx, "h", &etcd.GetOptions{Recursive: true})
+	if err != nil || len(resp.Node.Nodes) != 1 || resp.Node.Nodes[0].Key != "/h/visible" ||
+		len(resp.Node.Nodes[0].Nodes) != 0 {
+		t.Errorf("expecting the hidden nodes to be left out, got: %v %v", resp, err)
+	}
+	if resp, err := kapi.Get(ctx, "h/_hidden", nil); err != nil || resp.Node.Value != "x" {
+		t.Errorf("expecting the hidden node to be returned by its key, got: %v %v", resp, err)
+	}
+	if resp, err := kapi.Get(ctx, "h/_dir", nil); err != nil || len(resp.Node.Nodes) != 1 {
+		t.Errorf("expecting the children of the hidden directory, got: %v %v", resp, err)
+	}
+}
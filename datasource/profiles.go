@@ -0,0 +1,240 @@
+package datasource
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Profiles are named sets of variables, shared by the machines of a hardware
+// class (e.g. storage nodes). The variables of a profile are stored under
+// <cluster>/profiles/<profile>/<key>, and the machines are assigned to the
+// profiles by their SpecialKeyProfiles variable. The variables are resolved
+// from the machine, then its profiles in order, then the cluster.
+
+// Sources of the resolved variables, beside VariableSourceProfile
+const (
+	VariableSourceMachine = "machine"
+	VariableSourceCluster = "cluster"
+)
+
+// VariableSourceProfile returns the source of the variables which are
+// resolved from the given profile
+func VariableSourceProfile(profile string) string {
+	return "profile/" + profile
+}
+
+// ResolvedVariable is the effective value of a variable of a machine, with
+// the layer it's resolved from
+type ResolvedVariable struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+func validateProfileName(name string) error {
+	if name == "" || name != path.Base(name) || name[0] == '.' ||
+		strings.ContainsAny(name, ", ") {
+		return fmt.Errorf("invalid profile name: %q", name)
+	}
+	return nil
+}
+
+// ParseProfiles splits the value of SpecialKeyProfiles
+func ParseProfiles(value string) ([]string, error) {
+	var profiles []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := validateProfileName(name); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, name)
+	}
+	return profiles, nil
+}
+
+func (ds *EtcdDataSource) prefixifyForProfile(profile string, key string) string {
+	return path.Join(ds.ClusterName(), etcdProfilesDirName, profile, key)
+}
+
+// Profiles returns the names of the profiles which have any variables
+func (ds *EtcdDataSource) Profiles() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := ds.keysAPI.Get(ctx, path.Join(ds.ClusterName(), etcdProfilesDirName),
+		&etcd.GetOptions{Sort: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var profiles []string
+	for _, n := range response.Node.Nodes {
+		if n.Dir {
+			profiles = append(profiles, path.Base(n.Key))
+		}
+	}
+	return profiles, nil
+}
+
+// ListProfileVariables returns the variables of the profile
+func (ds *EtcdDataSource) ListProfileVariables(profile string) (map[string]string, error) {
+	if err := validateProfileName(profile); err != nil {
+		return nil, err
+	}
+	variables, err := ds.listNonDirKeyValues(ds.prefixifyForProfile(profile, ""))
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	return variables, nil
+}
+
+// SetProfileVariable sets a variable of the profile, creating the profile if
+// needed
+func (ds *EtcdDataSource) SetProfileVariable(profile string, key string, value string) error {
+	if err := validateProfileName(profile); err != nil {
+		return err
+	}
+	if key == SpecialKeyProfiles {
+		return fmt.Errorf("%q can't be set for a profile", key)
+	}
+	if err := ValidateVariable(key, value); err != nil {
+		return err
+	}
+	return ds.set(ds.prefixifyForProfile(profile, key), value)
+}
+
+// DeleteProfileVariable deletes a variable of the profile
+func (ds *EtcdDataSource) DeleteProfileVariable(profile string, key string) error {
+	if err := validateProfileName(profile); err != nil {
+		return err
+	}
+	return ds.delete(ds.prefixifyForProfile(profile, key))
+}
+
+// DeleteProfile deletes the profile with all its variables. The machines
+// which are assigned to it are not changed.
+func (ds *EtcdDataSource) DeleteProfile(profile string) error {
+	if err := validateProfileName(profile); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := ds.keysAPI.Delete(ctx, ds.prefixifyForProfile(profile, ""),
+		&etcd.DeleteOptions{Dir: true, Recursive: true})
+	return err
+}
+
+// Profiles returns the profiles which the machine is assigned to, in the
+// order of their priority
+func (m *etcdMachineInterface) Profiles() ([]string, error) {
+	value, err := m.selfGet(SpecialKeyProfiles)
+	if err != nil {
+		if !etcd.IsKeyNotFound(err) {
+			return nil, err
+		}
+		value, err = m.etcdDS.GetClusterVariable(SpecialKeyProfiles)
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return nil, err
+		}
+	}
+	return ParseProfiles(value)
+}
+
+// profileVariable returns the value of the key from the first profile of the
+// machine which has it
+func (m *etcdMachineInterface) profileVariable(key string) (value string, source string, err error) {
+	profiles, err := m.Profiles()
+	if err != nil {
+		return "", "", err
+	}
+	for _, profile := range profiles {
+		value, err := m.etcdDS.get(m.etcdDS.prefixifyForProfile(profile, key))
+		if err == nil {
+			return value, VariableSourceProfile(profile), nil
+		}
+		if !etcd.IsKeyNotFound(err) {
+			return "", "", err
+		}
+	}
+	return "", "", nil
+}
+
+// LookupProfilesVariable returns the value of the key from the first of the
+// profiles which has it, or else from the cluster, with its source, like the
+// variables which are not set for a machine. The source is empty if the key
+// is not set.
+func LookupProfilesVariable(ds DataSource, profiles []string, key string) (value string, source string, err error) {
+	for _, profile := range profiles {
+		variables, err := ds.ListProfileVariables(profile)
+		if err != nil {
+			return "", "", fmt.Errorf("error while getting the variables of profile %s: %s",
+				profile, err)
+		}
+		if value, ok := variables[key]; ok {
+			return value, VariableSourceProfile(profile), nil
+		}
+	}
+
+	value, err = ds.GetClusterVariable(key)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("error while getting the cluster variable %s: %s", key, err)
+	}
+	return value, VariableSourceCluster, nil
+}
+
+// ListResolvedVariables returns the effective variables of the machine,
+// including the ones from its profiles and the cluster, with their sources
+func (m *etcdMachineInterface) ListResolvedVariables() (map[string]ResolvedVariable, error) {
+	resolved := make(map[string]ResolvedVariable)
+
+	clusterVariables, err := m.etcdDS.ListClusterVariables()
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return nil, err
+	}
+	for key, value := range clusterVariables {
+		resolved[key] = ResolvedVariable{value, VariableSourceCluster}
+	}
+
+	profiles, err := m.Profiles()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(profiles) - 1; i >= 0; i-- {
+		variables, err := m.etcdDS.ListProfileVariables(profiles[i])
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range variables {
+			resolved[key] = ResolvedVariable{value, VariableSourceProfile(profiles[i])}
+		}
+	}
+
+	machineVariables, err := m.ListVariables()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range machineVariables {
+		if key[0] == '_' {
+			continue
+		}
+		resolved[key] = ResolvedVariable{value, VariableSourceMachine}
+	}
+	return resolved, nil
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -12,8 +14,69 @@ const (
 	SpecialKeyCoreosVersion = "coreos-version"
 	// SpecialKeyNetworkConfiguration is a special key for the network of the cluster
 	SpecialKeyNetworkConfiguration = "net-conf"
+	// SpecialKeyDHCPOptions is a special key for the custom options which are
+	// added to the DHCP replies. The value of the machine overrides the values
+	// of its profiles, which override the value of the cluster, option by
+	// option.
+	SpecialKeyDHCPOptions = "dhcp-options"
+	// SpecialKeyBootAction is a special key for what the machine does when it
+	// boots through the network, one of the BootAction* values
+	SpecialKeyBootAction = "boot-action"
+	// SpecialKeyImage is a special key for the name of the directory under
+	// images/ of the workspace, which the machines are booted from. If it's not
+	// set, SpecialKeyCoreosVersion is used instead.
+	SpecialKeyImage = "image"
+	// SpecialKeyRescueImage is a special key for the image which the machines
+	// are booted from with the rescue boot action
+	SpecialKeyRescueImage = "rescue-image"
+	// SpecialKeyBootLoopThreshold is a special key for the number of boot
+	// attempts without a successful boot, in the SpecialKeyBootLoopWindow,
+	// which are accepted before the machine is considered to be in a boot
+	// loop. 0 disables the detection.
+	SpecialKeyBootLoopThreshold = "boot-loop-threshold"
+	// SpecialKeyBootLoopWindow is a special key for the duration which the
+	// boot attempts are counted in, i.e. 1h
+	SpecialKeyBootLoopWindow = "boot-loop-window"
+	// SpecialKeyBootLoopAction is a special key for the boot action which the
+	// machines are switched to when they're in a boot loop, hold or rescue. If
+	// it's empty, the machines are only flagged.
+	SpecialKeyBootLoopAction = "boot-loop-action"
+	// SpecialKeyProfiles is a special key for the comma separated profiles
+	// which the machine is assigned to, the first one has the highest
+	// priority
+	SpecialKeyProfiles = "profiles"
+	// SpecialKeyStrictTemplates is a special key for rendering the templates
+	// of the machines in the strict mode, true or false. In the strict mode,
+	// a template which refers to an unset or empty variable, or a
+	// b64template which fails, fails the rendering.
+	SpecialKeyStrictTemplates = "strict-templates"
 )
 
+// Values of SpecialKeyBootAction
+const (
+	// BootActionInstall boots the coreos image with the configs of the
+	// workspace. It's the default boot action.
+	BootActionInstall = "install"
+	// BootActionInstallOnce is like BootActionInstall, but it's reverted to
+	// BootActionLocalBoot when the booted machine fetches its config
+	BootActionInstallOnce = "install-once"
+	// BootActionLocalBoot boots the machine from its local disk
+	BootActionLocalBoot = "localboot"
+	// BootActionRescue boots the coreos image without any config, with
+	// autologin on the console
+	BootActionRescue = "rescue"
+	// BootActionHold keeps the machine waiting, and retries periodically
+	BootActionHold = "hold"
+)
+
+var bootActions = map[string]bool{
+	BootActionInstall:     true,
+	BootActionInstallOnce: true,
+	BootActionLocalBoot:   true,
+	BootActionRescue:      true,
+	BootActionHold:        true,
+}
+
 // NetworkConfiguration is used to configure clients through dhcp
 type NetworkConfiguration struct {
 	Netmask              net.IP                     `json:"netmask"`
@@ -69,11 +132,18 @@ func UnmarshalNetworkConfiguration(netConfStr string) (*NetworkConfiguration, er
 	if err := json.Unmarshal([]byte(netConfStr), &netConf); err != nil {
 		return nil, err
 	}
-	// TODO: more validation on netmask and ...
+	if netConf.Netmask.To4() == nil {
+		return nil, fmt.Errorf("invalid netmask: %q", netConf.Netmask)
+	}
+	if netConf.Router != nil && netConf.Router.To4() == nil {
+		return nil, fmt.Errorf("invalid router: %q", netConf.Router)
+	}
 	return &netConf, nil
 }
 
-func validateVariable(key, value string) error {
+// ValidateVariable checks the value of a variable of the cluster, a profile
+// or a machine
+func ValidateVariable(key, value string) error {
 	if key == "" {
 		return errors.New("empty value for key is not permitted")
 	}
@@ -89,6 +159,40 @@ func validateVariable(key, value string) error {
 	case SpecialKeyNetworkConfiguration:
 		_, err := UnmarshalNetworkConfiguration(value)
 		return err
+	case SpecialKeyDHCPOptions:
+		_, err := UnmarshalDHCPOptions(value)
+		return err
+	case SpecialKeyImage, SpecialKeyRescueImage:
+		if value != "" && (value == "." || value == ".." || strings.ContainsAny(value, `/\`)) {
+			return fmt.Errorf("invalid image name: %q", value)
+		}
+	case SpecialKeyBootAction:
+		if value != "" && !bootActions[value] {
+			return fmt.Errorf("invalid boot action: %q", value)
+		}
+	case SpecialKeyBootLoopThreshold:
+		if value != "" {
+			if threshold, err := strconv.Atoi(value); err != nil || threshold < 0 {
+				return fmt.Errorf("invalid boot loop threshold: %q", value)
+			}
+		}
+	case SpecialKeyBootLoopWindow:
+		if value != "" {
+			return validateBootLoopWindow(value)
+		}
+	case SpecialKeyProfiles:
+		_, err := ParseProfiles(value)
+		return err
+	case SpecialKeyStrictTemplates:
+		if value != "" {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid strict templates: %q", value)
+			}
+		}
+	case SpecialKeyBootLoopAction:
+		if value != "" && value != BootActionHold && value != BootActionRescue {
+			return fmt.Errorf("invalid boot loop action: %q", value)
+		}
 	}
 	return nil
 }
@@ -28,10 +28,56 @@ func TestValidateVariable(t *testing.T) {
 		{SpecialKeyNetworkConfiguration, "", true},
 		{SpecialKeyNetworkConfiguration,
 			`{"netmask":"invalid"}`, true},
+		{SpecialKeyNetworkConfiguration, `{"router": "172.19.1.1"}`, true},
+		{SpecialKeyNetworkConfiguration,
+			`{"netmask":"255.255.255.0", "router": "fe80::1"}`, true},
+
+		// DHCPOptions
+		{SpecialKeyDHCPOptions, "", false},
+		{SpecialKeyDHCPOptions,
+			`[{"code": 42, "value": ["10.0.0.1", "10.0.0.2"]}, {"code": 26, "value": 9000}]`, false},
+		{SpecialKeyDHCPOptions,
+			`[{"code": 224, "type": "hex", "value": "0a0b"}]`, false},
+
+		{SpecialKeyDHCPOptions, `{"code": 42}`, true},
+		{SpecialKeyDHCPOptions, `[{"code": 224, "value": "0a0b"}]`, true},
+		{SpecialKeyDHCPOptions, `[{"code": 53, "type": "uint8", "value": 5}]`, true},
+		{SpecialKeyDHCPOptions, `[{"code": 42, "value": ["invalid"]}]`, true},
+		{SpecialKeyDHCPOptions, `[{"code": 26, "value": 70000}]`, true},
+
+		// BootAction
+		{SpecialKeyBootAction, "", false},
+		{SpecialKeyBootAction, BootActionLocalBoot, false},
+		{SpecialKeyBootAction, BootActionInstallOnce, false},
+		{SpecialKeyBootAction, "reboot", true},
+
+		// Image
+		{SpecialKeyImage, "flatcar-2345.3.0", false},
+		{SpecialKeyImage, "", false},
+		{SpecialKeyImage, "..", true},
+		{SpecialKeyRescueImage, "debian/../..", true},
+
+		// Boot loop
+		{SpecialKeyBootLoopThreshold, "3", false},
+		{SpecialKeyBootLoopThreshold, "-1", true},
+		{SpecialKeyBootLoopWindow, "30m", false},
+		{SpecialKeyBootLoopWindow, "48h", true},
+		{SpecialKeyBootLoopAction, BootActionHold, false},
+		{SpecialKeyBootLoopAction, BootActionLocalBoot, true},
+
+		// Profiles
+		{SpecialKeyProfiles, "storage, gpu-less", false},
+		{SpecialKeyProfiles, "", false},
+		{SpecialKeyProfiles, "storage,../x", true},
+
+		// Strict templates
+		{SpecialKeyStrictTemplates, "true", false},
+		{SpecialKeyStrictTemplates, "", false},
+		{SpecialKeyStrictTemplates, "yes", true},
 	}
 
 	for i, tt := range tests {
-		got := validateVariable(tt.key, tt.value)
+		got := ValidateVariable(tt.key, tt.value)
 		if tt.err && got == nil {
 			t.Errorf("#%d: expected error, got nil", i)
 		} else if !tt.err && got != nil {
@@ -39,3 +85,37 @@ func TestValidateVariable(t *testing.T) {
 		}
 	}
 }
+
+func TestDHCPOptionsEncode(t *testing.T) {
+	tests := []struct {
+		value    string
+		code     byte
+		expected []byte
+	}{
+		{`[{"code": 42, "value": ["10.0.0.1", "10.0.0.2"]}]`, 42,
+			[]byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		{`[{"code": 26, "value": 9000}]`, 26, []byte{0x23, 0x28}},
+		{`[{"code": 66, "value": "tftp"}]`, 66, []byte("tftp")},
+		{`[{"code": 119, "value": ["a.bc", "d."]}]`, 119,
+			[]byte{1, 'a', 2, 'b', 'c', 0, 1, 'd', 0}},
+		{`[{"code": 224, "type": "bool", "value": true}]`, 224, []byte{1}},
+		{`[{"code": 224, "type": "uint32", "value": 3600}]`, 224, []byte{0, 0, 0x0e, 0x10}},
+		{`[{"code": 43, "value": "0a0b"}, {"code": 43, "value": "0c"}]`, 43, []byte{0x0c}},
+	}
+
+	for i, tt := range tests {
+		dhcpOptions, err := UnmarshalDHCPOptions(tt.value)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", i, err)
+			continue
+		}
+		encoded, err := dhcpOptions.Encode()
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", i, err)
+			continue
+		}
+		if got := encoded[tt.code]; string(got) != string(tt.expected) {
+			t.Errorf("#%d: expected %v, got %v", i, tt.expected, got)
+		}
+	}
+}
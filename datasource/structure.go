@@ -1,6 +1,11 @@
 package datasource // import "github.com/cafebazaar/blacksmith/datasource"
 
-import "net"
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
 
 // MachineType distinguishes normal servers from static ones, and from the BMC inside those machines
 type MachineType int16
@@ -16,6 +21,9 @@ const (
 	// MTBMC is for the baseboard management controller embedded on the
 	// motherboard of the server machines
 	MTBMC MachineType = 3
+	// MTExternal is for the ethernet of a server machine which its IP is
+	// provided by another DHCP server, while we're serving as a proxyDHCP
+	MTExternal MachineType = 4
 )
 
 // Machine details
@@ -23,6 +31,9 @@ type Machine struct {
 	IP        net.IP      `json:"ip"`
 	FirstSeen int64       `json:"first_seen"`
 	Type      MachineType `json:"type"`
+	// Subnet is the name of the subnet which the IP is leased from, empty
+	// for the default lease pool
+	Subnet string `json:"subnet,omitempty"`
 }
 
 // MachineInterface provides the interface for querying/altering
@@ -48,22 +59,88 @@ type MachineInterface interface {
 	// for the returned Machine to have an IP different from createWithIP.
 	Machine(createIfNeeded bool, createWithIP net.IP) (Machine, error)
 
+	// MachineInSubnet is like Machine(true, nil), but a newly created machine
+	// is assigned an IP from the lease pool of the given subnet (the default
+	// pool if subnet is nil). If a MTNormal machine has an IP from another
+	// subnet (e.g. it's moved to another rack), a new IP is assigned to it.
+	MachineInSubnet(subnet *Subnet) (Machine, error)
+
 	// LastSeen returns the last time the machine has been seen
 	LastSeen() (int64, error)
 
+	// RenewLease records that the IP of the machine is leased for the given
+	// duration, starting from now
+	RenewLease(duration time.Duration) error
+
+	// ReleaseLease marks the lease of the machine as expired, so its IP can
+	// be reclaimed
+	ReleaseLease() error
+
+	// LeaseExpiry returns the time the lease of the machine expires, 0 if no
+	// lease is recorded for the machine
+	LeaseExpiry() (int64, error)
+
+	// QuarantineIP marks the IP of the machine as unusable for the given
+	// duration (e.g. because it's declined by the machine), and assigns a
+	// new IP to the machine
+	QuarantineIP(duration time.Duration) (Machine, error)
+
+	// RecordExternalIP creates or updates the machine as a MTExternal one,
+	// with the IP which is assigned to it by another DHCP server. The IPs of
+	// the machines which aren't MTExternal are never taken.
+	RecordExternalIP(ip net.IP) (Machine, error)
+
 	// DeleteMachine deletes a machine from the store entirely
 	DeleteMachine() error
 
 	// CheckIn updates the _last_seen field of the machine
 	CheckIn()
 
+	// RecordBootEvent stores a boot event of the given type, one of the
+	// BootEvent* values, for the machine
+	RecordBootEvent(eventType string) error
+
+	// BootEvents returns the recent boot events of the machine, sorted by
+	// their time
+	BootEvents() ([]BootEvent, error)
+
+	// State returns the lifecycle state of the machine
+	State() (MachineState, error)
+
+	// SetState changes the lifecycle state of the machine, if the transition
+	// is allowed, and records the change in the audit trail
+	SetState(to MachineState, actor string, reason string) error
+
+	// AdvanceState is like SetState, but it's used for the automatic
+	// transitions. If the transition is not allowed, the state is kept, and
+	// false is returned without an error.
+	AdvanceState(to MachineState, actor string, reason string) (bool, error)
+
+	// StateHistory returns the audit trail of the state of the machine, the
+	// oldest change first
+	StateHistory() ([]StateChange, error)
+
 	// ListVariables returns the list of all the flgas of a machine from Etcd
 	ListVariables() (map[string]string, error)
 
-	// GetVariable Gets a machine's variable, or the global if it was not
-	// set for the machine
+	// GetVariable Gets a machine's variable, or the one of its profiles, or
+	// the global if it was not set for the machine
 	GetVariable(key string) (string, error)
 
+	// LookupVariable is like GetVariable, and also returns the source which
+	// the variable is resolved from (see ResolvedVariable), which is empty
+	// if the variable is not set
+	LookupVariable(key string) (value string, source string, err error)
+
+	// Profiles returns the profiles which the machine is assigned to, in the
+	// order of their priority
+	Profiles() ([]string, error)
+
+	// ListResolvedVariables returns the effective variables of the machine,
+	// including the ones from its profiles and the cluster, with their
+	// sources
+	ListResolvedVariables() (map[string]ResolvedVariable, error)
+
 	// SetVariable sets the value of the specified key
 	SetVariable(key string, value string) error
 
@@ -73,13 +150,17 @@ type MachineInterface interface {
 
 // InstanceInfo describes an active instance of blacksmith running on some machine
 type InstanceInfo struct {
-	IP               net.IP           `json:"ip"`
-	Nic              net.HardwareAddr `json:"nic"`
-	WebPort          int              `json:"webPort"`
-	Version          string           `json:"version"`
-	Commit           string           `json:"commit"`
-	BuildTime        string           `json:"buildTime"`
-	ServiceStartTime int64            `json:"serviceStartTime"`
+	IP      net.IP           `json:"ip"`
+	Nic     net.HardwareAddr `json:"nic"`
+	WebPort int              `json:"webPort"`
+	// HTTPBooterPort is the port of the http booter of the instance, which is
+	// served by the standby instances too. It's zero for the versions which
+	// serve the booter only on the master.
+	HTTPBooterPort   int    `json:"httpBooterPort,omitempty"`
+	Version          string `json:"version"`
+	Commit           string `json:"commit"`
+	BuildTime        string `json:"buildTime"`
+	ServiceStartTime int64  `json:"serviceStartTime"`
 }
 
 // File describes a file located inside our workspace
@@ -88,7 +169,8 @@ type File struct {
 	Name                 string `json:"name"`
 	FromInstance         string `json:"fromInstance"`
 	Location             string `json:"location"`
-	UploadedAt           int64  `json:"uploadedAt"` // unix timestamp
+	Uploader             string `json:"uploader,omitempty"` // address of the client
+	UploadedAt           int64  `json:"uploadedAt"`         // unix timestamp
 	Size                 int64  `json:"size"`
 	LastModificationDate int64  `json:"lastModifiedDate"`
 }
@@ -108,6 +190,10 @@ type DataSource interface {
 	// WhileMaster makes a heartbeat and returns IsMaster()
 	WhileMaster() error
 
+	// Campaign blocks until this instance is the master, or ctx is done.
+	// The returned leadership is canceled as soon as the mastership is lost.
+	Campaign(ctx context.Context) (*Leadership, error)
+
 	// Shutdown removes the instance key from the list of instances, used to
 	// gracefully shutdown the instance
 	Shutdown() error
@@ -127,6 +213,10 @@ type DataSource interface {
 	// mac
 	MachineInterface(mac net.HardwareAddr) MachineInterface
 
+	// MachineInterfaceByIP returns the MachineInterface of the machine which
+	// the given IP is assigned to
+	MachineInterfaceByIP(ip net.IP) (MachineInterface, error)
+
 	// ListClusterVariables returns the list of all the cluster variables
 	ListClusterVariables() (map[string]string, error)
 
@@ -139,6 +229,69 @@ type DataSource interface {
 	// DeleteClusterVariable delete a cluster variable from etcd.
 	DeleteClusterVariable(key string) error
 
+	// Profiles returns the names of the profiles which have any variables
+	Profiles() ([]string, error)
+
+	// ListProfileVariables returns the variables of the profile
+	ListProfileVariables(profile string) (map[string]string, error)
+
+	// SetProfileVariable sets a variable of the profile, creating the
+	// profile if needed
+	SetProfileVariable(profile string, key string, value string) error
+
+	// DeleteProfileVariable deletes a variable of the profile
+	DeleteProfileVariable(profile string, key string) error
+
+	// DeleteProfile deletes the profile with all its variables
+	DeleteProfile(profile string) error
+
+	// Subnets returns all the subnets defined for the cluster
+	Subnets() ([]Subnet, error)
+
+	// Subnet returns the subnet with the given name
+	Subnet(name string) (*Subnet, error)
+
+	// SubnetOf returns the subnet which contains the given ip, nil if there
+	// is no such subnet
+	SubnetOf(ip net.IP) (*Subnet, error)
+
+	// SetSubnet creates or updates a subnet
+	SetSubnet(subnet Subnet) error
+
+	// DeleteSubnet deletes a subnet
+	DeleteSubnet(name string) error
+
+	// ReclaimExpiredLeases returns the IPs of the MTNormal machines whose
+	// lease has expired more than grace ago to the pool, and returns the
+	// number of reclaimed IPs. MTStatic and MTBMC machines are never
+	// reclaimed.
+	ReclaimExpiredLeases(grace time.Duration) (int, error)
+
+	// File returns the file with the given id
+	File(id string) (*File, error)
+
+	// Files returns all the recorded files
+	Files() ([]File, error)
+
+	// PutFile records a file, which is available on file.FromInstance at
+	// file.Location
+	PutFile(file File) error
+
+	// DeleteFile deletes the record of a file
+	DeleteFile(id string) error
+
+	// WorkspaceSyncStatuses returns the workspace sync status of the
+	// instances, by their web address
+	WorkspaceSyncStatuses() (map[string]WorkspaceSyncStatus, error)
+
+	// SetWorkspaceSyncStatus records the workspace sync status of this
+	// instance
+	SetWorkspaceSyncStatus(status WorkspaceSyncStatus) error
+
+	// WaitForWorkspaceChange blocks until the active workspace hash is
+	// changed, or ctx is done
+	WaitForWorkspaceChange(ctx context.Context) error
+
 	// EtcdMembers returns a string suitable for `-initial-cluster`
 	// This is the etcd the Blacksmith instance is using as its datastore
 	// Smelly function to be here! but it's a lot helpful.
@@ -0,0 +1,156 @@
+package datasource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/krolaw/dhcp4"
+	"golang.org/x/net/context"
+)
+
+// Subnet describes an L3 segment which its machines are served by our DHCP,
+// directly or through a DHCP relay agent. Each subnet has its own lease pool
+// and network configuration.
+type Subnet struct {
+	Name       string `json:"name"`
+	Network    string `json:"network"` // in CIDR notation, e.g. 10.0.1.0/24
+	LeaseStart net.IP `json:"leaseStart"`
+	LeaseRange int    `json:"leaseRange"`
+	NetworkConfiguration
+}
+
+// IPNet returns the parsed Network of the subnet
+func (s *Subnet) IPNet() (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(s.Network)
+	return ipNet, err
+}
+
+// Contains reports whether the ip is inside the subnet
+func (s *Subnet) Contains(ip net.IP) bool {
+	ipNet, err := s.IPNet()
+	if err != nil {
+		return false
+	}
+	return ipNet.Contains(ip)
+}
+
+// validate checks the subnet to be usable for leasing IPs
+func (s *Subnet) validate() error {
+	if s.Name == "" {
+		return errors.New("empty name for subnet is not permitted")
+	}
+	if s.Name != path.Base(s.Name) || s.Name[0] == '.' {
+		return fmt.Errorf("invalid subnet name: %q", s.Name)
+	}
+	ipNet, err := s.IPNet()
+	if err != nil {
+		return fmt.Errorf("invalid network for subnet %q: %s", s.Name, err)
+	}
+	if s.LeaseStart.To4() == nil || !ipNet.Contains(s.LeaseStart) {
+		return fmt.Errorf("leaseStart of subnet %q is not inside %s", s.Name, s.Network)
+	}
+	if s.LeaseRange < 1 {
+		return fmt.Errorf("leaseRange of subnet %q should be positive", s.Name)
+	}
+	if !ipNet.Contains(dhcp4.IPAdd(s.LeaseStart, s.LeaseRange-1)) {
+		return fmt.Errorf("lease pool of subnet %q exceeds %s", s.Name, s.Network)
+	}
+	if s.Netmask.To4() == nil {
+		return fmt.Errorf("netmask of subnet %q is not set", s.Name)
+	}
+	return nil
+}
+
+func (ds *EtcdDataSource) prefixifyForSubnets(name string) string {
+	return path.Join(ds.ClusterName(), etcdSubnetsDirName, name)
+}
+
+// Subnets returns all the subnets defined for the cluster
+func (ds *EtcdDataSource) Subnets() ([]Subnet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var ret []Subnet
+
+	response, err := ds.keysAPI.Get(ctx, path.Join(ds.clusterName, etcdSubnetsDirName), nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	for _, n := range response.Node.Nodes {
+		var subnet Subnet
+		if err := json.Unmarshal([]byte(n.Value), &subnet); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal subnet: %s / value=%q",
+				err, n.Value)
+		}
+		ret = append(ret, subnet)
+	}
+	return ret, nil
+}
+
+// Subnet returns the subnet with the given name
+func (ds *EtcdDataSource) Subnet(name string) (*Subnet, error) {
+	value, err := ds.get(ds.prefixifyForSubnets(name))
+	if err != nil {
+		return nil, err
+	}
+	var subnet Subnet
+	if err := json.Unmarshal([]byte(value), &subnet); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal subnet: %s / value=%q",
+			err, value)
+	}
+	return &subnet, nil
+}
+
+// SubnetOf returns the subnet which contains the given ip, nil if there is
+// no such subnet
+func (ds *EtcdDataSource) SubnetOf(ip net.IP) (*Subnet, error) {
+	subnets, err := ds.Subnets()
+	if err != nil {
+		return nil, err
+	}
+	for i := range subnets {
+		if subnets[i].Contains(ip) {
+			return &subnets[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// SetSubnet creates or updates a subnet
+func (ds *EtcdDataSource) SetSubnet(subnet Subnet) error {
+	if err := subnet.validate(); err != nil {
+		return err
+	}
+	jsoned, err := json.Marshal(subnet)
+	if err != nil {
+		return fmt.Errorf("error while marshaling the subnet: %s", err)
+	}
+	return ds.set(ds.prefixifyForSubnets(subnet.Name), string(jsoned))
+}
+
+// DeleteSubnet deletes a subnet. Machines which are leased an IP from this
+// subnet keep their IP.
+func (ds *EtcdDataSource) DeleteSubnet(name string) error {
+	return ds.delete(ds.prefixifyForSubnets(name))
+}
+
+// leasePool returns the lease pool of the subnet with the given name, or the
+// default pool if name is empty
+func (ds *EtcdDataSource) leasePool(subnetName string) (net.IP, int, error) {
+	if subnetName == "" {
+		return ds.leaseStart, ds.leaseRange, nil
+	}
+	subnet, err := ds.Subnet(subnetName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while getting the subnet %q: %s", subnetName, err)
+	}
+	return subnet.LeaseStart, subnet.LeaseRange, nil
+}
@@ -0,0 +1,124 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSubnetValidate(t *testing.T) {
+	netmask := net.IPv4(255, 255, 255, 0)
+	tests := []struct {
+		subnet Subnet
+		err    bool
+	}{
+		{Subnet{Name: "rack1", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 100, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, false},
+
+		{Subnet{Name: "", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 100, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, true},
+		{Subnet{Name: "a/b", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 100, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, true},
+		{Subnet{Name: "rack1", Network: "10.0.1.0", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 100, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, true},
+		{Subnet{Name: "rack1", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 2, 10),
+			LeaseRange: 100, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, true},
+		{Subnet{Name: "rack1", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 0, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, true},
+		{Subnet{Name: "rack1", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 250, NetworkConfiguration: NetworkConfiguration{Netmask: netmask}}, true},
+		{Subnet{Name: "rack1", Network: "10.0.1.0/24", LeaseStart: net.IPv4(10, 0, 1, 10),
+			LeaseRange: 100}, true},
+	}
+
+	for i, tt := range tests {
+		got := tt.subnet.validate()
+		if tt.err && got == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		} else if !tt.err && got != nil {
+			t.Errorf("#%d: expected no error, got %q", i, got)
+		}
+	}
+}
+
+func TestMachineInSubnet(t *testing.T) {
+	forEachBackend(t, nil, testMachineInSubnet)
+}
+
+func testMachineInSubnet(t *testing.T, ds DataSource) {
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	subnet := Subnet{
+		Name:       "rack1",
+		Network:    "10.0.1.0/24",
+		LeaseStart: net.IPv4(10, 0, 1, 10),
+		LeaseRange: 10,
+		NetworkConfiguration: NetworkConfiguration{
+			Netmask: net.IPv4(255, 255, 255, 0),
+			Router:  net.IPv4(10, 0, 1, 1),
+		},
+	}
+	if err := ds.SetSubnet(subnet); err != nil {
+		t.Error("error in setting the subnet:", err)
+		return
+	}
+
+	got, err := ds.SubnetOf(net.IPv4(10, 0, 1, 1))
+	if err != nil {
+		t.Error("error in getting the subnet of relay agent:", err)
+		return
+	}
+	if got == nil || got.Name != subnet.Name {
+		t.Error("expecting the relay agent to be inside rack1, got:", got)
+		return
+	}
+
+	got, err = ds.SubnetOf(net.IPv4(10, 0, 2, 1))
+	if err != nil {
+		t.Error("error in getting the subnet of an unknown relay agent:", err)
+		return
+	}
+	if got != nil {
+		t.Error("expecting no subnet for an unknown relay agent, got:", got)
+		return
+	}
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
+	mi := ds.MachineInterface(mac)
+
+	machine, err := mi.Machine(true, nil)
+	if err != nil {
+		t.Error("error in creating the machine:", err)
+		return
+	}
+	if subnet.Contains(machine.IP) {
+		t.Error("expecting the machine to be assigned from the default pool, got:", machine.IP)
+		return
+	}
+
+	machine, err = mi.MachineInSubnet(&subnet)
+	if err != nil {
+		t.Error("error in moving the machine to rack1:", err)
+		return
+	}
+	if !subnet.Contains(machine.IP) || machine.Subnet != subnet.Name {
+		t.Errorf("expecting the machine to be assigned from rack1, got: %v", machine)
+		return
+	}
+
+	again, err := mi.MachineInSubnet(&subnet)
+	if err != nil {
+		t.Error("error in getting the machine in rack1:", err)
+		return
+	}
+	if !again.IP.Equal(machine.IP) {
+		t.Error("same MAC address got two different IPs in the same subnet:", machine.IP, again.IP)
+		return
+	}
+}
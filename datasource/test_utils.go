@@ -2,6 +2,7 @@ package datasource
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"golang.org/x/net/context"
 
 	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
 )
 
 // ForTestParams is the way to create a customized DataSource to be
@@ -31,12 +33,44 @@ const (
 	forTestDNSIPStrings         = "8.8.8.8"
 )
 
+// ForTestBackend is the datastore of a DataSource which is used in a test
+type ForTestBackend string
+
+const (
+	// ForTestLocal is a BoltDB file in the temp directory
+	ForTestLocal ForTestBackend = "local"
+	// ForTestEtcd is the v3 api of the etcd at ETCD_ENDPOINT
+	ForTestEtcd ForTestBackend = "etcd"
+	// ForTestEtcd2 is the v2 api of the etcd at ETCD_ENDPOINT
+	ForTestEtcd2 ForTestBackend = "etcd2"
+)
+
+// ForTestBackends returns the backends which can be tested: the local one,
+// and the ones of etcd if ETCD_ENDPOINT is set
+func ForTestBackends() []ForTestBackend {
+	if os.Getenv("ETCD_ENDPOINT") == "" {
+		return []ForTestBackend{ForTestLocal}
+	}
+	return []ForTestBackend{ForTestLocal, ForTestEtcd, ForTestEtcd2}
+}
+
 var (
 	forTestLock  = &sync.Mutex{}
 	forTestIndex = 1
 )
 
-func etcdClietForTest() (etcd.Client, error) {
+func etcdClietForTest() (*clientv3.Client, error) {
+	etcdFlag := os.Getenv("ETCD_ENDPOINT")
+
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(etcdFlag, ","),
+		DialTimeout: 5 * time.Second,
+	})
+
+	return etcdClient, err
+}
+
+func etcd2ClietForTest() (etcd.Client, error) {
 	etcdFlag := os.Getenv("ETCD_ENDPOINT")
 
 	etcdClient, err := etcd.New(etcd.Config{
@@ -47,8 +81,10 @@ func etcdClietForTest() (etcd.Client, error) {
 	return etcdClient, err
 }
 
-// ForTest constructs a DataSource to be used in tests
-func ForTest(params *ForTestParams) (DataSource, error) {
+// ForTest constructs a DataSource on the backend to be used in tests. The
+// returned cleanup func removes what's created for it, i.e. the file of the
+// local datastore, and should be called at the end of the test.
+func ForTest(backend ForTestBackend, params *ForTestParams) (DataSource, func(), error) {
 	var err error
 
 	leaseStart := net.ParseIP(forTestDefaultLeaseStart)
@@ -84,28 +120,12 @@ func ForTest(params *ForTestParams) (DataSource, error) {
 	var dhcpIF *net.Interface
 	dhcpIF, err = net.InterfaceByName(listenIF)
 	if err != nil {
-		return nil,
+		return nil, nil,
 			fmt.Errorf("error while trying to get the interface (%s): %s", listenIF, err)
 	}
 
 	serverIP := net.IPv4(127, 0, 0, 1)
 
-	etcdClient, err := etcdClietForTest()
-
-	if err != nil {
-		return nil, fmt.Errorf("etcd instance not found: %s", err)
-	}
-
-	kapi := etcd.NewKeysAPI(etcdClient)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err = kapi.Delete(ctx, clusterNameFlag,
-		&etcd.DeleteOptions{Dir: true, Recursive: true})
-	if err != nil && !etcd.IsKeyNotFound(err) {
-		return nil, fmt.Errorf("error while purging previous data from etcd: %s", err)
-	}
-
 	selfInfo := InstanceInfo{
 		IP:               serverIP,
 		Nic:              dhcpIF.HardwareAddr,
@@ -116,20 +136,86 @@ func ForTest(params *ForTestParams) (DataSource, error) {
 		ServiceStartTime: time.Now().UTC().Unix(),
 	}
 
-	etcdDataSource, err := NewEtcdDataSource(
-		kapi,
-		etcdClient,
-		leaseStart,
-		leaseRange,
-		clusterNameFlag,
-		workspacePath,
-		dnsIPStrings,
-		selfInfo,
-	)
+	switch backend {
+	case ForTestLocal:
+		dbFile, err := ioutil.TempFile("", clusterNameFlag)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while creating the local datastore: %s", err)
+		}
+		dbFile.Close()
 
-	if err != nil {
-		return nil, fmt.Errorf("couldn't create runtime configuration: %s", err)
+		localDataSource, err := NewLocalDataSource(dbFile.Name(), leaseStart, leaseRange,
+			clusterNameFlag, workspacePath, selfInfo)
+		if err != nil {
+			os.Remove(dbFile.Name())
+			return nil, nil, fmt.Errorf("couldn't create runtime configuration: %s", err)
+		}
+		cleanup := func() {
+			localDataSource.(*EtcdDataSource).keysAPI.(*localKeysAPI).Close()
+			os.Remove(dbFile.Name())
+		}
+		return localDataSource, cleanup, nil
+
+	case ForTestEtcd2:
+		etcdClient, err := etcd2ClietForTest()
+		if err != nil {
+			return nil, nil, fmt.Errorf("etcd instance not found: %s", err)
+		}
+		kapi := etcd.NewKeysAPI(etcdClient)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_, err = kapi.Delete(ctx, clusterNameFlag,
+			&etcd.DeleteOptions{Dir: true, Recursive: true})
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return nil, nil, fmt.Errorf("error while purging previous data from etcd: %s", err)
+		}
+
+		etcdDataSource, err := NewEtcdDataSource(
+			kapi,
+			etcdClient,
+			leaseStart,
+			leaseRange,
+			clusterNameFlag,
+			workspacePath,
+			dnsIPStrings,
+			selfInfo,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't create runtime configuration: %s", err)
+		}
+		return etcdDataSource, func() {}, nil
+
+	case ForTestEtcd:
+		etcdClient, err := etcdClietForTest()
+		if err != nil {
+			return nil, nil, fmt.Errorf("etcd instance not found: %s", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_, err = etcdClient.Delete(ctx, keysDirPrefix("/"+clusterNameFlag),
+			clientv3.WithPrefix())
+		if err != nil {
+			etcdClient.Close()
+			return nil, nil, fmt.Errorf("error while purging previous data from etcd: %s", err)
+		}
+
+		etcdDataSource, err := NewEtcdV3DataSource(
+			etcdClient,
+			leaseStart,
+			leaseRange,
+			clusterNameFlag,
+			workspacePath,
+			dnsIPStrings,
+			selfInfo,
+		)
+		if err != nil {
+			etcdClient.Close()
+			return nil, nil, fmt.Errorf("couldn't create runtime configuration: %s", err)
+		}
+		return etcdDataSource, func() { etcdClient.Close() }, nil
 	}
 
-	return etcdDataSource, nil
+	return nil, nil, fmt.Errorf("unknown backend: %s", backend)
 }
@@ -0,0 +1,138 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// The states of the workspace of an instance
+const (
+	WorkspaceSynced     = "synced"
+	WorkspaceSyncing    = "syncing"
+	WorkspaceSyncFailed = "failed"
+)
+
+// WorkspaceSyncStatus describes how the workspace of an instance is synced
+// with the active workspace of the cluster
+type WorkspaceSyncStatus struct {
+	// Hash is the hash of the workspace which the instance serves, empty if
+	// it has none
+	Hash string `json:"hash"`
+	// Target is the hash of the active workspace, which the instance is
+	// syncing to
+	Target    string `json:"target"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"`
+	UpdatedAt int64  `json:"updatedAt"` // unix timestamp
+}
+
+func (ds *EtcdDataSource) prefixifyForFiles(id string) string {
+	return path.Join(ds.ClusterName(), etcdFilesDirName, id)
+}
+
+func (ds *EtcdDataSource) prefixifyForWorkspaceSync(instance string) string {
+	return path.Join(ds.ClusterName(), etcdWorkspaceSyncDirName, instance)
+}
+
+// File returns the file with the given id, which is recorded by PutFile
+func (ds *EtcdDataSource) File(id string) (*File, error) {
+	value, err := ds.get(ds.prefixifyForFiles(id))
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := json.Unmarshal([]byte(value), &file); err != nil {
+		return nil, fmt.Errorf("error while unmarshalling file %q: %s", id, err)
+	}
+	return &file, nil
+}
+
+// Files returns all the recorded files
+func (ds *EtcdDataSource) Files() ([]File, error) {
+	values, err := ds.listNonDirKeyValues(path.Join(ds.ClusterName(), etcdFilesDirName))
+	if err != nil {
+		if isEtcdErrorCode(err, etcd.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	files := make([]File, 0, len(values))
+	for id, value := range values {
+		var file File
+		if err := json.Unmarshal([]byte(value), &file); err != nil {
+			return nil, fmt.Errorf("error while unmarshalling file %q: %s", id, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// PutFile records a file, which is available on file.FromInstance at
+// file.Location
+func (ds *EtcdDataSource) PutFile(file File) error {
+	if file.ID == "" || file.ID != path.Base(file.ID) || file.ID[0] == '.' {
+		return fmt.Errorf("invalid file id: %q", file.ID)
+	}
+	value, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("error while marshalling file %q: %s", file.ID, err)
+	}
+	return ds.set(ds.prefixifyForFiles(file.ID), string(value))
+}
+
+// DeleteFile deletes the record of a file
+func (ds *EtcdDataSource) DeleteFile(id string) error {
+	return ds.delete(ds.prefixifyForFiles(id))
+}
+
+// WorkspaceSyncStatuses returns the workspace sync status of the instances,
+// by their web address
+func (ds *EtcdDataSource) WorkspaceSyncStatuses() (map[string]WorkspaceSyncStatus, error) {
+	values, err := ds.listNonDirKeyValues(path.Join(ds.ClusterName(), etcdWorkspaceSyncDirName))
+	if err != nil {
+		if isEtcdErrorCode(err, etcd.ErrorCodeKeyNotFound) {
+			return map[string]WorkspaceSyncStatus{}, nil
+		}
+		return nil, err
+	}
+
+	statuses := make(map[string]WorkspaceSyncStatus, len(values))
+	for instance, value := range values {
+		var status WorkspaceSyncStatus
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			return nil, fmt.Errorf("error while unmarshalling the workspace sync status of %s: %s",
+				instance, err)
+		}
+		statuses[instance] = status
+	}
+	return statuses, nil
+}
+
+// SetWorkspaceSyncStatus records the workspace sync status of this instance
+func (ds *EtcdDataSource) SetWorkspaceSyncStatus(status WorkspaceSyncStatus) error {
+	status.UpdatedAt = time.Now().Unix()
+	value, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("error while marshalling the workspace sync status: %s", err)
+	}
+	return ds.set(ds.prefixifyForWorkspaceSync(ds.selfInfo.WebAddr()), string(value))
+}
+
+// WaitForWorkspaceChange blocks until the active workspace hash is changed,
+// or ctx is done
+func (ds *EtcdDataSource) WaitForWorkspaceChange(ctx context.Context) error {
+	if ds.alwaysMaster {
+		// the local store is not shared, nothing to wait for
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	watcher := ds.keysAPI.Watcher(ds.prefixifyForClusterVariables(ActiveWorkspaceHashKey), nil)
+	_, err := watcher.Next(ctx)
+	return err
+}
@@ -0,0 +1,70 @@
+package dhcp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	dhcpServerPort = 67
+	// offset of giaddr field in the BOOTP header
+	giaddrOffset = 24
+)
+
+// giaddrOf returns the relay agent IP of the packet, nil if the packet is
+// not relayed
+func giaddrOf(b []byte) net.IP {
+	if len(b) < giaddrOffset+4 {
+		return nil
+	}
+	giaddr := net.IP(b[giaddrOffset : giaddrOffset+4])
+	if giaddr.Equal(net.IPv4zero) {
+		return nil
+	}
+	return giaddr
+}
+
+// serveConn implements dhcp4.ServeConn. It accepts the packets received on
+// the interface with index=ifIndex (any interface if ifIndex is 0), and the
+// packets which are relayed to us by a DHCP relay agent. The replies to a
+// relayed packet are unicasted to the relay agent, as specified in rfc2131.
+type serveConn struct {
+	ifIndex int
+	conn    *ipv4.PacketConn
+	cm      *ipv4.ControlMessage
+}
+
+func newServeConn(ifIndex int, pconn net.PacketConn) (*serveConn, error) {
+	p := ipv4.NewPacketConn(pconn)
+	if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	return &serveConn{ifIndex: ifIndex, conn: p}, nil
+}
+
+func (s *serveConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, s.cm, addr, err = s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if s.ifIndex == 0 || giaddrOf(b[:n]) != nil {
+			return
+		}
+		if s.cm != nil && s.cm.IfIndex == s.ifIndex {
+			return
+		}
+	}
+}
+
+func (s *serveConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if giaddr := giaddrOf(b); giaddr != nil {
+		return s.conn.WriteTo(b, nil, &net.UDPAddr{IP: giaddr, Port: dhcpServerPort})
+	}
+	var cm *ipv4.ControlMessage
+	if s.ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: s.ifIndex}
+	}
+	return s.conn.WriteTo(b, cm, addr)
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
 )
 
 func TestDnsAddressesForDHCP(t *testing.T) {
@@ -32,3 +33,73 @@ func TestDnsAddressesForDHCP(t *testing.T) {
 		}
 	}
 }
+
+func TestGiaddrOf(t *testing.T) {
+	packet := make([]byte, 240)
+	if giaddr := giaddrOf(packet); giaddr != nil {
+		t.Error("expecting nil giaddr for a packet which is not relayed, got:", giaddr)
+	}
+
+	copy(packet[giaddrOffset:], []byte{10, 0, 1, 1})
+	if giaddr := giaddrOf(packet); !giaddr.Equal(net.IPv4(10, 0, 1, 1)) {
+		t.Error("expecting 10.0.1.1 as giaddr, got:", giaddr)
+	}
+
+	if giaddr := giaddrOf(packet[:10]); giaddr != nil {
+		t.Error("expecting nil giaddr for a short packet, got:", giaddr)
+	}
+}
+
+func TestOnSubnet(t *testing.T) {
+	h := &Handler{serverIP: net.IPv4(10, 0, 0, 1)}
+	netConf := &datasource.NetworkConfiguration{Netmask: net.IPv4(255, 255, 255, 0)}
+	subnet := &datasource.Subnet{Name: "rack1", Network: "10.0.1.0/24"}
+
+	tests := []struct {
+		ip       net.IP
+		subnet   *datasource.Subnet
+		expected bool
+	}{
+		{net.IPv4(10, 0, 0, 10), nil, true},
+		{net.IPv4(10, 0, 1, 10), nil, false},
+		{net.IPv4(10, 0, 1, 10), subnet, true},
+		{net.IPv4(10, 0, 0, 10), subnet, false},
+	}
+
+	for i, tt := range tests {
+		if got := h.onSubnet(tt.ip, tt.subnet, netConf); got != tt.expected {
+			t.Errorf("#%d: expected %v for %s, got %v", i, tt.expected, tt.ip, got)
+		}
+	}
+}
+
+func TestWithoutOptions(t *testing.T) {
+	options := []dhcp4.Option{
+		{Code: dhcp4.OptionSubnetMask},
+		{Code: dhcp4.OptionVendorClassIdentifier},
+		{Code: dhcp4.OptionRouter},
+		{Code: dhcp4.OptionVendorSpecificInformation},
+	}
+	got := withoutOptions(options,
+		dhcp4.OptionVendorClassIdentifier, dhcp4.OptionVendorSpecificInformation)
+	if len(got) != 2 || got[0].Code != dhcp4.OptionSubnetMask || got[1].Code != dhcp4.OptionRouter {
+		t.Error("unexpected options after exclusion:", got)
+	}
+}
+
+func TestIsIPXEClient(t *testing.T) {
+	if isIPXEClient(dhcp4.Options{}) {
+		t.Error("expecting a request without user class not to be from iPXE")
+	}
+	if !isIPXEClient(dhcp4.Options{dhcp4.OptionUserClass: []byte("iPXE")}) {
+		t.Error("expecting a request with iPXE user class to be from iPXE")
+	}
+}
+
+func TestProxyIgnoresNonPXEClients(t *testing.T) {
+	h := &Handler{proxy: true}
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	if reply := h.ServeDHCP(p, dhcp4.Discover, dhcp4.Options{}); reply != nil {
+		t.Error("expecting no reply for a client which is not a PXE client")
+	}
+}
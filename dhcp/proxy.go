@@ -0,0 +1,126 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/krolaw/dhcp4"
+)
+
+// StartProxyDHCP is like StartDHCP, but the IPs are expected to be assigned
+// by another DHCP server on the segment. Only the PXE clients are answered,
+// with the boot options and without yiaddr, as specified for the proxyDHCP
+// servers in the PXE specification.
+func StartProxyDHCP(leadership *datasource.Leadership, ifName string, serverIP net.IP,
+	booters *pxe.Booters, datasource datasource.DataSource) error {
+	handler := &Handler{
+		leadership:  leadership,
+		ifName:      ifName,
+		serverIP:    serverIP,
+		booters:     booters,
+		datasource:  datasource,
+		bootMessage: fmt.Sprintf("Blacksmith (%s)", datasource.SelfInfo().Version),
+		proxy:       true,
+	}
+
+	log.WithFields(log.Fields{
+		"where":  "dhcp.StartProxyDHCP",
+		"action": "announce",
+	}).Infof("Listening on %s:67 as proxyDHCP (interface: %s)", serverIP.String(), ifName)
+
+	return serve(handler)
+}
+
+// serveProxyDHCP offers the boot options to the PXE clients, and records the
+// IPs which they request from the other DHCP server
+func (h *Handler) serveProxyDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	guidVal, isPxe := options[97]
+	isIPXE := isIPXEClient(options)
+	if isPxe && len(guidVal) == 0 {
+		isPxe = false
+	}
+	if !isPxe && !isIPXE {
+		return nil // the other DHCP server is responsible for this client
+	}
+
+	machineInterface := h.datasource.MachineInterface(p.CHAddr())
+
+	switch msgType {
+	case dhcp4.Discover:
+		var replyOptions []dhcp4.Option
+		var scriptURL string
+		if isIPXE {
+			scriptURL = pxe.IPXEScriptURL(h.booters.For(p.CHAddr()), p.CHAddr())
+			replyOptions = append(replyOptions,
+				dhcp4.Option{
+					Code:  dhcp4.OptionVendorClassIdentifier,
+					Value: []byte("PXEClient"),
+				},
+				dhcp4.Option{
+					Code:  dhcp4.OptionBootFileName,
+					Value: []byte(scriptURL),
+				},
+			)
+		} else {
+			if _, err := bootloaderFor(options); err != nil {
+				log.WithField("where", "dhcp.serveProxyDHCP").WithError(err).Warnf(
+					"can't pxe boot %s", p.CHAddr().String())
+				return nil
+			}
+			replyOptions = h.pxeOptions(guidVal)
+		}
+
+		log.WithFields(log.Fields{
+			"where":   "dhcp.serveProxyDHCP",
+			"action":  "debug",
+			"object":  p.CHAddr().String(),
+			"subject": msgType,
+		}).Infof("proxy offer isIPXE=%v", isIPXE)
+
+		packet := dhcp4.ReplyPacket(p, dhcp4.Offer, h.serverIP, nil, 0, replyOptions)
+		if scriptURL != "" {
+			// some iPXE builds only look at the file field
+			packet.SetFile([]byte(scriptURL))
+		}
+		return packet
+
+	case dhcp4.Request:
+		// The request is sent to the other DHCP server, and its answer is
+		// not seen here. The requested IP is recorded, but it's not taken
+		// from the machines whose IPs are assigned by us (see
+		// RecordExternalIP).
+		requestedIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
+		if requestedIP == nil {
+			requestedIP = net.IP(p.CIAddr())
+		}
+		if len(requestedIP) != 4 || requestedIP.Equal(net.IPv4zero) {
+			return nil
+		}
+
+		machine, err := machineInterface.RecordExternalIP(requestedIP)
+		if err != nil {
+			log.WithField("where", "dhcp.serveProxyDHCP").WithError(err).Warn(
+				"failed to record the IP")
+			return nil
+		}
+		machineInterface.CheckIn()
+		_, err = machineInterface.AdvanceState(datasource.StateDiscovered, "proxy-dhcp",
+			"offered "+machine.IP.String())
+		if err != nil {
+			log.WithField("where", "dhcp.serveProxyDHCP").WithError(err).Warn(
+				"failed to advance the state")
+		}
+		h.recordBootedWorkspace(machineInterface)
+
+		log.WithFields(log.Fields{
+			"where":   "dhcp.serveProxyDHCP",
+			"action":  "debug",
+			"object":  p.CHAddr().String(),
+			"subject": msgType,
+		}).Infof("externalIp=%s", machine.IP.String())
+	}
+	return nil
+}
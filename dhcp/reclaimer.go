@@ -0,0 +1,42 @@
+package dhcp
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+	"golang.org/x/net/context"
+)
+
+const (
+	reclaimInterval = time.Minute
+)
+
+// StartLeaseReclaimer periodically returns the IPs of the machines whose
+// lease has expired more than grace ago to the pool. It's expected to be
+// called on the master instance, and runs until ctx is done.
+func StartLeaseReclaimer(ctx context.Context, ds datasource.DataSource, grace time.Duration) error {
+	log.WithFields(log.Fields{
+		"where":  "dhcp.StartLeaseReclaimer",
+		"action": "announce",
+	}).Infof("Reclaiming the leases expired more than %s ago", grace)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reclaimInterval):
+		}
+
+		n, err := ds.ReclaimExpiredLeases(grace)
+		if err != nil {
+			log.WithField("where", "dhcp.StartLeaseReclaimer").WithError(err).Warn(
+				"failed to reclaim expired leases")
+			continue
+		}
+		if n > 0 {
+			log.WithField("where", "dhcp.StartLeaseReclaimer").Infof(
+				"%d expired leases reclaimed", n)
+		}
+	}
+}
@@ -10,12 +10,22 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/utils"
 	"github.com/krolaw/dhcp4"
 )
 
 const (
 	minLeaseHours = 24
 	maxLeaseHours = 48
+
+	// offerHoldDuration is how long an offered IP is kept for a machine
+	// which hasn't requested it yet
+	offerHoldDuration = 5 * time.Minute
+
+	// declineQuarantineDuration is how long a declined IP is not assigned to
+	// any machine
+	declineQuarantineDuration = time.Hour
 )
 
 func randLeaseDuration() time.Duration {
@@ -24,11 +34,16 @@ func randLeaseDuration() time.Duration {
 }
 
 // StartDHCP ListenAndServe for dhcp on port 67, binds on interface=ifName if it's
-// not empty
-func StartDHCP(ifName string, serverIP net.IP, datasource datasource.DataSource) error {
+// not empty. Packets relayed to serverIP by a DHCP relay agent are accepted
+// regardless of the interface they're received on. It replies only while the
+// leadership is valid, and stops when it's lost.
+func StartDHCP(leadership *datasource.Leadership, ifName string, serverIP net.IP,
+	booters *pxe.Booters, datasource datasource.DataSource) error {
 	handler := &Handler{
+		leadership:  leadership,
 		ifName:      ifName,
 		serverIP:    serverIP,
+		booters:     booters,
 		datasource:  datasource,
 		bootMessage: fmt.Sprintf("Blacksmith (%s)", datasource.SelfInfo().Version),
 	}
@@ -38,31 +53,63 @@ func StartDHCP(ifName string, serverIP net.IP, datasource datasource.DataSource)
 		"action": "announce",
 	}).Infof("Listening on %s:67 (interface: %s)", serverIP.String(), ifName)
 
-	var err error
-	if ifName != "" {
-		err = dhcp4.ListenAndServeIf(ifName, handler)
-	} else {
-		err = dhcp4.ListenAndServe(handler)
+	return serve(handler)
+}
+
+// serve listens on port 67 for the handler
+func serve(handler *Handler) error {
+	ifIndex := 0
+	if handler.ifName != "" {
+		iface, err := net.InterfaceByName(handler.ifName)
+		if err != nil {
+			return err
+		}
+		ifIndex = iface.Index
+	}
+
+	l, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", dhcpServerPort))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	conn, err := newServeConn(ifIndex, l)
+	if err != nil {
+		return err
 	}
 
 	// https://groups.google.com/forum/#!topic/coreos-user/Qbn3OdVtrZU
-	if len(datasource.ClusterName()) > 50 { // 63 - 12(mac) - 1(.)
+	if len(handler.datasource.ClusterName()) > 50 { // 63 - 12(mac) - 1(.)
 		log.WithField("where", "dhcp.StartDHCP").Warn(
 			"Warning: ClusterName is too long. It may break the behaviour of the DHCP clients")
 	}
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	ctx := handler.leadership.Context()
+	defer utils.CloseOnDone(ctx, l)()
+	err = dhcp4.Serve(conn, handler)
+	if ctx.Err() != nil {
+		return nil
+	}
 	return err
 }
 
 // Handler is passed to dhcp4 package to handle DHCP packets
 type Handler struct {
-	ifName      string
-	serverIP    net.IP
+	// leadership fences the replies, so they're sent only by the master. It's
+	// nil only in the tests.
+	leadership *datasource.Leadership
+	ifName     string
+	serverIP   net.IP
+	// booters picks the http booter of each machine among the instances
+	booters     *pxe.Booters
 	datasource  datasource.DataSource
 	dhcpOptions dhcp4.Options
 	bootMessage string
+	// proxy is true if the IPs are assigned by another DHCP server, and we
+	// just serve the PXE clients (see proxy.go)
+	proxy bool
 }
 
 // dnsAddressesForDHCP returns instances. marshalled as specified in
@@ -99,8 +146,269 @@ func (h *Handler) fillPXE() []byte {
 	return pxe.Bytes()
 }
 
-// ServeDHCP replies a dhcp request
-func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) (d dhcp4.Packet) {
+// pxeOptions returns the options which point the pxe client to our PXE boot
+// server
+func (h *Handler) pxeOptions(guidVal []byte) []dhcp4.Option {
+	guid := guidVal[1:]
+	return []dhcp4.Option{
+		{
+			Code:  dhcp4.OptionVendorClassIdentifier,
+			Value: []byte("PXEClient"),
+		},
+		{
+			Code:  97, // UUID/GUID-based Client Identifier
+			Value: guid,
+		},
+		{
+			Code:  dhcp4.OptionVendorSpecificInformation,
+			Value: h.fillPXE(),
+		},
+	}
+}
+
+// recordBootedWorkspace records the active workspace as the one which the
+// machine is booting with
+func (h *Handler) recordBootedWorkspace(machineInterface datasource.MachineInterface) {
+	hash, err := h.datasource.GetClusterVariable(datasource.ActiveWorkspaceHashKey)
+	if err == nil {
+		machineInterface.SetVariable(datasource.BootedWorkspaceHashKey, hash)
+	}
+}
+
+// isIPXEClient reports whether the request is sent by iPXE, which identifies
+// itself through the user class (option 77)
+func isIPXEClient(options dhcp4.Options) bool {
+	return string(options[dhcp4.OptionUserClass]) == "iPXE"
+}
+
+// bootloaderFor returns the bootloader for the pxe client, according to its
+// system architecture (option 93). Clients which don't send the option are
+// considered x86 BIOS.
+func bootloaderFor(options dhcp4.Options) (*pxe.Bootloader, error) {
+	arch := pxe.ArchX86BIOS
+	if val, ok := options[93]; ok {
+		var err error
+		arch, err = pxe.ParseArchitecture(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pxe.BootloaderFor(arch)
+}
+
+// subnetFor returns the subnet which the packet is originated from: the
+// subnet of the relay agent if the packet is relayed, otherwise the subnet of
+// the interface we're listening on. nil is returned for the default subnet,
+// which is configured through the lease flags and the net-conf variable.
+func (h *Handler) subnetFor(p dhcp4.Packet) (*datasource.Subnet, error) {
+	giaddr := giaddrOf(p)
+	if giaddr == nil {
+		return h.datasource.SubnetOf(h.serverIP)
+	}
+
+	subnet, err := h.datasource.SubnetOf(giaddr)
+	if err != nil {
+		return nil, err
+	}
+	if subnet == nil {
+		return nil, fmt.Errorf("no subnet is defined for relay agent %s", giaddr)
+	}
+	return subnet, nil
+}
+
+// networkConfiguration returns the network configuration of the subnet, or
+// the net-conf variable of the machine for the default subnet
+func (h *Handler) networkConfiguration(subnet *datasource.Subnet,
+	machineInterface datasource.MachineInterface) (*datasource.NetworkConfiguration, error) {
+	if subnet != nil {
+		return &subnet.NetworkConfiguration, nil
+	}
+
+	netConfStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetworkConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	netConf, err := datasource.UnmarshalNetworkConfiguration(netConfStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network-configuration=%q: %s",
+			netConfStr, err)
+	}
+	return netConf, nil
+}
+
+// networkOptions returns the options which configure the network of the
+// client
+func (h *Handler) networkOptions(p dhcp4.Packet,
+	netConf *datasource.NetworkConfiguration) (dhcp4.Options, error) {
+	instanceInfos, err := h.datasource.Instances()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instances: %s", err)
+	}
+
+	hostname := strings.Join(strings.Split(p.CHAddr().String(), ":"), "")
+	hostname += "." + h.datasource.ClusterName()
+
+	dhcpOptions := dhcp4.Options{
+		dhcp4.OptionSubnetMask:       netConf.Netmask.To4(),
+		dhcp4.OptionDomainNameServer: dnsAddressesForDHCP(&instanceInfos),
+		dhcp4.OptionHostName:         []byte(hostname),
+	}
+
+	if netConf.Router != nil {
+		dhcpOptions[dhcp4.OptionRouter] = netConf.Router.To4()
+	}
+	if len(netConf.ClasslessRouteOption) != 0 {
+		var res []byte
+		for _, part := range netConf.ClasslessRouteOption {
+			res = append(res, part.ToBytes()...)
+		}
+		dhcpOptions[dhcp4.OptionClasslessRouteFormat] = res
+	}
+	return dhcpOptions, nil
+}
+
+// customOptions returns the options of the dhcp-options variable of the
+// cluster, overridden by the options of the machine's profiles, and then by
+// the options of the machine's own variable
+func (h *Handler) customOptions(machineInterface datasource.MachineInterface) (dhcp4.Options, error) {
+	clusterVariables, err := h.datasource.ListClusterVariables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster variables: %s", err)
+	}
+	values := []string{clusterVariables[datasource.SpecialKeyDHCPOptions]}
+
+	// the profiles override the cluster, the higher priority ones last
+	profiles, err := machineInterface.Profiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profiles: %s", err)
+	}
+	for i := len(profiles) - 1; i >= 0; i-- {
+		profileVariables, err := h.datasource.ListProfileVariables(profiles[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to list variables of profile %s: %s",
+				profiles[i], err)
+		}
+		values = append(values, profileVariables[datasource.SpecialKeyDHCPOptions])
+	}
+
+	// the machine may be unknown, e.g. in case of Inform
+	machineVariables, err := machineInterface.ListVariables()
+	if err == nil {
+		values = append(values, machineVariables[datasource.SpecialKeyDHCPOptions])
+	}
+
+	customOptions := dhcp4.Options{}
+	for _, value := range values {
+		parsed, err := datasource.UnmarshalDHCPOptions(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dhcp-options=%q: %s",
+				value, err)
+		}
+		encoded, err := parsed.Encode()
+		if err != nil {
+			return nil, err
+		}
+		for code, optionValue := range encoded {
+			customOptions[dhcp4.OptionCode(code)] = optionValue
+		}
+	}
+	return customOptions, nil
+}
+
+// withCustomOptions adds the custom options of the machine to dhcpOptions,
+// replacing the built-in ones
+func (h *Handler) withCustomOptions(dhcpOptions dhcp4.Options,
+	machineInterface datasource.MachineInterface) (dhcp4.Options, error) {
+	customOptions, err := h.customOptions(machineInterface)
+	if err != nil {
+		return nil, err
+	}
+	for code, value := range customOptions {
+		dhcpOptions[code] = value
+	}
+	return dhcpOptions, nil
+}
+
+// onSubnet reports whether ip is inside the subnet. For the default subnet
+// the netmask of the network configuration is applied to our own IP.
+func (h *Handler) onSubnet(ip net.IP, subnet *datasource.Subnet,
+	netConf *datasource.NetworkConfiguration) bool {
+	if subnet != nil {
+		return subnet.Contains(ip)
+	}
+	mask := net.IPMask(netConf.Netmask.To4())
+	if mask == nil {
+		return true // nothing to compare with
+	}
+	return ip.Mask(mask).Equal(h.serverIP.Mask(mask))
+}
+
+// nak returns a DHCPNAK for the request. As specified in rfc2131, if the
+// request is not relayed, the NAK is broadcasted.
+func (h *Handler) nak(p dhcp4.Packet, reason string) dhcp4.Packet {
+	log.WithFields(log.Fields{
+		"where":   "dhcp.ServeDHCP",
+		"action":  "nak",
+		"object":  p.CHAddr().String(),
+		"subject": dhcp4.Request,
+	}).Info(reason)
+
+	// dhcp4.Serve decides to broadcast based on the flags of the request
+	p.SetBroadcast(true)
+	return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP, nil, 0,
+		[]dhcp4.Option{{Code: dhcp4.OptionMessage, Value: []byte(reason)}})
+}
+
+// withoutOptions returns options, excluding the ones with the given codes
+func withoutOptions(options []dhcp4.Option, codes ...dhcp4.OptionCode) []dhcp4.Option {
+	var ret []dhcp4.Option
+	for _, option := range options {
+		excluded := false
+		for _, code := range codes {
+			if option.Code == code {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			ret = append(ret, option)
+		}
+	}
+	return ret
+}
+
+// ServeDHCP replies a dhcp request, if the leadership is still valid after
+// the reply is prepared
+func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	if err := h.checkLeadership(); err != nil {
+		log.WithField("where", "dhcp.ServeDHCP").WithError(err).Debug(
+			"not replying, as this instance is not the master")
+		return nil
+	}
+	reply := h.serveDHCP(p, msgType, options)
+	if reply == nil {
+		return nil
+	}
+	if err := h.checkLeadership(); err != nil {
+		log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warnf(
+			"the reply to %s is dropped", p.CHAddr().String())
+		return nil
+	}
+	return reply
+}
+
+func (h *Handler) checkLeadership() error {
+	if h.leadership == nil {
+		return nil
+	}
+	return h.leadership.Valid()
+}
+
+func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) (d dhcp4.Packet) {
+	if h.proxy {
+		return h.serveProxyDHCP(p, msgType, options)
+	}
 
 	switch msgType {
 	case dhcp4.Discover, dhcp4.Request:
@@ -112,56 +420,58 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 			return nil // this message is not ours
 		}
 
+		subnet, err := h.subnetFor(p)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to find the subnet")
+			return nil
+		}
+
 		machineInterface := h.datasource.MachineInterface(p.CHAddr())
-		machine, err := machineInterface.Machine(true, nil)
+		machine, err := machineInterface.MachineInSubnet(subnet)
 		if err != nil {
 			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
 				"failed to get machine")
 			return nil
 		}
 
-		netConfStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetworkConfiguration)
+		netConf, err := h.networkConfiguration(subnet, machineInterface)
 		if err != nil {
 			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
 				"failed to get network configuration")
 			return nil
 		}
 
-		netConf, err := datasource.UnmarshalNetworkConfiguration(netConfStr)
+		dhcpOptions, err := h.networkOptions(p, netConf)
 		if err != nil {
 			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
-				"failed to unmarshal network-configuration=%q", netConfStr)
+				"failed to get dhcp options")
 			return nil
 		}
-
-		instanceInfos, err := h.datasource.Instances()
+		dhcpOptions, err = h.withCustomOptions(dhcpOptions, machineInterface)
 		if err != nil {
 			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
-				"failed to get instances")
+				"failed to get custom dhcp options")
 			return nil
 		}
 
-		hostname := strings.Join(strings.Split(p.CHAddr().String(), ":"), "")
-		hostname += "." + h.datasource.ClusterName()
-
-		dhcpOptions := dhcp4.Options{
-			dhcp4.OptionSubnetMask:       netConf.Netmask.To4(),
-			dhcp4.OptionDomainNameServer: dnsAddressesForDHCP(&instanceInfos),
-			dhcp4.OptionHostName:         []byte(hostname),
-		}
-
-		if netConf.Router != nil {
-			dhcpOptions[dhcp4.OptionRouter] = netConf.Router.To4()
-		}
-		if len(netConf.ClasslessRouteOption) != 0 {
-			var res []byte
-			for _, part := range netConf.ClasslessRouteOption {
-				res = append(res, part.ToBytes()...)
+		leaseDuration := randLeaseDuration()
+		responseMsgType := dhcp4.Offer
+		if msgType == dhcp4.Discover {
+			expiry, err := machineInterface.LeaseExpiry()
+			if err != nil {
+				log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+					"failed to get lease expiry")
+				return nil
+			}
+			if expiry < time.Now().Add(offerHoldDuration).Unix() {
+				if err := machineInterface.RenewLease(offerHoldDuration); err != nil {
+					log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+						"failed to hold the offered IP")
+					return nil
+				}
 			}
-			dhcpOptions[dhcp4.OptionClasslessRouteFormat] = res
 		}
-
-		responseMsgType := dhcp4.Offer
 		if msgType == dhcp4.Request {
 			responseMsgType = dhcp4.ACK
 
@@ -177,57 +487,196 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 				}).Debugf("bad request")
 				return nil
 			}
+			if !h.onSubnet(requestedIP, subnet, netConf) {
+				return h.nak(p, fmt.Sprintf("requestedIP(%s) is on a wrong subnet",
+					requestedIP.String()))
+			}
 			if !requestedIP.Equal(machine.IP) {
-				log.WithFields(log.Fields{
-					"where":   "dhcp.ServeDHCP",
-					"object":  p.CHAddr().String(),
-					"subject": msgType,
-				}).Debugf("requestedIP(%s) != assignedIp(%s)",
-					requestedIP.String(), machine.IP.String())
-				return nil
+				return h.nak(p, fmt.Sprintf("requestedIP(%s) != assignedIp(%s)",
+					requestedIP.String(), machine.IP.String()))
 			}
 
+			if err := machineInterface.RenewLease(leaseDuration); err != nil {
+				log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+					"failed to renew lease")
+				return nil
+			}
 			machineInterface.CheckIn()
+			_, err := machineInterface.AdvanceState(datasource.StateDiscovered, "dhcp",
+				"leased "+machine.IP.String())
+			if err != nil {
+				log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+					"failed to advance the state")
+			}
 		}
 
 		guidVal, isPxe := options[97]
+		isIPXE := isIPXEClient(options)
+		bootloaderName := ""
+		if isIPXE {
+			bootloaderName = "ipxe"
+		} else if isPxe {
+			bootloader, err := bootloaderFor(options)
+			if err != nil {
+				log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warnf(
+					"can't pxe boot %s", p.CHAddr().String())
+				isPxe = false
+			} else {
+				bootloaderName = bootloader.Name
+			}
+		}
 
 		log.WithFields(log.Fields{
 			"where":   "dhcp.ServeDHCP",
 			"action":  "debug",
 			"object":  p.CHAddr().String(),
 			"subject": msgType,
-		}).Infof("assignedIp=%s isPxe=%v", machine.IP.String(), isPxe)
+		}).Infof("assignedIp=%s isPxe=%v bootloader=%s", machine.IP.String(), isPxe, bootloaderName)
 
 		replyOptions := dhcpOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
 
-		if isPxe { // this is a pxe request
-			guid := guidVal[1:]
-			replyOptions = append(replyOptions,
-				dhcp4.Option{
-					Code:  dhcp4.OptionVendorClassIdentifier,
-					Value: []byte("PXEClient"),
-				},
-				dhcp4.Option{
-					Code:  97, // UUID/GUID-based Client Identifier
-					Value: guid,
-				},
-				dhcp4.Option{
-					Code:  dhcp4.OptionVendorSpecificInformation,
-					Value: h.fillPXE(),
-				},
-			)
-
-			hash, err := h.datasource.GetClusterVariable(datasource.ActiveWorkspaceHashKey)
-			if err == nil {
-				machineInterface.SetVariable("booted-workspace-hash", hash)
-			}
+		var scriptURL string
+		if isIPXE { // the bootloader is already loaded, point it to its script
+			scriptURL = pxe.IPXEScriptURL(h.booters.For(p.CHAddr()), p.CHAddr())
+			replyOptions = withoutOptions(replyOptions, dhcp4.OptionBootFileName)
+			replyOptions = append(replyOptions, dhcp4.Option{
+				Code:  dhcp4.OptionBootFileName,
+				Value: []byte(scriptURL),
+			})
+		} else if isPxe { // this is a pxe request
+			// the pxe options below take precedence over the custom ones
+			replyOptions = withoutOptions(replyOptions,
+				dhcp4.OptionVendorClassIdentifier, 97,
+				dhcp4.OptionVendorSpecificInformation)
+			replyOptions = append(replyOptions, h.pxeOptions(guidVal)...)
+		}
+		if isIPXE || isPxe {
+			h.recordBootedWorkspace(machineInterface)
 		}
 		packet := dhcp4.ReplyPacket(p, responseMsgType, h.serverIP, machine.IP,
-			randLeaseDuration(), replyOptions)
+			leaseDuration, replyOptions)
+		if scriptURL != "" {
+			// some iPXE builds only look at the file field
+			packet.SetFile([]byte(scriptURL))
+		}
 		return packet
 
-	case dhcp4.Release, dhcp4.Decline:
+	case dhcp4.Inform:
+		// The client has already an IP, just the configurations are replied,
+		// without yiaddr and lease time
+		if net.IP(p.CIAddr()).Equal(net.IPv4zero) {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  p.CHAddr().String(),
+				"subject": msgType,
+			}).Debugf("bad request")
+			return nil
+		}
+
+		subnet, err := h.subnetFor(p)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to find the subnet")
+			return nil
+		}
+
+		machineInterface := h.datasource.MachineInterface(p.CHAddr())
+		netConf, err := h.networkConfiguration(subnet, machineInterface)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to get network configuration")
+			return nil
+		}
+
+		dhcpOptions, err := h.networkOptions(p, netConf)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to get dhcp options")
+			return nil
+		}
+		dhcpOptions, err = h.withCustomOptions(dhcpOptions, machineInterface)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to get custom dhcp options")
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"where":   "dhcp.ServeDHCP",
+			"action":  "debug",
+			"object":  p.CHAddr().String(),
+			"subject": msgType,
+		}).Infof("ciaddr=%s", net.IP(p.CIAddr()).String())
+
+		replyOptions := dhcpOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+		return dhcp4.ReplyPacket(p, dhcp4.ACK, h.serverIP, nil, 0, replyOptions)
+
+	case dhcp4.Release:
+		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP) {
+			return nil // this message is not ours
+		}
+
+		machineInterface := h.datasource.MachineInterface(p.CHAddr())
+		if _, err := machineInterface.Machine(false, nil); err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Debug(
+				"release from an unknown machine")
+			return nil
+		}
+
+		if err := machineInterface.ReleaseLease(); err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to release lease")
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"where":   "dhcp.ServeDHCP",
+			"action":  "debug",
+			"object":  p.CHAddr().String(),
+			"subject": msgType,
+		}).Info("lease released")
+		return nil
+
+	case dhcp4.Decline:
+		// The client has found the IP in use by another host, e.g. through
+		// ARP. The IP is quarantined and a new one is assigned to the machine.
+		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP) {
+			return nil // this message is not ours
+		}
+
+		machineInterface := h.datasource.MachineInterface(p.CHAddr())
+		machine, err := machineInterface.Machine(false, nil)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Debug(
+				"decline from an unknown machine")
+			return nil
+		}
+
+		declinedIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
+		if declinedIP != nil && !declinedIP.Equal(machine.IP) {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  p.CHAddr().String(),
+				"subject": msgType,
+			}).Debugf("declinedIP(%s) != assignedIp(%s)",
+				declinedIP.String(), machine.IP.String())
+			return nil
+		}
+
+		newMachine, err := machineInterface.QuarantineIP(declineQuarantineDuration)
+		if err != nil {
+			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
+				"failed to quarantine the declined IP")
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"where":   "dhcp.ServeDHCP",
+			"action":  "debug",
+			"object":  p.CHAddr().String(),
+			"subject": msgType,
+		}).Infof("declinedIp=%s is quarantined, assignedIp=%s",
+			machine.IP.String(), newMachine.IP.String())
 		return nil
 	}
 	return nil
@@ -0,0 +1,121 @@
+package pxe
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// bootersRefreshInterval is the interval which the list of the instances
+// serving the http booter is refreshed at
+const bootersRefreshInterval = datasource.ActiveMasterUpdateTime
+
+// Booters spreads the machines across the http booters of the instances. Each
+// instance which advertises an HTTPBooterPort serves the http booter, even
+// while it's a standby, so the machines which are booting are not affected by
+// the failover of the master.
+//
+// The booter of each machine is chosen by rendezvous hashing of its MAC, so
+// the machines keep their booters when the other instances join or leave.
+// Only the instances which serve the active workspace, according to their
+// workspace sync status, are chosen; if there's none, this instance is used.
+type Booters struct {
+	datasource datasource.DataSource
+	// self is the http booter of this instance, which is used if the
+	// instances can't be listed
+	self net.TCPAddr
+
+	lock      sync.Mutex // guards the fields below
+	addrs     []net.TCPAddr
+	refreshed time.Time
+}
+
+// NewBooters returns the Booters of the instances of ds. self is the address
+// of the http booter of this instance.
+func NewBooters(ds datasource.DataSource, self net.TCPAddr) *Booters {
+	return &Booters{
+		datasource: ds,
+		self:       self,
+	}
+}
+
+// For returns the address of the http booter of the machine
+func (b *Booters) For(mac net.HardwareAddr) net.TCPAddr {
+	return pickBooter(b.list(), mac, b.self)
+}
+
+// list returns the http booters of the instances, which are refreshed every
+// bootersRefreshInterval
+func (b *Booters) list() []net.TCPAddr {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.addrs != nil && time.Since(b.refreshed) < bootersRefreshInterval {
+		return b.addrs
+	}
+
+	instances, err := b.datasource.Instances()
+	if err != nil {
+		log.WithField("where", "pxe.Booters.list").WithError(err).Warn(
+			"failed to get the instances, keeping the previous booters")
+		return b.addrs
+	}
+	statuses, err := b.datasource.WorkspaceSyncStatuses()
+	if err != nil {
+		log.WithField("where", "pxe.Booters.list").WithError(err).Warn(
+			"failed to get the workspace sync statuses, keeping the previous booters")
+		return b.addrs
+	}
+	activeHash, err := b.datasource.GetClusterVariable(datasource.ActiveWorkspaceHashKey)
+	if err != nil {
+		log.WithField("where", "pxe.Booters.list").WithError(err).Warn(
+			"failed to get the active workspace, keeping the previous booters")
+		return b.addrs
+	}
+	b.addrs = bootersOf(instances, statuses, activeHash)
+	b.refreshed = time.Now()
+	return b.addrs
+}
+
+// bootersOf returns the http booters of the instances which advertise one,
+// and have synced the active workspace. The statuses are by the web
+// addresses of the instances. Without an active workspace, i.e. before the
+// first one is activated, the workspaces are not compared.
+func bootersOf(instances []datasource.InstanceInfo,
+	statuses map[string]datasource.WorkspaceSyncStatus, activeHash string) []net.TCPAddr {
+	addrs := make([]net.TCPAddr, 0, len(instances))
+	for _, instance := range instances {
+		if instance.HTTPBooterPort == 0 || instance.IP == nil {
+			// registered by a version which doesn't serve the booter on
+			// the standby instances
+			continue
+		}
+		if activeHash != "" && statuses[instance.WebAddr()].Hash != activeHash {
+			// the workspace is missing, stale or failed to sync
+			continue
+		}
+		addrs = append(addrs, net.TCPAddr{IP: instance.IP, Port: instance.HTTPBooterPort})
+	}
+	return addrs
+}
+
+// pickBooter returns the booter with the highest weight for the mac, or
+// fallback if there's none
+func pickBooter(addrs []net.TCPAddr, mac net.HardwareAddr, fallback net.TCPAddr) net.TCPAddr {
+	picked := fallback
+	var pickedWeight uint64
+	for i, addr := range addrs {
+		h := fnv.New64a()
+		h.Write(mac)
+		h.Write([]byte(addr.String()))
+		if weight := h.Sum64(); i == 0 || weight > pickedWeight {
+			picked, pickedWeight = addr, weight
+		}
+	}
+	return picked
+}
@@ -0,0 +1,145 @@
+package pxe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Architecture is the system architecture of the client, as sent in the
+// option 93 of the DHCP requests (rfc4578)
+type Architecture uint16
+
+// The architectures which we may know how to boot
+const (
+	ArchX86BIOS  Architecture = 0
+	ArchEFIIA32  Architecture = 6
+	ArchEFIBC    Architecture = 7
+	ArchEFIX8664 Architecture = 9
+)
+
+// ParseArchitecture returns the first architecture listed in the value of
+// option 93
+func ParseArchitecture(val []byte) (Architecture, error) {
+	if len(val) < 2 || len(val)%2 != 0 {
+		return 0, errors.New("malformed client system architecture")
+	}
+	return Architecture(binary.BigEndian.Uint16(val)), nil
+}
+
+// IsEFI reports whether the client boots through UEFI
+func (a Architecture) IsEFI() bool {
+	return a == ArchEFIIA32 || a == ArchEFIBC || a == ArchEFIX8664
+}
+
+// Bootloader is the first stage which is delivered to the clients through
+// tftp. The rest of the boot (ldlinux, pxelinux config, kernel and initrd)
+// is fetched from the http booter, under the Prefix of the bootloader.
+type Bootloader struct {
+	Name string
+	// Prefix of the paths of the bootloader, both in tftp and http booter
+	Prefix string
+	// Filename is the file which is sent to the client through tftp
+	Filename string
+	// LDLinux is the syslinux core module which matches the Filename
+	LDLinux string
+}
+
+// The bootloaders which are delivered by blacksmith. The EFI ones are not
+// bundled, and should be provided by the workspace.
+var (
+	BootloaderPxelinux = &Bootloader{
+		Name:     "pxelinux",
+		Prefix:   "",
+		Filename: "lpxelinux.0",
+		LDLinux:  "ldlinux.c32",
+	}
+	BootloaderSyslinuxEFI64 = &Bootloader{
+		Name:     "syslinux-efi64",
+		Prefix:   "efi64",
+		Filename: "syslinux.efi",
+		LDLinux:  "ldlinux.e64",
+	}
+	BootloaderSyslinuxEFI32 = &Bootloader{
+		Name:     "syslinux-efi32",
+		Prefix:   "efi32",
+		Filename: "syslinux.efi",
+		LDLinux:  "ldlinux.e32",
+	}
+
+	bootloaders = []*Bootloader{
+		BootloaderPxelinux,
+		BootloaderSyslinuxEFI64,
+		BootloaderSyslinuxEFI32,
+	}
+)
+
+// BootloaderFor returns the bootloader which is able to boot clients of the
+// given architecture
+func BootloaderFor(arch Architecture) (*Bootloader, error) {
+	switch arch {
+	case ArchX86BIOS:
+		return BootloaderPxelinux, nil
+	case ArchEFIBC, ArchEFIX8664:
+		return BootloaderSyslinuxEFI64, nil
+	case ArchEFIIA32:
+		return BootloaderSyslinuxEFI32, nil
+	}
+	return nil, fmt.Errorf("unsupported client system architecture: %d", arch)
+}
+
+// Path returns the path of the named file of the bootloader, relative to the
+// root of the tftp and http booter
+func (b *Bootloader) Path(name string) string {
+	return path.Join("/", b.Prefix, name)
+}
+
+// URLPrefix returns the url which the bootloader fetches the rest of the
+// boot from, to be sent as the pxelinux path prefix (option 210)
+func (b *Bootloader) URLPrefix(httpAddr string) string {
+	if b.Prefix == "" {
+		return fmt.Sprintf("http://%s/", httpAddr)
+	}
+	return fmt.Sprintf("http://%s/%s/", httpAddr, b.Prefix)
+}
+
+// open returns the named file of the bootloader, and its size. The embedded
+// assets are looked up first, then the bootloaders folder of the workspace.
+func (b *Bootloader) open(workspacePath string, name string) (io.ReadCloser, int64, error) {
+	embedded, err := FS(false).Open(path.Join("/pxelinux", b.Prefix, name))
+	if err == nil {
+		stat, err := embedded.Stat()
+		if err != nil {
+			embedded.Close()
+			return nil, 0, err
+		}
+		return embedded, stat.Size(), nil
+	}
+
+	f, err := os.Open(filepath.Join(workspacePath, "bootloaders", b.Prefix, name))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s of %s is not found: %s", name, b.Name, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+// bootloaderByFilePath returns the bootloader which its Filename is
+// requested, nil if there is no such bootloader
+func bootloaderByFilePath(filePath string) *Bootloader {
+	filePath = path.Join("/", filePath)
+	for _, b := range bootloaders {
+		if b.Path(b.Filename) == filePath {
+			return b
+		}
+	}
+	return nil
+}
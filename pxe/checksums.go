@@ -0,0 +1,93 @@
+package pxe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// checksumCache keeps the SHA-256 of the served files, so they're hashed
+// once, unless they're modified. The concurrent requests of a file which is
+// not hashed yet wait for a single computation.
+type checksumCache struct {
+	sync.Mutex
+	checksums map[string]cachedChecksum
+	calls     map[string]*checksumCall
+}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// checksumCall is an in-flight computation of the checksum of a file
+type checksumCall struct {
+	cachedChecksum
+	wg  sync.WaitGroup
+	err error
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{
+		checksums: make(map[string]cachedChecksum),
+		calls:     make(map[string]*checksumCall),
+	}
+}
+
+// checksum returns the hex encoded SHA-256 of the file. If it's hashed by
+// this call, the file is read from the beginning, and is seeked back to the
+// beginning afterwards.
+func (c *checksumCache) checksum(f *os.File, stat os.FileInfo) (string, error) {
+	name := f.Name()
+	c.Lock()
+	cached, found := c.checksums[name]
+	if found && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		c.Unlock()
+		return cached.sum, nil
+	}
+	call, found := c.calls[name]
+	if found && call.size == stat.Size() && call.modTime.Equal(stat.ModTime()) {
+		c.Unlock()
+		call.wg.Wait()
+		return call.sum, call.err
+	}
+	call = &checksumCall{cachedChecksum: cachedChecksum{
+		size:    stat.Size(),
+		modTime: stat.ModTime(),
+	}}
+	call.wg.Add(1)
+	c.calls[name] = call
+	c.Unlock()
+
+	call.sum, call.err = hashFile(f)
+
+	c.Lock()
+	if call.err == nil {
+		c.checksums[name] = call.cachedChecksum
+	}
+	if c.calls[name] == call {
+		delete(c.calls, name)
+	}
+	c.Unlock()
+	call.wg.Done()
+	return call.sum, call.err
+}
+
+// hashFile returns the hex encoded SHA-256 of the file, from its beginning
+func hashFile(f *os.File) (string, error) {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
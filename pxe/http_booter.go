@@ -1,17 +1,22 @@
 package pxe
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
 
 	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/templating"
@@ -23,22 +28,36 @@ const (
 		Blacksmith ($VERSION) on $HOST
 		+ MAC ADDR:	$MAC
 `
+
+	// checksumSuffix is appended to the path of the image files to get
+	// their SHA-256
+	checksumSuffix = ".sha256"
+
+	// holdRetrySeconds is the interval which the machines on hold retry to
+	// get their boot config
+	holdRetrySeconds = 30
 )
 
 type nodeContext struct {
 	IP string
 }
 
+// HTTPBooter serves the boot configs and the files of the images. It runs on
+// the standby instances too, so it never creates the machines or allocates
+// IPs, which are left to the master and fenced by its leadership. The boot
+// events, and the state and boot action changes which follow them, are
+// written by every instance; they're per-machine writes to the shared
+// datastore, made with CreateInOrder or compare-and-swap.
 type HTTPBooter struct {
 	listenAddr          net.TCPAddr
-	ldlinux             []byte
 	datasource          datasource.DataSource
 	bootParamsTemplates *template.Template
 	webPort             int
 	bootMessageTemplate string
+	checksums           *checksumCache
 }
 
-func NewHTTPBooter(listenAddr net.TCPAddr, ldlinux []byte,
+func NewHTTPBooter(listenAddr net.TCPAddr,
 	ds datasource.DataSource, webPort int) (*HTTPBooter, error) {
 	bootMessageVersionedTemplate := strings.Replace(bootMessageTemplate,
 		"$VERSION", ds.SelfInfo().Version, -1)
@@ -46,175 +65,492 @@ func NewHTTPBooter(listenAddr net.TCPAddr, ldlinux []byte,
 		"$HOST", ds.SelfInfo().IP.String(), -1)
 	booter := &HTTPBooter{
 		listenAddr:          listenAddr,
-		ldlinux:             ldlinux,
 		datasource:          ds,
 		webPort:             webPort,
 		bootMessageTemplate: bootMessageVersionedTemplate,
+		checksums:           newChecksumCache(),
 	}
 	return booter, nil
 }
 
 func (b *HTTPBooter) Mux() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ldlinux.c32", b.ldlinuxHandler)
-	mux.HandleFunc("/pxelinux.cfg/", b.pxelinuxConfig)
+	// each bootloader fetches its ldlinux and config under its own prefix
+	for _, bootloader := range bootloaders {
+		mux.HandleFunc(bootloader.Path(bootloader.LDLinux), b.ldlinuxHandler(bootloader))
+		mux.HandleFunc(bootloader.Path("pxelinux.cfg")+"/", b.pxelinuxConfig)
+	}
+	mux.HandleFunc("/ipxe/", b.ipxeScript)
 	mux.HandleFunc("/f/", b.fileHandler)
 	return mux
 }
 
-func (b *HTTPBooter) ldlinuxHandler(w http.ResponseWriter, r *http.Request) {
-	utils.LogAccess(r).WithField("where", "pxe.ldlinuxHandler").Info()
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(b.ldlinux)
-}
-
-func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
+func (b *HTTPBooter) ldlinuxHandler(bootloader *Bootloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, size, err := bootloader.open(b.datasource.WorkspacePath(), bootloader.LDLinux)
+		if err != nil {
+			utils.LogAccess(r).WithError(err).WithField("where", "pxe.ldlinuxHandler").Warn(
+				"error while opening ldlinux")
+			http.Error(w, "Couldn't get ldlinux", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
 
-	macStr := filepath.Base(r.URL.Path)
-	errStr := fmt.Sprintf("%s requested a pxelinux config from URL %q, which does not include a correct MAC address", r.RemoteAddr, r.URL)
-	if !strings.HasPrefix(macStr, "01-") {
-		utils.LogAccess(r).WithField("where", "pxe.pxelinuxConfig").Debug(errStr)
-		http.Error(w, "Missing MAC address in request", http.StatusBadRequest)
-		return
-	}
-	mac, err := net.ParseMAC(macStr[3:])
-	if err != nil {
-		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Debug()
-		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
-		return
+		utils.LogAccess(r).WithField("where", "pxe.ldlinuxHandler").Info()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		io.Copy(w, f)
 	}
+}
+
+// bootSpec describes how a machine is booted, regardless of the bootloader
+type bootSpec struct {
+	// Action is one of the datasource.BootAction* values. Kernel, Initrd and
+	// Cmdline are empty for localboot and hold.
+	Action  string
+	Kernel  string
+	Initrd  []string
+	Cmdline string
+	Message string
+}
 
+// bootSpec returns the bootSpec of the machine. On failure, the error is
+// replied and nil is returned.
+func (b *HTTPBooter) bootSpec(w http.ResponseWriter, r *http.Request,
+	mac net.HardwareAddr, where string) *bootSpec {
 	machineInterface := b.datasource.MachineInterface(mac)
-	_, err = machineInterface.Machine(false, nil)
+	_, err := machineInterface.Machine(false, nil)
 	if err != nil {
-		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Debug(
+		utils.LogAccess(r).WithError(err).WithField("where", where).Debug(
 			"Machine not found")
 		http.Error(w, "Machine not found", http.StatusNotFound)
-		return
+		return nil
 	}
 
 	if _, _, err := net.SplitHostPort(r.Host); err != nil {
 		r.Host = fmt.Sprintf("%s:%d", r.Host, b.listenAddr.Port)
 	}
 
-	coreOSVersion, err := machineInterface.GetVariable(datasource.SpecialKeyCoreosVersion)
+	action, err := machineInterface.GetVariable(datasource.SpecialKeyBootAction)
 	if err != nil {
-		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Warn(
-			"error in getting coreOSVersion")
-		http.Error(w, "error in getting coreOSVersion", 500)
-		return
+		utils.LogAccess(r).WithError(err).WithField("where", where).Warn(
+			"error in getting boot action")
+		http.Error(w, "error in getting boot action", 500)
+		return nil
+	}
+	if action == "" {
+		action = datasource.BootActionInstall
+	}
+	state, err := machineInterface.State()
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", where).Warn(
+			"error in getting state")
+		http.Error(w, "error in getting state", 500)
+		return nil
+	}
+	if state == datasource.StateDecommissioned {
+		action = datasource.BootActionHold
+	}
+	if action != datasource.BootActionHold {
+		// the machines on hold fetch their config periodically, which are not
+		// boot attempts
+		action = recordBootAttempt(machineInterface, action)
 	}
 
-	KernelURL := "http://" + r.Host + "/f/" + coreOSVersion + "/kernel"
-	InitrdURL := "http://" + r.Host + "/f/" + coreOSVersion + "/initrd"
+	spec := &bootSpec{
+		Action:  action,
+		Message: strings.Replace(b.bootMessageTemplate, "$MAC", mac.String(), -1),
+	}
+	if action == datasource.BootActionLocalBoot || action == datasource.BootActionHold {
+		return spec
+	}
+
+	rescue := action == datasource.BootActionRescue
+	image, err := machineImage(machineInterface, rescue)
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", where).Warn(
+			"error in getting image")
+		http.Error(w, "error in getting image", 500)
+		return nil
+	}
+
+	manifest, err := b.imageManifest(image)
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", where).Warn(
+			"error in getting image manifest")
+		http.Error(w, "error in getting image manifest", 500)
+		return nil
+	}
+
+	if action == datasource.BootActionInstall || action == datasource.BootActionInstallOnce {
+		_, err := machineInterface.AdvanceState(datasource.StateProvisioning, "http-booter",
+			"booting "+image)
+		if err != nil {
+			utils.LogAccess(r).WithError(err).WithField("where", where).Warn(
+				"failed to advance the state")
+		}
+	}
+
+	spec.Kernel = "http://" + r.Host + "/f/" + image + "/" + manifest.Kernel
+	for _, initrd := range manifest.Initrd {
+		spec.Initrd = append(spec.Initrd, "http://"+r.Host+"/f/"+image+"/"+initrd)
+	}
 
 	host, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
-		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Debug(
+		utils.LogAccess(r).WithError(err).WithField("where", where).Debug(
 			"error in parsing host and port")
 		http.Error(w, "error in parsing host and port", 500)
-		return
+		return nil
+	}
+
+	webServer := fmt.Sprintf("%s:%d", host, b.webPort)
+	replacer := strings.NewReplacer(
+		"$CLOUD_CONFIG_URL", "http://"+webServer+"/t/cc/"+mac.String(),
+		"$IGNITION_URL", "http://"+webServer+"/t/ig/"+mac.String(),
+		"$WEB_SERVER", webServer,
+		"$MAC", mac.String(),
+	)
+
+	if rescue {
+		spec.Cmdline = manifest.cmdline(true, replacer)
+		return spec
 	}
 
 	params, err := templating.ExecuteTemplateFolder(
 		path.Join(b.datasource.WorkspacePath(), "config", "bootparams"), b.datasource, machineInterface, r.Host)
 	if err != nil {
-		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Warn(
+		utils.LogAccess(r).WithError(err).WithField("where", where).Warn(
 			"error while executing the template")
 		http.Error(w, fmt.Sprintf(`Error while executing the template: %q`, err),
 			http.StatusInternalServerError)
-		return
+		return nil
 	}
 
 	params = strings.Replace(params, "\n", " ", -1)
 
-	Cmdline := fmt.Sprintf(
-		"cloud-config-url=http://%s:%d/t/cc/%s "+
-			"coreos.config.url=http://%s:%d/t/ig/%s %s",
-		host, b.webPort, mac.String(),
-		host, b.webPort, mac.String(), params)
-	bootMessage := strings.Replace(b.bootMessageTemplate, "$MAC", macStr, -1)
-	cfg := fmt.Sprintf(`
-SAY %s
+	spec.Cmdline = manifest.cmdline(false, replacer) + " " + params
+
+	return spec
+}
+
+// recordBootAttempt records the start of a boot attempt of the machine. If
+// the machine is in a boot loop, it's switched to the boot action of its
+// boot loop policy, which is returned. Otherwise the given action is returned.
+func recordBootAttempt(machineInterface datasource.MachineInterface, action string) string {
+	logEntry := log.WithFields(log.Fields{
+		"where":  "pxe.recordBootAttempt",
+		"object": machineInterface.Mac().String(),
+	})
+
+	if err := machineInterface.RecordBootEvent(datasource.BootEventConfig); err != nil {
+		logEntry.WithError(err).Warn("failed to record the boot event")
+		return action
+	}
+
+	policy, err := datasource.BootLoopPolicyOf(machineInterface)
+	if err != nil {
+		logEntry.WithError(err).Warn("failed to get the boot loop policy")
+		return action
+	}
+	events, err := machineInterface.BootEvents()
+	if err != nil {
+		logEntry.WithError(err).Warn("failed to get the boot events")
+		return action
+	}
+	if !policy.InBootLoop(events, time.Now()) {
+		return action
+	}
+
+	_, err = machineInterface.AdvanceState(datasource.StateFailed, "http-booter", "boot loop")
+	if err != nil {
+		logEntry.WithError(err).Warn("failed to advance the state")
+	}
+
+	if policy.Action == "" || policy.Action == action {
+		logEntry.Warnf("in a boot loop, %d attempts in %s",
+			datasource.BootAttempts(events, time.Now().Add(-policy.Window)), policy.Window)
+		return action
+	}
+	err = machineInterface.SetVariable(datasource.SpecialKeyBootAction, policy.Action)
+	if err != nil {
+		logEntry.WithError(err).Warn("failed to switch the boot action")
+		return action
+	}
+	logEntry.WithFields(log.Fields{
+		"action":  "update",
+		"subject": datasource.SpecialKeyBootAction,
+	}).Warnf("in a boot loop, switched to %s", policy.Action)
+	return policy.Action
+}
+
+// machineImage returns the name of the image which the machine boots, from
+// the image variable, falling back to coreos-version. For the rescue boot
+// action, the rescue-image variable takes precedence if it's set.
+func machineImage(machineInterface datasource.MachineInterface, rescue bool) (string, error) {
+	if rescue {
+		image, err := machineInterface.GetVariable(datasource.SpecialKeyRescueImage)
+		if err != nil || image != "" {
+			return image, err
+		}
+	}
+
+	image, err := machineInterface.GetVariable(datasource.SpecialKeyImage)
+	if err != nil || image != "" {
+		return image, err
+	}
+
+	image, err = machineInterface.GetVariable(datasource.SpecialKeyCoreosVersion)
+	if err != nil {
+		return "", err
+	}
+	if image == "" {
+		return "", errors.New("no image is selected for the machine")
+	}
+	return image, nil
+}
+
+func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	macStr := filepath.Base(r.URL.Path)
+	errStr := fmt.Sprintf("%s requested a pxelinux config from URL %q, which does not include a correct MAC address", r.RemoteAddr, r.URL)
+	if !strings.HasPrefix(macStr, "01-") {
+		utils.LogAccess(r).WithField("where", "pxe.pxelinuxConfig").Debug(errStr)
+		http.Error(w, "Missing MAC address in request", http.StatusBadRequest)
+		return
+	}
+	mac, err := net.ParseMAC(macStr[3:])
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Debug()
+		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
+		return
+	}
+
+	spec := b.bootSpec(w, r, mac, "pxe.pxelinuxConfig")
+	if spec == nil {
+		return
+	}
+
+	w.Write([]byte(pxelinuxConfigFor(spec, "http://"+r.Host+r.URL.Path)))
+
+	utils.LogAccess(r).WithField("where", "pxe.pxelinuxConfig").Infof(
+		"action=%s", spec.Action)
+}
+
+// pxelinuxConfigFor renders the pxelinux config of the spec. selfURL is the
+// url of the config, which is reloaded by the machines on hold.
+func pxelinuxConfigFor(spec *bootSpec, selfURL string) string {
+	say := "SAY " + strings.Replace(spec.Message, "\n", "\nSAY ", -1)
+	switch spec.Action {
+	case datasource.BootActionLocalBoot:
+		return fmt.Sprintf(`
+%s
+DEFAULT local
+LABEL local
+LOCALBOOT 0
+`, say)
+	case datasource.BootActionHold:
+		return fmt.Sprintf(`
+%s
+SAY On hold, retrying in %d seconds
+PROMPT 1
+TIMEOUT %d
+DEFAULT hold
+LABEL hold
+CONFIG %s
+`, say, holdRetrySeconds, holdRetrySeconds*10, selfURL)
+	}
+	return fmt.Sprintf(`
+%s
 DEFAULT linux
 LABEL linux
 LINUX %s
 APPEND initrd=%s %s
-`, strings.Replace(bootMessage, "\n", "\nSAY ", -1), KernelURL, InitrdURL, Cmdline)
-	w.Write([]byte(cfg))
+`, say, spec.Kernel, strings.Join(spec.Initrd, ","), spec.Cmdline)
+}
 
-	utils.LogAccess(r).WithField("where", "pxe.pxelinuxConfig").Info()
+// ipxeScript renders the boot script of the machine for iPXE clients, which
+// are pointed to /ipxe/<mac> by our DHCP server
+func (b *HTTPBooter) ipxeScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	mac, err := net.ParseMAC(filepath.Base(r.URL.Path))
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.ipxeScript").Debug()
+		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
+		return
+	}
+
+	spec := b.bootSpec(w, r, mac, "pxe.ipxeScript")
+	if spec == nil {
+		return
+	}
+
+	w.Write([]byte(ipxeScriptFor(spec, "http://"+r.Host+r.URL.Path)))
+
+	utils.LogAccess(r).WithField("where", "pxe.ipxeScript").Infof(
+		"action=%s", spec.Action)
 }
 
-// Get the contents of a blob mentioned in a previously issued
-// BootSpec. Additionally returns a pretty name for the blob for
-// logging purposes.
-func (b *HTTPBooter) coreOS(version string, id string) (io.ReadCloser, error) {
-	imagePath := filepath.Join(b.datasource.WorkspacePath(), "images")
-	switch id {
-	case "kernel":
-		path := filepath.Join(imagePath, version, "coreos_production_pxe.vmlinuz")
-		return os.Open(path)
-	case "initrd":
-		return os.Open(filepath.Join(imagePath, version, "coreos_production_pxe_image.cpio.gz"))
+// ipxeScriptFor renders the iPXE script of the spec. selfURL is the url of
+// the script, which is chained by the machines on hold.
+func ipxeScriptFor(spec *bootSpec, selfURL string) string {
+	echo := "echo " + strings.Replace(spec.Message, "\n", "\necho ", -1)
+	switch spec.Action {
+	case datasource.BootActionLocalBoot:
+		// returning to the firmware makes it try the next boot device
+		return fmt.Sprintf(`#!ipxe
+%s
+exit
+`, echo)
+	case datasource.BootActionHold:
+		return fmt.Sprintf(`#!ipxe
+%s
+echo On hold, retrying in %d seconds
+sleep %d
+chain %s
+`, echo, holdRetrySeconds, holdRetrySeconds, selfURL)
+	}
+	// the initrds are named, so EFI kernels can find them through the cmdline
+	var initrdArgs, initrdLines string
+	for i, initrd := range spec.Initrd {
+		initrdArgs += fmt.Sprintf("initrd=initrd%d ", i)
+		initrdLines += fmt.Sprintf("initrd --name initrd%d %s\n", i, initrd)
 	}
-	return nil, fmt.Errorf("id=<%q> wasn't expected", id)
+	return fmt.Sprintf(`#!ipxe
+%s
+kernel %s %s%s
+%sboot
+`, echo, spec.Kernel, initrdArgs, spec.Cmdline, initrdLines)
+}
+
+// IPXEScriptURL returns the url of the iPXE script of the machine, served by
+// the http booter on httpAddr
+func IPXEScriptURL(httpAddr net.TCPAddr, mac net.HardwareAddr) string {
+	return fmt.Sprintf("http://%s/ipxe/%s", httpAddr.String(), mac.String())
 }
 
+// fileHandler serves the files of the images, with the range and
+// conditional request semantics of http.ServeContent. The SHA-256 of each file
+// is sent as its ETag and Digest, and is also served at <file>.sha256.
 func (b *HTTPBooter) fileHandler(w http.ResponseWriter, r *http.Request) {
 	splitPath := strings.SplitN(r.URL.Path, "/", 4)
-	version := splitPath[2]
+	if len(splitPath) != 4 {
+		http.Error(w, "Malformed file path", http.StatusBadRequest)
+		return
+	}
+	image := splitPath[2]
 	id := splitPath[3]
+	sumRequested := strings.HasSuffix(id, checksumSuffix)
+	id = strings.TrimSuffix(id, checksumSuffix)
 
-	var (
-		f   io.ReadCloser
-		err error
-	)
-
-	f, err = b.coreOS(version, id)
-
+	f, err := b.imageFile(image, id)
 	if err != nil {
 		utils.LogAccess(r).WithError(err).WithField("where", "pxe.fileHandler").Warn(
-			"error while getting CoreOS reader")
+			"error while getting image reader")
 		http.Error(w, "Couldn't get byte stream", http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	written, err := io.Copy(w, f)
+	stat, err := f.Stat()
 	if err != nil {
-		utils.LogAccess(r).WithError(err).WithField("where", "pxe.fileHandler").Debug(
-			"error while copying from CoreOS reader")
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.fileHandler").Warn(
+			"error while getting image file info")
+		http.Error(w, "Couldn't get file info", http.StatusInternalServerError)
 		return
 	}
 
-	utils.LogAccess(r).WithField("where", "pxe.fileHandler").Infof("written=%d", written)
+	if !sumRequested && fromStart(r) {
+		// the resumed downloads are not new boots
+		b.recordKernelServed(r, image, id)
+	}
+
+	sum, err := b.checksums.checksum(f, stat)
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.fileHandler").Warn(
+			"error while computing the checksum")
+		http.Error(w, "Couldn't compute checksum", http.StatusInternalServerError)
+		return
+	}
+
+	if sumRequested {
+		// the format of sha256sum
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s  %s\n", sum, filepath.Base(f.Name()))
+		utils.LogAccess(r).WithField("where", "pxe.fileHandler").Info()
+		return
+	}
+
+	rawSum, _ := hex.DecodeString(sum)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(rawSum))
+	// the files may change with the workspace, caches should revalidate them
+	w.Header().Set("Cache-Control", "public, no-cache")
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+
+	utils.LogAccess(r).WithField("where", "pxe.fileHandler").Infof(
+		"size=%d range=%q", stat.Size(), r.Header.Get("Range"))
 }
 
-func HTTPBooterMux(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) (*http.ServeMux, error) {
-	ldlinux, err := FSByte(false, "/pxelinux/ldlinux.c32")
+// fromStart reports whether the request downloads the whole file, i.e. it has
+// no range, or the open-ended range from the beginning. The resumed downloads,
+// the probes like bytes=0-0 and the multi-range requests are not new boots.
+func fromStart(r *http.Request) bool {
+	if r.Method == "HEAD" {
+		return false
+	}
+	rangeHeader := strings.TrimSpace(r.Header.Get("Range"))
+	return rangeHeader == "" || rangeHeader == "bytes=0-"
+}
+
+// recordKernelServed records a BootEventKernel for the machine which has
+// requested the kernel of the image, if it's known by its IP
+func (b *HTTPBooter) recordKernelServed(r *http.Request, image string, id string) {
+	manifest, err := b.imageManifest(image)
+	if err != nil || (id != "kernel" && id != manifest.Kernel) {
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return nil, err
+		return
 	}
-	booter, err := NewHTTPBooter(listenAddr, ldlinux, ds, webPort)
+	machineInterface, err := b.datasource.MachineInterfaceByIP(net.ParseIP(host))
+	if err != nil {
+		return
+	}
+	if err := machineInterface.RecordBootEvent(datasource.BootEventKernel); err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.recordKernelServed").Warn(
+			"failed to record the boot event")
+	}
+}
+
+func HTTPBooterMux(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) (*http.ServeMux, error) {
+	booter, err := NewHTTPBooter(listenAddr, ds, webPort)
 	if err != nil {
 		return nil, err
 	}
 	return booter.Mux(), nil
 }
 
-func ServeHTTPBooter(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) error {
+// ServeHTTPBooter serves the http booter on listenAddr until ctx is done
+func ServeHTTPBooter(ctx context.Context, listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) error {
 	mux, err := HTTPBooterMux(listenAddr, ds, webPort)
 	if err != nil {
 		return err
 	}
 
+	l, err := net.Listen("tcp", listenAddr.String())
+	if err != nil {
+		return err
+	}
+
 	log.WithFields(log.Fields{
 		"where":  "pxe.ServeHTTPBooter",
 		"action": "announce",
 	}).Infof("Listening on %s", listenAddr.String())
 
-	return http.ListenAndServe(listenAddr.String(), mux)
+	return utils.ServeHTTP(ctx, l, mux)
 }
@@ -0,0 +1,179 @@
+package pxe
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// imageManifestName is the name of the manifest file inside each image
+// directory, i.e. images/{image}/manifest.yaml
+const imageManifestName = "manifest.yaml"
+
+// ImageManifest describes how an image is network booted. The file names are
+// relative to the image directory. These placeholders are replaced in the
+// cmdlines:
+//
+//	$CLOUD_CONFIG_URL: url of the rendered cloudconfig of the machine
+//	$IGNITION_URL:     url of the rendered ignition of the machine
+//	$WEB_SERVER:       host:port of the web server
+//	$MAC:              mac address of the machine
+type ImageManifest struct {
+	Kernel  string   `yaml:"kernel"`
+	Initrd  []string `yaml:"initrd"`
+	Cmdline string   `yaml:"cmdline"`
+	// RescueCmdline is used instead of Cmdline for the rescue boot action.
+	// If it's empty, Cmdline is used.
+	RescueCmdline string `yaml:"rescueCmdline"`
+}
+
+// legacyCoreOSManifest is used for the image directories without manifest,
+// which are named after the CoreOS version they contain
+var legacyCoreOSManifest = ImageManifest{
+	Kernel:        "coreos_production_pxe.vmlinuz",
+	Initrd:        []string{"coreos_production_pxe_image.cpio.gz"},
+	Cmdline:       "cloud-config-url=$CLOUD_CONFIG_URL coreos.config.url=$IGNITION_URL",
+	RescueCmdline: "coreos.autologin",
+}
+
+// validate checks the manifest to refer only to the files inside the image
+// directory
+func (m *ImageManifest) validate() error {
+	if m.Kernel == "" {
+		return errors.New("kernel is not specified")
+	}
+	for _, name := range append([]string{m.Kernel}, m.Initrd...) {
+		if !isImageFileName(name) {
+			return fmt.Errorf("invalid file name: %q", name)
+		}
+	}
+	return nil
+}
+
+// hasFile reports whether the named file is a part of the image
+func (m *ImageManifest) hasFile(name string) bool {
+	if name == m.Kernel {
+		return true
+	}
+	for _, initrd := range m.Initrd {
+		if name == initrd {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdline returns the cmdline of the image for the boot action, with the
+// placeholders replaced
+func (m *ImageManifest) cmdline(rescue bool, replacer *strings.Replacer) string {
+	cmdline := m.Cmdline
+	if rescue && m.RescueCmdline != "" {
+		cmdline = m.RescueCmdline
+	}
+	return replacer.Replace(cmdline)
+}
+
+// isImageFileName reports whether name is a plain file name, which can't
+// escape its directory
+func isImageFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+// imagePath returns the directory of the image inside the workspace
+func imagePath(workspacePath, image string) (string, error) {
+	if !isImageFileName(image) {
+		return "", fmt.Errorf("invalid image name: %q", image)
+	}
+	return filepath.Join(workspacePath, "images", image), nil
+}
+
+// imagePath returns the directory of the image inside the workspace of b
+func (b *HTTPBooter) imagePath(image string) (string, error) {
+	return imagePath(b.datasource.WorkspacePath(), image)
+}
+
+// imageManifest reads the manifest of the image. The legacy CoreOS manifest
+// is returned for the images without manifest.
+func (b *HTTPBooter) imageManifest(image string) (*ImageManifest, error) {
+	return readImageManifest(b.datasource.WorkspacePath(), image)
+}
+
+// readImageManifest reads the manifest of the image of the workspace
+func readImageManifest(workspacePath, image string) (*ImageManifest, error) {
+	dir, err := imagePath(workspacePath, image)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, imageManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			manifest := legacyCoreOSManifest
+			return &manifest, nil
+		}
+		return nil, err
+	}
+
+	var manifest ImageManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error while parsing the manifest of %q: %s", image, err)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %q: %s", image, err)
+	}
+	return &manifest, nil
+}
+
+// ValidateImage checks the image of the workspace to have a valid manifest,
+// and all the files which the manifest declares
+func ValidateImage(workspacePath, image string) error {
+	manifest, err := readImageManifest(workspacePath, image)
+	if err != nil {
+		return err
+	}
+	dir, err := imagePath(workspacePath, image)
+	if err != nil {
+		return err
+	}
+	for _, name := range append([]string{manifest.Kernel}, manifest.Initrd...) {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("image %q: %s", image, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("image %q: %s is not a regular file", image, name)
+		}
+	}
+	return nil
+}
+
+// imageFile opens a file of the image. Beside the file names of the
+// manifest, "kernel" and "initrd" (the first initrd) are accepted.
+func (b *HTTPBooter) imageFile(image string, id string) (*os.File, error) {
+	manifest, err := b.imageManifest(image)
+	if err != nil {
+		return nil, err
+	}
+
+	name := id
+	switch {
+	case id == "kernel":
+		name = manifest.Kernel
+	case id == "initrd" && len(manifest.Initrd) > 0:
+		name = manifest.Initrd[0]
+	case !manifest.hasFile(id):
+		return nil, fmt.Errorf("id=<%q> wasn't expected", id)
+	}
+
+	imagePath, err := b.imagePath(image)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(imagePath, name))
+}
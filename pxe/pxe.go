@@ -7,7 +7,10 @@ import (
 	"net"
 
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
 	"golang.org/x/net/ipv4"
+
+	"github.com/cafebazaar/blacksmith/utils"
 )
 
 var dhcpMagic = []byte{99, 130, 83, 99}
@@ -26,7 +29,12 @@ type PXEPacket struct {
 	// The boot type requested by the client. We need to mirror this
 	// in the PXE reply.
 	BootType []byte
+	// The system architecture of the client, from option 93
+	Arch Architecture
 
+	// The bootloader which is delivered to the client, and the http
+	// path prefix which the bootloader fetches the rest of boot from
+	Bootloader *Bootloader
 	HTTPServer string
 }
 
@@ -41,12 +49,15 @@ func dhcpOption(b []byte) (typ byte, val []byte, next []byte) {
 	return typ, b[2 : 2+l], b[2+l:]
 }
 
-func ServePXE(listenAddr net.UDPAddr, serverIP net.IP, httpAddr net.TCPAddr) error {
+// ServePXE answers the PXE boot server requests on listenAddr until ctx is
+// done. Each machine is pointed to its http booter among booters.
+func ServePXE(ctx context.Context, listenAddr net.UDPAddr, serverIP net.IP, booters *Booters) error {
 	conn, err := net.ListenPacket("udp4", listenAddr.String())
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	defer utils.CloseOnDone(ctx, conn)()
 	l := ipv4.NewPacketConn(conn)
 	if err = l.SetControlMessage(ipv4.FlagInterface, true); err != nil {
 		return err
@@ -60,6 +71,9 @@ func ServePXE(listenAddr net.UDPAddr, serverIP net.IP, httpAddr net.TCPAddr) err
 	buf := make([]byte, 1024)
 	for {
 		n, msg, addr, err := l.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
 			log.WithField("where", "pxe.ServePXE").WithError(err).Debug(
 				"error reading from socket")
@@ -73,14 +87,23 @@ func ServePXE(listenAddr net.UDPAddr, serverIP net.IP, httpAddr net.TCPAddr) err
 			continue
 		}
 
+		req.Bootloader, err = BootloaderFor(req.Arch)
+		if err != nil {
+			log.WithField("where", "pxe.ServePXE").WithError(err).Warnf(
+				"can't boot %s", req.MAC)
+			continue
+		}
+
 		req.ServerIP = serverIP
-		req.HTTPServer = fmt.Sprintf("http://%s/", httpAddr.String())
+		httpAddr := booters.For(req.MAC)
+		req.HTTPServer = req.Bootloader.URLPrefix(httpAddr.String())
 
 		log.WithFields(log.Fields{
 			"where":  "pxe.ServePXE",
 			"action": "debug",
 			"object": req.MAC,
-		}).Info()
+		}).Infof("arch=%d bootloader=%s booter=%s", req.Arch, req.Bootloader.Name,
+			httpAddr.String())
 
 		if _, err := l.WriteTo(ReplyPXE(req), &ipv4.ControlMessage{
 			IfIndex: msg.IfIndex,
@@ -105,10 +128,12 @@ func ReplyPXE(p *PXEPacket) []byte {
 	copy(bootp[16:], p.ClientIP)
 	copy(bootp[20:], p.ServerIP)
 	copy(bootp[28:], p.MAC)
-	// Boot file name. Our TFTP server unconditionally serves up
-	// pxelinux no matter the name, so we just put something that
-	// looks nice in packet dumps.
-	copy(bootp[108:], "boot")
+	// Boot file name, which is served by our TFTP server
+	bootloader := p.Bootloader
+	if bootloader == nil {
+		bootloader = BootloaderPxelinux
+	}
+	copy(bootp[108:], bootloader.Path(bootloader.Filename)[1:])
 	b.Write(bootp[:])
 
 	// DHCP magic
@@ -179,6 +204,11 @@ func ParsePXE(b []byte) (req *PXEPacket, err error) {
 				return nil, fmt.Errorf("packet from %s (%s) has malformed option 97", ret.MAC, ret.ClientIP)
 			}
 			ret.GUID = val[1:]
+		case 93:
+			ret.Arch, err = ParseArchitecture(val)
+			if err != nil {
+				return nil, fmt.Errorf("packet from %s (%s) has malformed option 93", ret.MAC, ret.ClientIP)
+			}
 		}
 		typ, val, opts = dhcpOption(opts)
 	}
@@ -1,8 +1,15 @@
 package pxe
 
 import (
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
 )
 
 func TestReplyPXE(t *testing.T) {
@@ -20,3 +27,294 @@ func TestReplyPXE(t *testing.T) {
 		t.Errorf("PXE packets end with 255, this one ends with %d", response[n-1])
 	}
 }
+
+func TestParsePXEArchitecture(t *testing.T) {
+	packet := make([]byte, 240)
+	copy(packet[28:], []byte{1, 2, 3, 4, 5, 6})
+	copy(packet[236:], dhcpMagic)
+	packet = append(packet, 97, 17, 0)
+	packet = append(packet, make([]byte, 16)...)
+	packet = append(packet, 43, 6, 71, 4, 0x80, 0, 0, 0)
+	packet = append(packet, 93, 2, 0, 7, 255)
+
+	req, err := ParsePXE(packet)
+	if err != nil {
+		t.Error("unexpected error:", err)
+		return
+	}
+	if req.Arch != ArchEFIBC {
+		t.Errorf("expected arch %d, got %d", ArchEFIBC, req.Arch)
+	}
+}
+
+func TestBootloaderFor(t *testing.T) {
+	tests := []struct {
+		arch     Architecture
+		expected *Bootloader
+	}{
+		{ArchX86BIOS, BootloaderPxelinux},
+		{ArchEFIIA32, BootloaderSyslinuxEFI32},
+		{ArchEFIBC, BootloaderSyslinuxEFI64},
+		{ArchEFIX8664, BootloaderSyslinuxEFI64},
+		{11, nil}, // ARM64 EFI
+	}
+
+	for i, tt := range tests {
+		got, err := BootloaderFor(tt.arch)
+		if tt.expected == nil && err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		} else if tt.expected != got {
+			t.Errorf("#%d: expected %v, got %v", i, tt.expected, got)
+		}
+	}
+
+	if got := bootloaderByFilePath("efi64/syslinux.efi"); got != BootloaderSyslinuxEFI64 {
+		t.Error("expected syslinux-efi64 for efi64/syslinux.efi, got:", got)
+	}
+	if got := bootloaderByFilePath("boot"); got != nil {
+		t.Error("expected nil for an unknown path, got:", got)
+	}
+	if got := BootloaderSyslinuxEFI64.URLPrefix("10.0.0.1:70"); got != "http://10.0.0.1:70/efi64/" {
+		t.Error("unexpected url prefix:", got)
+	}
+}
+
+func TestBootActionConfigs(t *testing.T) {
+	tests := []struct {
+		spec     bootSpec
+		pxelinux string
+		ipxe     string
+	}{
+		{
+			bootSpec{Action: datasource.BootActionInstall, Kernel: "k", Initrd: []string{"i"}, Cmdline: "c"},
+			"LINUX k\nAPPEND initrd=i c\n",
+			"kernel k initrd=initrd0 c\ninitrd --name initrd0 i\nboot\n",
+		},
+		{
+			bootSpec{Action: datasource.BootActionRescue, Kernel: "k", Initrd: []string{"i", "j"}, Cmdline: "c"},
+			"LINUX k\nAPPEND initrd=i,j c\n",
+			"kernel k initrd=initrd0 initrd=initrd1 c\ninitrd --name initrd0 i\ninitrd --name initrd1 j\nboot\n",
+		},
+		{
+			bootSpec{Action: datasource.BootActionLocalBoot},
+			"LOCALBOOT 0\n",
+			"exit\n",
+		},
+		{
+			bootSpec{Action: datasource.BootActionHold},
+			"CONFIG http://self\n",
+			"chain http://self\n",
+		},
+	}
+
+	for i, tt := range tests {
+		if got := pxelinuxConfigFor(&tt.spec, "http://self"); !strings.HasSuffix(got, tt.pxelinux) {
+			t.Errorf("#%d: expected pxelinux config to end with %q, got %q", i, tt.pxelinux, got)
+		}
+		if got := ipxeScriptFor(&tt.spec, "http://self"); !strings.HasSuffix(got, tt.ipxe) {
+			t.Errorf("#%d: expected ipxe script to end with %q, got %q", i, tt.ipxe, got)
+		}
+	}
+}
+
+func TestImageManifest(t *testing.T) {
+	tests := []struct {
+		manifest ImageManifest
+		valid    bool
+	}{
+		{legacyCoreOSManifest, true},
+		{ImageManifest{Kernel: "vmlinuz", Initrd: []string{"initrd.img"}}, true},
+		{ImageManifest{Initrd: []string{"initrd.img"}}, false},
+		{ImageManifest{Kernel: "../vmlinuz"}, false},
+		{ImageManifest{Kernel: "vmlinuz", Initrd: []string{".."}}, false},
+	}
+
+	for i, tt := range tests {
+		err := tt.manifest.validate()
+		if tt.valid && err != nil {
+			t.Errorf("#%d: expected no error, got %q", i, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+	}
+
+	replacer := strings.NewReplacer("$MAC", "m", "$IGNITION_URL", "u")
+	manifest := ImageManifest{Kernel: "k", Cmdline: "a=$MAC b=$IGNITION_URL", RescueCmdline: "rescue"}
+	if got := manifest.cmdline(false, replacer); got != "a=m b=u" {
+		t.Error("unexpected cmdline:", got)
+	}
+	if got := manifest.cmdline(true, replacer); got != "rescue" {
+		t.Error("unexpected rescue cmdline:", got)
+	}
+}
+
+func TestChecksumCache(t *testing.T) {
+	f, err := ioutil.TempFile("", "blacksmith-checksum")
+	if err != nil {
+		t.Error("error while creating temp file:", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("abc")
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Error("error while getting file info:", err)
+		return
+	}
+
+	c := newChecksumCache()
+	for i := 0; i < 2; i++ { // the second one is cached
+		sum, err := c.checksum(f, stat)
+		if err != nil {
+			t.Error("unexpected error:", err)
+			return
+		}
+		if sum != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+			t.Error("unexpected sha256 of abc:", sum)
+		}
+	}
+
+	// the concurrent requests of a modified file share the computation
+	f.Seek(0, os.SEEK_END)
+	f.WriteString("d")
+	if stat, err = f.Stat(); err != nil {
+		t.Error("error while getting file info:", err)
+		return
+	}
+	sums := make(chan string, 4)
+	for i := 0; i < cap(sums); i++ {
+		go func() {
+			sum, err := c.checksum(f, stat)
+			if err != nil {
+				t.Error("unexpected error:", err)
+			}
+			sums <- sum
+		}()
+	}
+	for i := 0; i < cap(sums); i++ {
+		if sum := <-sums; sum != "88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589" {
+			t.Error("unexpected sha256 of abcd:", sum)
+		}
+	}
+	if len(c.calls) != 0 {
+		t.Error("expecting the finished computations to be removed")
+	}
+}
+
+func TestFromStart(t *testing.T) {
+	tests := []struct {
+		method string
+		rng    string
+		want   bool
+	}{
+		{"GET", "", true},
+		{"GET", "bytes=0-", true},
+		{"GET", "bytes=0-0", false},
+		{"GET", "bytes=0-1023", false},
+		{"GET", "bytes=0-,500-", false},
+		{"GET", "bytes=1024-", false},
+		{"GET", "bytes=-500", false},
+		{"HEAD", "", false},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(tt.method, "http://booter/f/image/kernel", nil)
+		if tt.rng != "" {
+			r.Header.Set("Range", tt.rng)
+		}
+		if got := fromStart(r); got != tt.want {
+			t.Errorf("fromStart(%s %q) = %v, expecting %v", tt.method, tt.rng, got, tt.want)
+		}
+	}
+}
+
+func TestResolveTFTPPath(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "blacksmith-tftp")
+	if err != nil {
+		t.Error("error while creating temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(workspace)
+
+	root := filepath.Join(workspace, "tftp")
+	os.MkdirAll(filepath.Join(root, "pxelinux.cfg"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "pxelinux.cfg", "default"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(workspace, "initial.yaml"), []byte("x"), 0644)
+	os.Symlink(filepath.Join(workspace, "initial.yaml"), filepath.Join(root, "escape"))
+
+	if _, err := resolveTFTPPath(root, "pxelinux.cfg/default"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if _, err := resolveTFTPPath(root, "/pxelinux.cfg/../pxelinux.cfg/default"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if _, err := resolveTFTPPath(root, "../initial.yaml"); !os.IsNotExist(err) {
+		t.Error("expecting ../ not to escape the root, got:", err)
+	}
+	if _, err := resolveTFTPPath(root, "escape"); err != errOutsideTFTPRoot {
+		t.Error("expecting the symlink not to escape the root, got:", err)
+	}
+	if _, err := resolveTFTPPath(root, "missing"); !os.IsNotExist(err) {
+		t.Error("expecting a not exist error, got:", err)
+	}
+}
+
+func TestPickBooter(t *testing.T) {
+	fallback := net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 70}
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	if got := pickBooter(nil, mac, fallback); got.String() != fallback.String() {
+		t.Errorf("expecting the fallback without any booters, got %s", got.String())
+	}
+
+	instances := []datasource.InstanceInfo{
+		{IP: net.IPv4(10, 0, 0, 1), HTTPBooterPort: 70, WebPort: 8000},
+		{IP: net.IPv4(10, 0, 0, 2), HTTPBooterPort: 70, WebPort: 8000},
+		{IP: net.IPv4(10, 0, 0, 3), WebPort: 8000}, // doesn't serve the booter
+		{IP: net.IPv4(10, 0, 0, 4), HTTPBooterPort: 70, WebPort: 8000},
+		{IP: net.IPv4(10, 0, 0, 5), HTTPBooterPort: 70, WebPort: 8000},
+	}
+	statuses := map[string]datasource.WorkspaceSyncStatus{
+		"10.0.0.1:8000": {Hash: "h2", Target: "h2"},
+		"10.0.0.2:8000": {Hash: "h2", Target: "h2"},
+		"10.0.0.3:8000": {Hash: "h2", Target: "h2"},
+		"10.0.0.4:8000": {Hash: "h2", Target: "h2"},
+		"10.0.0.5:8000": {Hash: "h1", Target: "h2", State: datasource.WorkspaceSyncFailed},
+	}
+	if addrs := bootersOf(instances, statuses, ""); len(addrs) != 4 {
+		t.Errorf("expecting 4 booters without an active workspace, got %v", addrs)
+	}
+	if addrs := bootersOf(instances, statuses, "h3"); len(addrs) != 0 {
+		t.Errorf("expecting no booters before the workspace is synced, got %v", addrs)
+	}
+	addrs := bootersOf(instances, statuses, "h2")
+	if len(addrs) != 3 {
+		t.Fatalf("expecting 3 booters, got %v", addrs)
+	}
+
+	picked := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, byte(i >> 8), byte(i)}
+		addr := pickBooter(addrs, mac, fallback)
+		picked[addr.String()]++
+
+		// the machines of the other booters keep their booters when one
+		// leaves
+		for j := range addrs {
+			if addrs[j].String() == addr.String() {
+				continue
+			}
+			rest := append(append([]net.TCPAddr{}, addrs[:j]...), addrs[j+1:]...)
+			if got := pickBooter(rest, mac, fallback); got.String() != addr.String() {
+				t.Errorf("expecting %s to keep %s when %s leaves, got %s",
+					mac, addr.String(), addrs[j].String(), got.String())
+			}
+		}
+	}
+	for _, addr := range addrs {
+		if picked[addr.String()] < 50 {
+			t.Errorf("expecting the machines to be spread, got %v", picked)
+			break
+		}
+	}
+}
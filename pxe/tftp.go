@@ -1,27 +1,43 @@
 package pxe
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"go.universe.tf/netboot/tftp"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/templating"
+	"github.com/cafebazaar/blacksmith/utils"
+)
+
+const (
+	// tftpDirName is the folder of the workspace which its files are served
+	// through tftp
+	tftpDirName = "tftp"
+	// tftpTemplateSuffix marks the files of the tftp folder which are
+	// rendered per machine, i.e. tftp/{name}.tmpl is served as {name}
+	tftpTemplateSuffix = ".tmpl"
 )
 
-// ServeTFTP delivers lpxelinux.0 to machines through the old tftp protocol
-func ServeTFTP(listenAddr net.UDPAddr) error {
-	pxelinuxDir := FS(false)
+var errOutsideTFTPRoot = errors.New("the requested path is outside the tftp folder")
 
-	handler := func(string, net.Addr) (io.ReadCloser, int64, error) {
-		pxelinux, err := pxelinuxDir.Open("/pxelinux/lpxelinux.0")
-		if err != nil {
-			return nil, 0, err
-		}
-		stat, err := pxelinux.Stat()
-		if err != nil {
-			return nil, 0, err
-		}
-		return pxelinux, stat.Size(), nil
+// ServeTFTP delivers the files to machines through the old tftp protocol.
+// The requested paths are looked up in the tftp folder of the workspace,
+// then in the bootloaders and the embedded pxelinux assets. It stops when ctx
+// is done.
+func ServeTFTP(ctx context.Context, listenAddr net.UDPAddr, ds datasource.DataSource) error {
+	handler := func(filePath string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+		return tftpFile(ds, filePath, clientAddr)
 	}
 
 	tftpServer := &tftp.Server{
@@ -49,5 +65,116 @@ func ServeTFTP(listenAddr net.UDPAddr) error {
 		},
 	}
 
-	return tftpServer.ListenAndServe(listenAddr.String())
+	conn, err := net.ListenPacket("udp", listenAddr.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer utils.CloseOnDone(ctx, conn)()
+
+	err = tftpServer.Serve(conn)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// tftpFile returns the requested file, and its size
+func tftpFile(ds datasource.DataSource, filePath string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+	cleanPath := path.Clean("/" + filePath)
+	if strings.HasSuffix(cleanPath, tftpTemplateSuffix) {
+		return nil, 0, fmt.Errorf("%s is not found", cleanPath)
+	}
+	root := filepath.Join(ds.WorkspacePath(), tftpDirName)
+
+	fullPath, err := resolveTFTPPath(root, cleanPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if err == nil {
+		return openTFTPFile(fullPath)
+	}
+
+	tmplPath, err := resolveTFTPPath(root, cleanPath+tftpTemplateSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if err == nil {
+		return renderTFTPTemplate(ds, tmplPath, clientAddr)
+	}
+
+	if bootloader := bootloaderByFilePath(cleanPath); bootloader != nil {
+		return bootloader.open(ds.WorkspacePath(), bootloader.Filename)
+	}
+
+	embedded, err := FS(false).Open(path.Join("/pxelinux", cleanPath))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s is not found", cleanPath)
+	}
+	stat, err := embedded.Stat()
+	if err != nil || stat.IsDir() {
+		embedded.Close()
+		return nil, 0, fmt.Errorf("%s is not found", cleanPath)
+	}
+	return embedded, stat.Size(), nil
+}
+
+// resolveTFTPPath returns the path of the requested file inside root, after
+// following the symlinks. errOutsideTFTPRoot is returned if the file is not
+// inside root, and an error satisfying os.IsNotExist if it doesn't exist.
+func resolveTFTPPath(root string, filePath string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	fullPath := filepath.Join(realRoot, filepath.FromSlash(path.Clean("/"+filePath)))
+	realPath, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(realPath, realRoot+string(filepath.Separator)) {
+		return "", errOutsideTFTPRoot
+	}
+	return realPath, nil
+}
+
+func openTFTPFile(fullPath string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s is a directory", fullPath)
+	}
+	return f, stat.Size(), nil
+}
+
+// renderTFTPTemplate renders the template for the machine which the IP of
+// the client is assigned to
+func renderTFTPTemplate(ds datasource.DataSource, tmplPath string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+	udpAddr, ok := clientAddr.(*net.UDPAddr)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected client address: %s", clientAddr.String())
+	}
+
+	machineInterface, err := ds.MachineInterfaceByIP(udpAddr.IP)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	selfInfo := ds.SelfInfo()
+	webServerAddr := fmt.Sprintf("%s:%d", selfInfo.IP.String(), selfInfo.WebPort)
+	text, err := templating.ExecuteTemplateFile(tmplPath, ds, machineInterface, webServerAddr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while executing the template: %s", err)
+	}
+	return ioutil.NopCloser(strings.NewReader(text)), int64(len(text)), nil
 }
@@ -0,0 +1,154 @@
+package templating
+
+import (
+	"fmt"
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// Preview is a template folder which is rendered for a machine, with what
+// it's rendered from
+type Preview struct {
+	Output string `json:"output"`
+	// Parts are the variables which each part (template) of the folder
+	// refers to, by the name of the part
+	Parts map[string][]string `json:"parts"`
+	// Variables are the values of the variables which are used while
+	// rendering
+	Variables map[string]string `json:"variables"`
+	// Warnings are the problems which don't stop the rendering, like the
+	// variables which can't be read, or the parts which fail in b64template
+	Warnings []string `json:"warnings"`
+}
+
+// PreviewTemplateFolder renders the template folder for the machine, like
+// ExecuteTemplateFolder, and records what it's rendered from. In the strict
+// mode, the rendering fails like ExecuteTemplateFolder.
+func PreviewTemplateFolder(tmplFolder string,
+	ds datasource.DataSource, machineInterface datasource.MachineInterface,
+	webServerAddr string) (*Preview, error) {
+
+	template, err := templateFromPath(tmplFolder)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the template with path=%s: %s",
+			tmplFolder, err)
+	}
+	machine, err := newTemplateMachine(machineInterface)
+	if err != nil {
+		return nil, err
+	}
+	if err := machine.setStrict(tmplFolder); err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{
+		Variables: make(map[string]string),
+		Warnings:  []string{},
+	}
+	lookupVariable := machine.lookupVariable
+	machine.lookupVariable = func(key string) (string, string, error) {
+		value, source, err := lookupVariable(key)
+		if err == nil {
+			preview.Variables[key] = value
+		}
+		return value, source, err
+	}
+	machine.warn = func(message string) {
+		preview.Warnings = append(preview.Warnings, message)
+	}
+
+	preview.Parts = templateVariables(template, machine.warn)
+	preview.Output, err = renderTemplate(template, "main", ds, machine, webServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// templateVariables returns the variables which each template of the root
+// refers to through V. The calls of V with non-constant keys are reported
+// to warn.
+func templateVariables(root *template.Template, warn func(message string)) map[string][]string {
+	templates := make(map[string]*template.Template)
+	var names []string
+	for _, t := range root.Templates() {
+		if t.Tree != nil && t.Name() != "" {
+			templates[t.Name()] = t
+			names = append(names, t.Name())
+		}
+	}
+	sort.Strings(names)
+
+	parts := make(map[string][]string)
+	for _, name := range names {
+		t := templates[name]
+		keys := make(map[string]bool)
+		walkTemplate(t.Tree.Root, func(cmd *parse.CommandNode) {
+			identifier, ok := cmd.Args[0].(*parse.IdentifierNode)
+			if !ok || identifier.Ident != "V" {
+				return
+			}
+			if len(cmd.Args) == 2 {
+				if key, ok := cmd.Args[1].(*parse.StringNode); ok {
+					keys[key.Text] = true
+					return
+				}
+			}
+			warn(fmt.Sprintf("%s: V is called with a non-constant key: %s", t.Name(), cmd))
+		})
+
+		variables := make([]string, 0, len(keys))
+		for key := range keys {
+			variables = append(variables, key)
+		}
+		sort.Strings(variables)
+		parts[t.Name()] = variables
+	}
+	return parts
+}
+
+// walkTemplate calls f for the commands of the node, and of its children
+func walkTemplate(node parse.Node, f func(cmd *parse.CommandNode)) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			walkTemplate(child, f)
+		}
+	case *parse.ActionNode:
+		walkTemplate(node.Pipe, f)
+	case *parse.IfNode:
+		walkBranch(&node.BranchNode, f)
+	case *parse.RangeNode:
+		walkBranch(&node.BranchNode, f)
+	case *parse.WithNode:
+		walkBranch(&node.BranchNode, f)
+	case *parse.TemplateNode:
+		walkTemplate(node.Pipe, f)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for _, cmd := range node.Cmds {
+			walkTemplate(cmd, f)
+		}
+	case *parse.CommandNode:
+		if len(node.Args) > 0 {
+			f(node)
+		}
+		for _, arg := range node.Args {
+			walkTemplate(arg, f)
+		}
+	}
+}
+
+func walkBranch(node *parse.BranchNode, f func(cmd *parse.CommandNode)) {
+	walkTemplate(node.Pipe, f)
+	walkTemplate(node.List, f)
+	walkTemplate(node.ElseList, f)
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -29,26 +31,33 @@ func findFiles(path string) ([]string, error) {
 	return files, nil
 }
 
-//FromPath creates templates from the files located in the specifed path
-func templateFromPath(tmplPath string) (*template.Template, error) {
-	files, err := findFiles(tmplPath)
-	if err != nil {
-		return nil, fmt.Errorf("error while trying to list files in%s: %s", tmplPath, err)
-	}
-
+// newTemplate creates an empty root template, with the delimiters and the
+// placeholders of the functions which are defined per machine
+func newTemplate() *template.Template {
 	t := template.New("")
 	t.Delims("<<", ">>")
 	t.Funcs(map[string]interface{}{
-		"V": func(key string) string {
-			return ""
+		"V": func(key string) (string, error) {
+			return "", nil
 		},
 		"b64": func(text string) string {
 			return ""
 		},
-		"b64template": func(templateName string) string {
-			return ""
+		"b64template": func(templateName string) (string, error) {
+			return "", nil
 		},
 	})
+	return t
+}
+
+//FromPath creates templates from the files located in the specifed path
+func templateFromPath(tmplPath string) (*template.Template, error) {
+	files, err := findFiles(tmplPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to list files in%s: %s", tmplPath, err)
+	}
+
+	t := newTemplate()
 
 	for i := range files {
 		files[i] = path.Join(tmplPath, files[i])
@@ -65,6 +74,59 @@ func templateFromPath(tmplPath string) (*template.Template, error) {
 func executeTemplate(rootTemplte *template.Template, templateName string,
 	ds datasource.DataSource, machineInterface datasource.MachineInterface,
 	webServerAddr string) (string, error) {
+	machine, err := newTemplateMachine(machineInterface)
+	if err != nil {
+		return "", err
+	}
+	return renderTemplate(rootTemplte, templateName, ds, machine, webServerAddr)
+}
+
+// templateMachine is the machine which the templates are rendered for
+type templateMachine struct {
+	mac      string
+	ip       string
+	hostname string
+	state    string
+	// lookupVariable returns the value of the variable, and the source which
+	// it's resolved from, empty if it's not set
+	lookupVariable func(key string) (value string, source string, err error)
+	// warn is called with the problems which don't stop the rendering, if
+	// it's set
+	warn func(message string)
+	// strict makes the unset variables, and the failing b64templates, fail
+	// the rendering. The variables which are set to the empty string are
+	// not unset.
+	strict bool
+}
+
+func newTemplateMachine(machineInterface datasource.MachineInterface) (*templateMachine, error) {
+	machine, err := machineInterface.Machine(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	state, _ := machineInterface.State()
+
+	return &templateMachine{
+		mac:            machineInterface.Mac().String(),
+		ip:             machine.IP.String(),
+		hostname:       machineInterface.Hostname(),
+		state:          string(state),
+		lookupVariable: machineInterface.LookupVariable,
+	}, nil
+}
+
+// warnf logs the problem, and reports it to warn
+func (m *templateMachine) warnf(err error, format string, args ...interface{}) {
+	log.WithField("where", "templating.executeTemplate").WithError(err).Warnf(format, args...)
+	if m.warn != nil {
+		m.warn(fmt.Sprintf(format, args...) + ": " + err.Error())
+	}
+}
+
+func renderTemplate(rootTemplte *template.Template, templateName string,
+	ds datasource.DataSource, machine *templateMachine,
+	webServerAddr string) (string, error) {
 	template := rootTemplte.Lookup(templateName)
 
 	if template == nil {
@@ -72,40 +134,41 @@ func executeTemplate(rootTemplte *template.Template, templateName string,
 			templateName, rootTemplte)
 	}
 
-	mac := machineInterface.Mac().String()
-
 	buf := new(bytes.Buffer)
 	template.Funcs(map[string]interface{}{
-		"V": func(key string) string {
-			value, err := machineInterface.GetVariable(key)
-			if err != nil {
-				log.WithField("where", "templating.executeTemplate").WithError(err).Warn(
-					"error while GetVariable")
+		"V": func(key string) (string, error) {
+			value, source, err := machine.lookupVariable(key)
+			if machine.strict {
+				if err != nil {
+					return "", fmt.Errorf("error while getting variable %q: %s", key, err)
+				}
+				if source == "" {
+					return "", fmt.Errorf("variable %q is not set for machine %s", key, machine.mac)
+				}
+			} else if err != nil {
+				machine.warnf(err, "error while GetVariable(key=%s)", key)
 			}
-			return value
+			return value, nil
 		},
 		"b64": func(text string) string {
 			return base64.StdEncoding.EncodeToString([]byte(text))
 		},
-		"b64template": func(templateName string) string {
-			text, err := executeTemplate(rootTemplte, templateName, ds, machineInterface, webServerAddr)
+		"b64template": func(templateName string) (string, error) {
+			text, err := renderTemplate(rootTemplte, templateName, ds, machine, webServerAddr)
 			if err != nil {
-				log.WithField("where", "templating.executeTemplate").WithError(err).Warnf(
-					"error while executeTemplate(templateName=%s machine=%s)",
-					templateName, mac)
-				return ""
+				if machine.strict {
+					return "", err
+				}
+				machine.warnf(err, "error while executeTemplate(templateName=%s machine=%s)",
+					templateName, machine.mac)
+				return "", nil
 			}
-			return base64.StdEncoding.EncodeToString([]byte(text))
+			return base64.StdEncoding.EncodeToString([]byte(text)), nil
 		},
 	})
 
 	etcdMembers, _ := ds.EtcdMembers()
 
-	machine, err := machineInterface.Machine(false, nil)
-	if err != nil {
-		return "", err
-	}
-
 	data := struct {
 		Mac           string
 		IP            string
@@ -113,15 +176,17 @@ func executeTemplate(rootTemplte *template.Template, templateName string,
 		Domain        string
 		WebServerAddr string
 		EtcdEndpoints string
+		State         string
 	}{
-		mac,
-		machine.IP.String(),
-		machineInterface.Hostname(),
+		machine.mac,
+		machine.ip,
+		machine.hostname,
 		ds.ClusterName(),
 		webServerAddr,
 		etcdMembers,
+		machine.state,
 	}
-	err = template.ExecuteTemplate(buf, templateName, &data)
+	err := template.ExecuteTemplate(buf, templateName, &data)
 	if err != nil {
 		return "", err
 	}
@@ -130,8 +195,29 @@ func executeTemplate(rootTemplte *template.Template, templateName string,
 	return str, nil
 }
 
+// strictMarkerName is the name of the file which makes the templates of its
+// folder render in the strict mode
+const strictMarkerName = ".strict"
+
+// setStrict enables the strict mode for the machine, if the folder of the
+// templates has the strict marker, or the strict-templates variable is set
+func (m *templateMachine) setStrict(tmplFolder string) error {
+	if _, err := os.Stat(path.Join(tmplFolder, strictMarkerName)); err == nil {
+		m.strict = true
+		return nil
+	}
+	value, _, err := m.lookupVariable(datasource.SpecialKeyStrictTemplates)
+	if err != nil {
+		return fmt.Errorf("error while getting %s: %s", datasource.SpecialKeyStrictTemplates, err)
+	}
+	m.strict, _ = strconv.ParseBool(value)
+	return nil
+}
+
 // ExecuteTemplateFolder returns a string compiled from using the files in the
-// specified directory, starting from `main` file inside the directory.
+// specified directory, starting from `main` file inside the directory. The
+// templates are rendered in the strict mode if the directory has a `.strict`
+// file, or the strict-templates variable of the machine is true.
 func ExecuteTemplateFolder(tmplFolder string,
 	ds datasource.DataSource, machineInterface datasource.MachineInterface,
 	webServerAddr string) (string, error) {
@@ -142,5 +228,35 @@ func ExecuteTemplateFolder(tmplFolder string,
 			tmplFolder, err)
 	}
 
-	return executeTemplate(template, "main", ds, machineInterface, webServerAddr)
+	machine, err := newTemplateMachine(machineInterface)
+	if err != nil {
+		return "", err
+	}
+	if err := machine.setStrict(tmplFolder); err != nil {
+		return "", err
+	}
+	return renderTemplate(template, "main", ds, machine, webServerAddr)
+}
+
+// ExecuteTemplateFile returns a string compiled from the single specified
+// template file. The strict mode is like ExecuteTemplateFolder, for the
+// directory of the file.
+func ExecuteTemplateFile(tmplFile string,
+	ds datasource.DataSource, machineInterface datasource.MachineInterface,
+	webServerAddr string) (string, error) {
+
+	template, err := newTemplate().ParseFiles(tmplFile)
+	if err != nil {
+		return "", fmt.Errorf("error while reading the template with path=%s: %s",
+			tmplFile, err)
+	}
+
+	machine, err := newTemplateMachine(machineInterface)
+	if err != nil {
+		return "", err
+	}
+	if err := machine.setStrict(path.Dir(tmplFile)); err != nil {
+		return "", err
+	}
+	return renderTemplate(template, path.Base(tmplFile), ds, machine, webServerAddr)
 }
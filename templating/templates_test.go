@@ -1,7 +1,11 @@
 package templating
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"text/template"
 
@@ -21,11 +25,12 @@ func TestExecuteTemplate(t *testing.T) {
 
 	mac1, _ := net.ParseMAC("FF:FF:FF:FF:00:0F")
 
-	ds, err := datasource.ForTest(nil)
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
 	if err != nil {
 		t.Error("error in getting a DataSource instance for our test:", err)
 		return
 	}
+	defer cleanup()
 
 	for i, tt := range tests {
 		got, err := executeTemplate(
@@ -46,3 +51,140 @@ func TestExecuteTemplate(t *testing.T) {
 		}
 	}
 }
+
+func TestPreviewTemplateFolder(t *testing.T) {
+	mac1, _ := net.ParseMAC("FF:FF:FF:FF:00:1F")
+
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
+	if err != nil {
+		t.Fatal("error in getting a DataSource instance for our test:", err)
+	}
+	defer cleanup()
+	if err := ds.WhileMaster(); err != nil {
+		t.Fatal("failed to register as the master instance:", err)
+	}
+	defer ds.Shutdown()
+
+	machineInterface := ds.MachineInterface(mac1)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Fatal("error while creating machine:", err)
+	}
+	if err := machineInterface.SetVariable("role", "worker"); err != nil {
+		t.Fatal("error while setting the variable:", err)
+	}
+
+	dir, err := ioutil.TempDir("", "blacksmith-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main": `role=<< V "role" >><< template "part" . >><< b64template "missing" >>`,
+		"part": `<< define "part" >><< if V "debug" >>debug<< end >><< V .Hostname >><< end >>`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	preview, err := PreviewTemplateFolder(dir, ds, machineInterface, "127.0.0.1:8000")
+	if err != nil {
+		t.Fatal("failed to preview:", err)
+	}
+	if preview.Output != "role=worker" {
+		t.Errorf("unexpected output: %q", preview.Output)
+	}
+	if got := preview.Parts["main"]; len(got) != 1 || got[0] != "role" {
+		t.Errorf("unexpected variables of main: %v", got)
+	}
+	if got := preview.Parts["part"]; len(got) != 1 || got[0] != "debug" {
+		t.Errorf("unexpected variables of part: %v", got)
+	}
+	if preview.Variables["role"] != "worker" {
+		t.Errorf("expecting the used variables to be recorded, got %v", preview.Variables)
+	}
+	// V .Hostname, and b64template "missing"
+	if len(preview.Warnings) != 2 {
+		t.Errorf("expecting 2 warnings, got %v", preview.Warnings)
+	}
+}
+
+func TestStrictTemplates(t *testing.T) {
+	mac1, _ := net.ParseMAC("FF:FF:FF:FF:00:2F")
+
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
+	if err != nil {
+		t.Fatal("error in getting a DataSource instance for our test:", err)
+	}
+	defer cleanup()
+	if err := ds.WhileMaster(); err != nil {
+		t.Fatal("failed to register as the master instance:", err)
+	}
+	defer ds.Shutdown()
+
+	machineInterface := ds.MachineInterface(mac1)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Fatal("error while creating machine:", err)
+	}
+	if err := machineInterface.SetVariable("role", "worker"); err != nil {
+		t.Fatal("error while setting the variable:", err)
+	}
+	if err := machineInterface.SetVariable("extra-args", ""); err != nil {
+		t.Fatal("error while setting the variable:", err)
+	}
+
+	tests := []struct {
+		main   string
+		strict bool
+		err    bool
+	}{
+		{`<< V "role" >>`, false, false},
+		{`<< V "role" >>`, true, false},
+		{`<< V "etcd-discovery" >>`, false, false},
+		{`<< V "etcd-discovery" >>`, true, true},
+		{`<< V "extra-args" >>`, true, false},
+		{`<< b64template "missing" >>`, false, false},
+		{`<< b64template "missing" >>`, true, true},
+	}
+
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "blacksmith-templates")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "main"), []byte(tt.main), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.strict {
+			if err := ioutil.WriteFile(filepath.Join(dir, strictMarkerName), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = ExecuteTemplateFolder(dir, ds, machineInterface, "127.0.0.1:8000")
+		if tt.err && err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		} else if !tt.err && err != nil {
+			t.Errorf("#%d: expected no error, err=%q", i, err)
+		}
+	}
+
+	// the strict mode through the variable of the machine
+	dir, err := ioutil.TempDir("", "blacksmith-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "main"), []byte(`<< V "etcd-discovery" >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyStrictTemplates, "true"); err != nil {
+		t.Fatal("error while setting the variable:", err)
+	}
+	_, err = ExecuteTemplateFolder(dir, ds, machineInterface, "127.0.0.1:8000")
+	if err == nil || !strings.Contains(err.Error(), `"etcd-discovery"`) {
+		t.Errorf("expected an error naming the variable, got %v", err)
+	}
+}
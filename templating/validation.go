@@ -2,8 +2,12 @@ package templating
 
 import (
 	"bytes"
+	"fmt"
+	"path"
 
 	"github.com/coreos/coreos-cloudinit/config/validate"
+
+	"github.com/cafebazaar/blacksmith/datasource"
 )
 
 func ValidateCloudConfig(config string) string {
@@ -17,3 +21,45 @@ func ValidateCloudConfig(config string) string {
 	}
 	return errors.String()
 }
+
+// syntheticMachine returns the machine which the templates are validated
+// against, with the given variables
+func syntheticMachine(variables map[string]string) *templateMachine {
+	return &templateMachine{
+		mac:      "02:00:00:00:00:01",
+		ip:       "10.0.0.1",
+		hostname: "020000000001",
+		state:    string(datasource.StateProvisioning),
+		lookupVariable: func(key string) (string, string, error) {
+			value, found := variables[key]
+			if !found {
+				return "", "", nil
+			}
+			return value, datasource.VariableSourceMachine, nil
+		},
+	}
+}
+
+// ValidateTemplateFolder parses the files of the template folder, and renders
+// its `main` template for a synthetic machine, which has the given variables
+func ValidateTemplateFolder(tmplFolder string, ds datasource.DataSource,
+	variables map[string]string) error {
+	template, err := templateFromPath(tmplFolder)
+	if err != nil {
+		return fmt.Errorf("error while parsing the templates: %s", err)
+	}
+	_, err = renderTemplate(template, "main", ds, syntheticMachine(variables), "127.0.0.1:8000")
+	return err
+}
+
+// ValidateTemplateFile is like ValidateTemplateFolder, for a single template
+// file
+func ValidateTemplateFile(tmplFile string, ds datasource.DataSource,
+	variables map[string]string) error {
+	template, err := newTemplate().ParseFiles(tmplFile)
+	if err != nil {
+		return fmt.Errorf("error while parsing the template: %s", err)
+	}
+	_, err = renderTemplate(template, path.Base(tmplFile), ds, syntheticMachine(variables), "127.0.0.1:8000")
+	return err
+}
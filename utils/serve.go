@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// CloseOnDone closes c when ctx is done, to stop the services which are
+// blocked on reading from it. The returned function stops waiting for ctx.
+func CloseOnDone(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// ServeHTTP serves the handler on l until ctx is done. Then l and all the
+// open connections are closed, so the in-flight requests are stopped too.
+// It returns nil if it's stopped by ctx.
+func ServeHTTP(ctx context.Context, l net.Listener, handler http.Handler) error {
+	var lock sync.Mutex // guards conns and closed
+	conns := make(map[net.Conn]struct{})
+	closed := false
+
+	server := &http.Server{
+		Handler: handler,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch state {
+			case http.StateNew:
+				if closed {
+					conn.Close()
+					return
+				}
+				conns[conn] = struct{}{}
+			case http.StateHijacked, http.StateClosed:
+				delete(conns, conn)
+			}
+		},
+	}
+
+	stop := CloseOnDone(ctx, closerFunc(func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		closed = true
+		for conn := range conns {
+			conn.Close()
+		}
+		return l.Close()
+	}))
+	defer stop()
+
+	err := server.Serve(l)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
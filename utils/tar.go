@@ -2,52 +2,253 @@ package utils
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// UntarLimits bounds what an archive can extract, to stop the archives which
+// are crafted to fill the disk
+type UntarLimits struct {
+	// MaxBytes is the total size of the extracted files
+	MaxBytes int64
+	// MaxEntries is the number of the entries of the archive
+	MaxEntries int
+}
+
+// DefaultUntarLimits are the limits of Untar. MaxBytes is also the limit of
+// the uploaded workspaces, and is set by the -workspace-max-size flag.
+var DefaultUntarLimits = UntarLimits{
+	MaxBytes:   2 << 30,
+	MaxEntries: 100000,
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
-// https://gist.github.com/svett/dc27b7fb04c2549e3ada#file-untarball-go
+// Untar extracts the tarball into target, which is created if needed. See
+// UntarReader.
 func Untar(tarball, target string) error {
 	reader, err := os.Open(tarball)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	tarReader := tar.NewReader(reader)
+	return UntarReader(reader, target, DefaultUntarLimits)
+}
 
+// UntarReader extracts the tar archive of r into target. Gzip and zstd
+// compressed archives are detected by their magic numbers. The archive is
+// rejected if it exceeds the limits, or has any entries with absolute names
+// or names which escape target through .., entries which are extracted
+// through a symlink, symlinks which are absolute or have .. in their targets,
+// hard links to the files outside target, or devices and fifos.
+// The permissions of the files are kept, without the setuid, setgid and
+// sticky bits. The files which are extracted before an error are not removed.
+func UntarReader(r io.Reader, target string, limits UntarLimits) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	var archive io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("error while reading the gzip stream: %s", err)
+		}
+		defer gz.Close()
+		archive = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("error while reading the zstd stream: %s", err)
+		}
+		defer zr.Close()
+		archive = zr
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	u := &untarer{
+		target: target,
+		limits: limits,
+	}
+	tarReader := tar.NewReader(archive)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
-			break
+			return nil
 		} else if err != nil {
 			return err
 		}
+		if err := u.extract(header, tarReader); err != nil {
+			return fmt.Errorf("%q: %s", header.Name, err)
+		}
+	}
+}
+
+type untarer struct {
+	target  string
+	limits  UntarLimits
+	bytes   int64
+	entries int
+}
+
+// extract extracts an entry of the archive
+func (u *untarer) extract(header *tar.Header, r io.Reader) error {
+	u.entries++
+	if u.entries > u.limits.MaxEntries {
+		return fmt.Errorf("the archive has more than %d entries", u.limits.MaxEntries)
+	}
+
+	name, err := u.clean(header.Name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	path := filepath.Join(u.target, name)
+	if err := u.checkParents(name); err != nil {
+		return err
+	}
+	mode := header.FileInfo().Mode().Perm()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+			return fmt.Errorf("%s is already extracted as a file", name)
+		}
+		return os.MkdirAll(path, mode|0700)
+
+	case tar.TypeReg, tar.TypeRegA:
+		if header.Size < 0 || header.Size > u.limits.MaxBytes-u.bytes {
+			return fmt.Errorf("the extracted files exceed %d bytes", u.limits.MaxBytes)
+		}
+		u.bytes += header.Size
+		if err := u.replaceable(path); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(file, r, header.Size)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
 
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
+	case tar.TypeSymlink:
+		linkname := filepath.FromSlash(header.Linkname)
+		if filepath.IsAbs(linkname) {
+			return fmt.Errorf("absolute symlink to %q", header.Linkname)
+		}
+		for _, part := range strings.Split(linkname, string(filepath.Separator)) {
+			if part == ".." {
+				return fmt.Errorf("symlink to %q, which has ..", header.Linkname)
 			}
-			continue
 		}
+		if err := u.replaceable(path); err != nil {
+			return err
+		}
+		return os.Symlink(linkname, path)
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	case tar.TypeLink:
+		linkname, err := u.clean(header.Linkname)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		_, err = io.Copy(file, tarReader)
+		if err := u.checkParents(linkname); err != nil {
+			return err
+		}
+		info, err := os.Lstat(filepath.Join(u.target, linkname))
 		if err != nil {
 			return err
 		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("hard link to %q, which is not a regular file", header.Linkname)
+		}
+		if err := u.replaceable(path); err != nil {
+			return err
+		}
+		return os.Link(filepath.Join(u.target, linkname), path)
+
+	case tar.TypeXHeader, tar.TypeXGlobalHeader:
+		return nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return fmt.Errorf("device files and fifos are not allowed")
+	}
+	return fmt.Errorf("unsupported entry type %q", header.Typeflag)
+}
+
+// clean returns the name of the entry relative to the target, if it's inside
+// the target
+func (u *untarer) clean(name string) (string, error) {
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("absolute path")
+	}
+	name = filepath.Clean(filepath.FromSlash(name))
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes the target")
+	}
+	return name, nil
+}
+
+// checkParents checks that none of the parents of the name is a symlink, so
+// the entry is extracted where its name says
+func (u *untarer) checkParents(name string) error {
+	dir := u.target
+	parts := strings.Split(filepath.Dir(name), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// created by MkdirAll
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("extracting through the symlink %s", dir)
+		}
 	}
 	return nil
 }
 
+// replaceable removes the file which is previously extracted at path, if
+// any, since the later entries of an archive override the former ones. The
+// directories are not replaced.
+func (u *untarer) replaceable(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is already extracted as a directory", path)
+	}
+	return os.Remove(path)
+}
+
 // http://www.mrwaggel.be/post/generate-md5-hash-of-a-file/
 func HashFileMD5(filePath string) (string, error) {
 	// Initialize variable returnMD5String now in case an error has to be returned
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntryForTest struct {
+	header  tar.Header
+	content string
+}
+
+func tarForTest(t *testing.T, entries ...tarEntryForTest) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func file(name, content string) tarEntryForTest {
+	return tarEntryForTest{tar.Header{Name: name, Typeflag: tar.TypeReg}, content}
+}
+
+func symlink(name, linkname string) tarEntryForTest {
+	return tarEntryForTest{tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: linkname}, ""}
+}
+
+func TestUntarReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := tarForTest(t,
+		tarEntryForTest{tar.Header{Name: "workspace/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		file("workspace/a/b.txt", "b"),
+		symlink("workspace/latest", "a/b.txt"),
+		tarEntryForTest{tar.Header{Name: "workspace/c.txt", Typeflag: tar.TypeLink, Linkname: "workspace/a/b.txt"}, ""},
+	)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(archive)
+	gw.Close()
+
+	for name, r := range map[string][]byte{"plain": archive, "gzip": gzipped.Bytes()} {
+		target := filepath.Join(dir, name)
+		if err := UntarReader(bytes.NewReader(r), target, DefaultUntarLimits); err != nil {
+			t.Errorf("%s: failed to untar: %s", name, err)
+			continue
+		}
+		for _, path := range []string{"a/b.txt", "latest", "c.txt"} {
+			got, err := ioutil.ReadFile(filepath.Join(target, "workspace", path))
+			if err != nil || string(got) != "b" {
+				t.Errorf("%s: expecting %s to be extracted, got %q, %v", name, path, got, err)
+			}
+		}
+	}
+}
+
+func TestUntarReaderRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		entries []tarEntryForTest
+		limits  UntarLimits
+	}{
+		{"traversal", []tarEntryForTest{file("../escaped", "x")}, DefaultUntarLimits},
+		{"nested traversal", []tarEntryForTest{file("a/../../escaped", "x")}, DefaultUntarLimits},
+		{"absolute", []tarEntryForTest{file("/tmp/escaped", "x")}, DefaultUntarLimits},
+		{"absolute symlink", []tarEntryForTest{symlink("link", "/etc")}, DefaultUntarLimits},
+		{"escaping symlink", []tarEntryForTest{symlink("link", "../..")}, DefaultUntarLimits},
+		{"through symlink", []tarEntryForTest{
+			symlink("link", "."),
+			file("link/escaped", "x"),
+		}, DefaultUntarLimits},
+		{"escaping hard link", []tarEntryForTest{
+			{tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../escaped"}, ""},
+		}, DefaultUntarLimits},
+		{"device", []tarEntryForTest{
+			{tar.Header{Name: "dev", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}, ""},
+		}, DefaultUntarLimits},
+		{"fifo", []tarEntryForTest{
+			{tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}, ""},
+		}, DefaultUntarLimits},
+		{"too large", []tarEntryForTest{
+			file("a", strings.Repeat("x", 600)),
+			file("b", strings.Repeat("x", 600)),
+		}, UntarLimits{MaxBytes: 1000, MaxEntries: 10}},
+		{"too many entries", []tarEntryForTest{
+			file("a", ""), file("b", ""), file("c", ""),
+		}, UntarLimits{MaxBytes: 1000, MaxEntries: 2}},
+	}
+
+	for _, tt := range tests {
+		target := filepath.Join(dir, "target", strings.Replace(tt.name, " ", "-", -1))
+		err := UntarReader(bytes.NewReader(tarForTest(t, tt.entries...)), target, tt.limits)
+		if err == nil {
+			t.Errorf("%s: expecting the archive to be rejected", tt.name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "escaped")); err == nil {
+		t.Error("expecting no file to escape the target")
+	}
+}
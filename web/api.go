@@ -8,12 +8,15 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"path"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/utils"
+	"github.com/cafebazaar/blacksmith/workspace"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -29,12 +32,17 @@ func (ws *webServer) Version(w http.ResponseWriter, r *http.Request) {
 }
 
 type machineDetails struct {
-	Name          string                 `json:"name"`
-	Nic           string                 `json:"nic"`
-	IP            net.IP                 `json:"ip"`
-	Type          datasource.MachineType `json:"type"`
-	FirstAssigned int64                  `json:"firstAssigned"`
-	LastAssigned  int64                  `json:"lastAssigned"`
+	Name          string                  `json:"name"`
+	Nic           string                  `json:"nic"`
+	IP            net.IP                  `json:"ip"`
+	Type          datasource.MachineType  `json:"type"`
+	FirstAssigned int64                   `json:"firstAssigned"`
+	LastAssigned  int64                   `json:"lastAssigned"`
+	LeaseExpiry   int64                   `json:"leaseExpiry"`
+	Subnet        string                  `json:"subnet"`
+	BootAttempts  int                     `json:"bootAttempts"`
+	BootLoop      bool                    `json:"bootLoop"`
+	State         datasource.MachineState `json:"state"`
 }
 
 func machineToDetails(machineInterface datasource.MachineInterface) (*machineDetails, error) {
@@ -47,11 +55,31 @@ func machineToDetails(machineInterface datasource.MachineInterface) (*machineDet
 		return nil, errors.New("error in retrieving machine details")
 	}
 	last, _ := machineInterface.LastSeen()
+	leaseExpiry, _ := machineInterface.LeaseExpiry()
+
+	state, err := machineInterface.State()
+	if err != nil {
+		return nil, errors.New("error in retrieving machine state")
+	}
+
+	// the boot fields are left zero if they can't be read, and the policy is
+	// only read for the machines with pending boot attempts
+	var bootAttempts int
+	var bootLoop bool
+	events, _ := machineInterface.BootEvents()
+	if datasource.BootAttempts(events, time.Time{}) > 0 {
+		if policy, err := datasource.BootLoopPolicyOf(machineInterface); err == nil {
+			now := time.Now()
+			bootAttempts = datasource.BootAttempts(events, now.Add(-policy.Window))
+			bootLoop = policy.InBootLoop(events, now)
+		}
+	}
 
 	return &machineDetails{
 		name, mac.String(),
 		machine.IP, machine.Type,
-		machine.FirstSeen, last}, nil
+		machine.FirstSeen, last, leaseExpiry, machine.Subnet,
+		bootAttempts, bootLoop, state}, nil
 }
 
 // MachinesList creates a list of the currently known machines based on the etcd
@@ -107,7 +135,70 @@ func (ws *webServer) MachineDelete(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, `"OK"`)
 }
 
-// MachineVariable returns all the flags set for the machine
+// MachineState returns the lifecycle state of the machine, with its audit
+// trail
+func (ws *webServer) MachineState(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, `{"error": "Machine not found"}`, http.StatusNotFound)
+		return
+	}
+	state, err := machineInterface.State()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	history, err := machineInterface.StateHistory()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	stateJSON, err := json.Marshal(struct {
+		State   datasource.MachineState  `json:"state"`
+		History []datasource.StateChange `json:"history"`
+	}{state, history})
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(stateJSON))
+}
+
+// SetMachineState changes the lifecycle state of the machine. The actor is
+// taken from the actor form value, or the address of the client.
+func (ws *webServer) SetMachineState(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	actor := r.FormValue("actor")
+	if actor == "" {
+		actor = fmt.Sprintf("api (%s)", r.RemoteAddr)
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	err = machineInterface.SetState(datasource.MachineState(r.FormValue("value")),
+		actor, r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// MachineVariable returns all the flags set for the machine. With the
+// resolved form value, the effective variables are returned with their
+// sources.
 func (ws *webServer) MachineVariables(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	macString := vars["mac"]
@@ -120,7 +211,13 @@ func (ws *webServer) MachineVariables(w http.ResponseWriter, r *http.Request) {
 
 	machineInterface := ws.ds.MachineInterface(mac)
 
-	flags, err := machineInterface.ListVariables()
+	var flags interface{}
+	if r.FormValue("resolved") != "" {
+		// including the variables of the profiles and the cluster
+		flags, err = machineInterface.ListResolvedVariables()
+	} else {
+		flags, err = machineInterface.ListVariables()
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
@@ -160,6 +257,9 @@ func (ws *webServer) SetMachineVariable(w http.ResponseWriter, r *http.Request)
 		http.Error(w, `{"error": "Error while setting value"}`, http.StatusInternalServerError)
 		return
 	}
+	if name == datasource.SpecialKeyBootAction {
+		recordBootActionChanged(machineInterface)
+	}
 
 	io.WriteString(w, `"OK"`)
 }
@@ -187,10 +287,23 @@ func (ws *webServer) DelMachineVariable(w http.ResponseWriter, r *http.Request)
 		http.Error(w, `{"error": "Error while delleting value"}`, http.StatusInternalServerError)
 		return
 	}
+	if name == datasource.SpecialKeyBootAction {
+		recordBootActionChanged(machineInterface)
+	}
 
 	io.WriteString(w, `"OK"`)
 }
 
+// recordBootActionChanged records that the boot action of the machine is
+// changed by the user, so its previous boot attempts are not counted anymore
+func recordBootActionChanged(machineInterface datasource.MachineInterface) {
+	err := machineInterface.RecordBootEvent(datasource.BootEventActionChanged)
+	if err != nil {
+		log.WithField("where", "web.recordBootActionChanged").WithError(err).Warn(
+			"failed to record the boot event")
+	}
+}
+
 // ClusterVariables returns all the cluster general variables
 func (ws *webServer) ClusterVariablesList(w http.ResponseWriter, r *http.Request) {
 	flags, err := ws.ds.ListClusterVariables()
@@ -248,70 +361,391 @@ func (ws *webServer) DelClusterVariables(w http.ResponseWriter, r *http.Request)
 	io.WriteString(w, `"OK"`)
 }
 
+// ProfilesList returns the names of all the profiles
+func (ws *webServer) ProfilesList(w http.ResponseWriter, r *http.Request) {
+	profiles, err := ws.ds.Profiles()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	if len(profiles) == 0 {
+		io.WriteString(w, "[]")
+		return
+	}
+
+	profilesJSON, err := json.Marshal(profiles)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(profilesJSON))
+}
+
+// ProfileVariables returns all the variables of the profile
+func (ws *webServer) ProfileVariables(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	flags, err := ws.ds.ListProfileVariables(vars["profile"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	flagsJSON, err := json.Marshal(flags)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(flagsJSON))
+}
+
+func (ws *webServer) SetProfileVariable(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := ws.ds.SetProfileVariable(vars["profile"], vars["name"], r.FormValue("value"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+func (ws *webServer) DelProfileVariable(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := ws.ds.DeleteProfileVariable(vars["profile"], vars["name"])
+	if err != nil {
+		http.Error(w, `{"error": "Error while deleting value"}`, http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+func (ws *webServer) DelProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := ws.ds.DeleteProfile(vars["profile"]); err != nil {
+		http.Error(w, `{"error": "Error while deleting profile"}`, http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// SubnetsList returns all the subnets defined for the cluster
+func (ws *webServer) SubnetsList(w http.ResponseWriter, r *http.Request) {
+	subnets, err := ws.ds.Subnets()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	if len(subnets) == 0 {
+		io.WriteString(w, "[]")
+		return
+	}
+
+	subnetsJSON, err := json.Marshal(subnets)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(subnetsJSON))
+}
+
+// SetSubnet creates or updates a subnet from the json encoded value
+func (ws *webServer) SetSubnet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	value := r.FormValue("value")
+
+	var subnet datasource.Subnet
+	if err := json.Unmarshal([]byte(value), &subnet); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+	subnet.Name = name
+
+	if err := ws.ds.SetSubnet(subnet); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// DelSubnet deletes a subnet
+func (ws *webServer) DelSubnet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if err := ws.ds.DeleteSubnet(name); err != nil {
+		http.Error(w, `{"error": "Error while deleting subnet"}`, http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
 var workspaceUploadLock = &sync.Mutex{}
 
+// WorkspaceUploadHandler receives a workspace tarball, which may be
+// compressed with gzip or zstd, and activates it. The tarball is streamed
+// to the disk while its SHA-256 is verified, and is extracted before the
+// current workspace is switched to it atomically. The tarballs which are
+// larger than the max size of the workspaces are rejected.
 func (ws *webServer) WorkspaceUploadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hash := vars["hash"]
+	if err := workspace.ValidSHA256(hash); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	maxSize := utils.DefaultUntarLimits.MaxBytes
+	if r.ContentLength > maxSize {
+		http.Error(w, fmt.Sprintf(`{"error": "The workspace is larger than %d bytes"}`, maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	workspacePath := ws.ds.WorkspacePath()
+	size, err := workspace.Store(workspacePath, hash, r.Body)
+	if err == workspace.ErrHashMismatch {
+		http.Error(w, `{"error": "Actual hash of uploaded file doesn't match with the request"}`, http.StatusBadRequest)
+		return
+	}
+	if err != nil && size >= maxSize {
+		http.Error(w, fmt.Sprintf(`{"error": "The workspace is larger than %d bytes"}`, maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.WithField("where", "web.WorkspaceUploadHandler").WithError(err).Warn(
+			"failed to store the uploaded workspace")
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
 
 	workspaceUploadLock.Lock()
 	defer workspaceUploadLock.Unlock()
 
-	workspacePath := ws.ds.WorkspacePath()
+	errs := workspace.Validate(ws.ds, filepath.Join(workspace.Dir(workspacePath, hash), "workspace"))
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs, http.StatusBadRequest)
+		return
+	}
+	if err := workspace.Switch(workspacePath, hash); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
 
-	workspaceParentPath := path.Dir(workspacePath)
-	tarPath := path.Join(workspaceParentPath, "workspace.tar")
-	file, err := os.Create(tarPath)
+	// the other instances pull the workspace from this one
+	self := ws.ds.SelfInfo()
+	err = ws.ds.PutFile(datasource.File{
+		ID:           hash,
+		Name:         workspace.TarballName,
+		FromInstance: self.WebAddr(),
+		Location:     workspace.TarballLocation(hash),
+		Uploader:     r.RemoteAddr,
+		UploadedAt:   time.Now().Unix(),
+		Size:         size,
+	})
 	if err != nil {
-		http.Error(w, `{"error": "Error while creating new file for storing the upload"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error": "Unable to record the uploaded workspace"}`, http.StatusInternalServerError)
 		return
 	}
-	_, err = io.Copy(file, r.Body)
-	if err != nil {
-		http.Error(w, `{"error": "Error while storing the workspace"}`, http.StatusInternalServerError)
+
+	if err := ws.activateWorkspace(hash); err != nil {
+		http.Error(w, `{"error": "Unable to set current workspace hash"}`, http.StatusInternalServerError)
 		return
 	}
 
-	actualHash, _ := utils.HashFileMD5(tarPath)
-	if actualHash != hash {
-		http.Error(w, `{"error": "Actual hash of uploaded file doesn't match with the request"}`, http.StatusInternalServerError)
+	io.WriteString(w, `"OK"`)
+}
+
+// ValidateWorkspace validates the workspace tarball of the request body,
+// like WorkspaceUploadHandler, without storing or activating it
+func (ws *webServer) ValidateWorkspace(w http.ResponseWriter, r *http.Request) {
+	errs, err := workspace.ValidateTarball(ws.ds, r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
 		return
 	}
+	writeValidationErrors(w, errs, http.StatusOK)
+}
 
-	extractPath := path.Join(workspaceParentPath, hash)
-	err = utils.Untar(tarPath, extractPath)
+// writeValidationErrors writes the problems of a workspace
+func writeValidationErrors(w http.ResponseWriter, errs workspace.ValidationErrors, code int) {
+	body := struct {
+		Error  string   `json:"error,omitempty"`
+		Errors []string `json:"errors"`
+	}{
+		Errors: errs.Strings(),
+	}
+	if code != http.StatusOK {
+		body.Error = errs.Error()
+	}
+	bodyJSON, err := json.Marshal(body)
 	if err != nil {
-		http.Error(w, `{"error": "Error untaring the uploaded workspace"}`, http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(code)
+	w.Write(bodyJSON)
+}
+
+// activateWorkspace makes the current workspace of this instance the active
+// workspace of the cluster, by loading its initial values and setting its
+// hash, which is watched by the other instances
+func (ws *webServer) activateWorkspace(hash string) error {
+	ws.ds.(*datasource.EtcdDataSource).FillEtcdFromWorkspace()
 
-	os.Remove(workspacePath)
+	err := ws.ds.SetWorkspaceSyncStatus(datasource.WorkspaceSyncStatus{
+		Hash:   hash,
+		Target: hash,
+		State:  datasource.WorkspaceSynced,
+	})
 	if err != nil {
-		log.Info("Failed to unlink \"current\" symlink, but it is a no issue as it could be the first initialization")
+		log.WithField("where", "web.activateWorkspace").WithError(err).Warn(
+			"failed to record the workspace sync status")
 	}
 
-	destinedCurrentWorkspacePath := path.Join(extractPath, "workspace/")
-	err = os.Symlink(destinedCurrentWorkspacePath, workspacePath)
+	return ws.ds.SetClusterVariable(datasource.ActiveWorkspaceHashKey, hash)
+}
+
+// WorkspacesList returns the stored versions of the workspace, the newest
+// first
+func (ws *webServer) WorkspacesList(w http.ResponseWriter, r *http.Request) {
+	versions, err := workspace.Versions(ws.ds)
 	if err != nil {
-		http.Error(w, `{"error": "Error symlinking current to the untared workspace"}`, http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
+	if versions == nil {
+		versions = []workspace.Version{}
+	}
 
-	imagesWorkspaceDir := path.Join(workspacePath, "files/")
-	imagesWorkspaceTarPath := path.Join(imagesWorkspaceDir, "workspace.tar")
-	os.Rename(tarPath, imagesWorkspaceTarPath)
+	versionsJSON, err := json.Marshal(versions)
 	if err != nil {
-		http.Error(w, `{"error": "Error while moving uploaded tar itself into workspace"}`, http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
+	w.Write(versionsJSON)
+}
 
-	ws.ds.(*datasource.EtcdDataSource).FillEtcdFromWorkspace()
+// ActivateWorkspace rolls the cluster back (or forward) to a stored version
+// of the workspace
+func (ws *webServer) ActivateWorkspace(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if err := workspace.ValidHash(hash); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	workspaceUploadLock.Lock()
+	defer workspaceUploadLock.Unlock()
 
-	err = ws.ds.SetClusterVariable(datasource.ActiveWorkspaceHashKey, hash)
+	versions, err := workspace.Versions(ws.ds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, version := range versions {
+		found = found || version.ID == hash
+	}
+	if !found {
+		http.Error(w, `{"error": "Workspace not found"}`, http.StatusNotFound)
+		return
+	}
+
+	err = workspace.Activate(context.Background(), ws.ds, hash)
+	if errs, ok := err.(workspace.ValidationErrors); ok {
+		writeValidationErrors(w, errs, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	if err := ws.activateWorkspace(hash); err != nil {
 		http.Error(w, `{"error": "Unable to set current workspace hash"}`, http.StatusInternalServerError)
 		return
 	}
 
 	io.WriteString(w, `"OK"`)
 }
+
+// CollectWorkspaces deletes the versions of the workspace which are not
+// retained, and returns their hashes
+func (ws *webServer) CollectWorkspaces(w http.ResponseWriter, r *http.Request) {
+	workspaceUploadLock.Lock()
+	defer workspaceUploadLock.Unlock()
+
+	deleted, err := workspace.Collect(ws.ds, ws.workspaceRetention)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	if deleted == nil {
+		deleted = []string{}
+	}
+
+	deletedJSON, err := json.Marshal(deleted)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(deletedJSON)
+}
+
+// WorkspaceTarball serves the tarball of a workspace, which is pulled by the
+// other instances
+func (ws *webServer) WorkspaceTarball(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if err := workspace.ValidHash(hash); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	tarballPath := workspace.TarballPath(ws.ds.WorkspacePath(), hash)
+	if _, err := os.Stat(tarballPath); err != nil {
+		http.Error(w, `{"error": "Workspace not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	http.ServeFile(w, r, tarballPath)
+}
+
+type instanceDetails struct {
+	datasource.InstanceInfo
+	Workspace *datasource.WorkspaceSyncStatus `json:"workspace"`
+}
+
+// InstancesList returns the list of the instances, with the sync status of
+// their workspaces
+func (ws *webServer) InstancesList(w http.ResponseWriter, r *http.Request) {
+	instances, err := ws.ds.Instances()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	statuses, err := ws.ds.WorkspaceSyncStatuses()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	details := make([]instanceDetails, 0, len(instances))
+	for _, instance := range instances {
+		d := instanceDetails{InstanceInfo: instance}
+		if status, ok := statuses[instance.WebAddr()]; ok {
+			d.Workspace = &status
+		}
+		details = append(details, d)
+	}
+
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(detailsJSON)
+}
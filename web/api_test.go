@@ -3,22 +3,26 @@ package web
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/utils"
 )
 
 func TestMachineVariablesAPI(t *testing.T) {
 	mac1, _ := net.ParseMAC("00:11:22:33:44:55")
 
-	ds, err := datasource.ForTest(nil)
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
 	if err != nil {
 		t.Error("error in getting a DataSource instance for our test:", err)
 		return
 	}
+	defer cleanup()
 
 	if err := ds.WhileMaster(); err != nil {
 		t.Error("failed to register as the master instance:", err)
@@ -120,3 +124,37 @@ func TestMachineVariablesAPI(t *testing.T) {
 		return
 	}
 }
+
+func TestWorkspaceUploadMaxSize(t *testing.T) {
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
+	if err != nil {
+		t.Fatal("error in getting a DataSource instance for our test:", err)
+	}
+	defer cleanup()
+
+	maxSize := utils.DefaultUntarLimits.MaxBytes
+	utils.DefaultUntarLimits.MaxBytes = 10
+	defer func() { utils.DefaultUntarLimits.MaxBytes = maxSize }()
+
+	h := (&webServer{ds: ds}).Handler()
+	hash := strings.Repeat("0", 64)
+	req, err := http.NewRequest("POST", "http://test.com/uploadworkspace/"+hash,
+		strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal("error while NewRequest:", err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("unexpected status code while uploading a large workspace:", w.Code)
+	}
+
+	// without the content length, the body is cut at the max size
+	req.ContentLength = -1
+	req.Body = ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100)))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("unexpected status code while streaming a large workspace:", w.Code)
+	}
+}
@@ -14,6 +14,9 @@ import (
 
 type webServer struct {
 	ds datasource.DataSource
+	// workspaceRetention is the number of the newest versions of the
+	// workspace which are kept by the garbage collection
+	workspaceRetention int
 }
 
 // Handler uses a multiplexing router to route http requests
@@ -23,14 +26,21 @@ func (ws *webServer) Handler() http.Handler {
 	mux.PathPrefix("/t/cc/").HandlerFunc(ws.Cloudconfig).Methods("GET")
 	mux.PathPrefix("/t/ig/").HandlerFunc(ws.Ignition).Methods("GET")
 	mux.PathPrefix("/t/bp/").HandlerFunc(ws.Bootparams).Methods("GET")
+	mux.PathPrefix("/t/booted/").HandlerFunc(ws.Booted).Methods("POST")
+	mux.HandleFunc("/api/templates/{name}/preview", ws.TemplatePreview).Methods("POST")
 
 	mux.HandleFunc("/api/version", ws.Version)
+	mux.HandleFunc("/api/instances", ws.InstancesList).Methods("GET")
 
 	mux.HandleFunc("/api/machines", ws.MachinesList)
 	mux.HandleFunc("/api/machines/{mac}", ws.MachineDelete).Methods("DELETE")
 
 	// mux.PathPrefix("/api/machine/").HandlerFunc(ws.NodeSetIPMI).Methods("PUT")
 
+	// Machine lifecycle state, with its audit trail
+	mux.HandleFunc("/api/machines/{mac}/state", ws.MachineState).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/state", ws.SetMachineState).Methods("PUT")
+
 	// Machine variables; used in templates
 	mux.PathPrefix("/api/machines/{mac}/variables").HandlerFunc(ws.MachineVariables).Methods("GET")
 	mux.PathPrefix("/api/machines/{mac}/variables/{name}").HandlerFunc(ws.SetMachineVariable).Methods("PUT")
@@ -42,6 +52,18 @@ func (ws *webServer) Handler() http.Handler {
 	mux.PathPrefix("/api/variables/{name}").HandlerFunc(ws.DelClusterVariables).Methods("DELETE")
 	mux.PathPrefix("/api/variables").HandlerFunc(ws.ClusterVariablesList).Methods("GET")
 
+	// Profiles; their variables are shared by the machines assigned to them
+	mux.PathPrefix("/api/profiles/{profile}/variables/{name}").HandlerFunc(ws.SetProfileVariable).Methods("PUT")
+	mux.PathPrefix("/api/profiles/{profile}/variables/{name}").HandlerFunc(ws.DelProfileVariable).Methods("DELETE")
+	mux.PathPrefix("/api/profiles/{profile}/variables").HandlerFunc(ws.ProfileVariables).Methods("GET")
+	mux.HandleFunc("/api/profiles/{profile}", ws.DelProfile).Methods("DELETE")
+	mux.HandleFunc("/api/profiles", ws.ProfilesList).Methods("GET")
+
+	// Subnets; used by DHCP for the relayed requests
+	mux.PathPrefix("/api/subnets/{name}").HandlerFunc(ws.SetSubnet).Methods("PUT")
+	mux.PathPrefix("/api/subnets/{name}").HandlerFunc(ws.DelSubnet).Methods("DELETE")
+	mux.PathPrefix("/api/subnets").HandlerFunc(ws.SubnetsList).Methods("GET")
+
 	// TODO: returning other files functionalities
 	mux.PathPrefix("/files/images/").Handler(http.StripPrefix("/files/images",
 		http.FileServer(http.Dir(filepath.Join(ws.ds.WorkspacePath(), "images")))))
@@ -60,6 +82,13 @@ func (ws *webServer) Handler() http.Handler {
 	mux.PathPrefix("/static/").Handler(http.FileServer(FS(false)))
 
 	mux.PathPrefix("/uploadworkspace/{hash}").HandlerFunc(ws.WorkspaceUploadHandler).Methods("POST")
+	mux.HandleFunc("/api/workspaces/{hash}/tarball", ws.WorkspaceTarball).Methods("GET")
+
+	// Workspace versions; the old ones can be activated to roll back
+	mux.HandleFunc("/api/workspaces", ws.WorkspacesList).Methods("GET")
+	mux.HandleFunc("/api/workspaces/gc", ws.CollectWorkspaces).Methods("POST")
+	mux.HandleFunc("/api/workspaces/validate", ws.ValidateWorkspace).Methods("POST")
+	mux.HandleFunc("/api/workspaces/{hash}/activate", ws.ActivateWorkspace).Methods("PUT")
 
 	return mux
 }
@@ -71,8 +100,8 @@ func logHandler(h http.Handler) http.Handler {
 }
 
 //ServeWeb serves api of Blacksmith and a ui connected to that api
-func ServeWeb(ds datasource.DataSource, listenAddr net.TCPAddr) error {
-	r := &webServer{ds: ds}
+func ServeWeb(ds datasource.DataSource, listenAddr net.TCPAddr, workspaceRetention int) error {
+	r := &webServer{ds: ds, workspaceRetention: workspaceRetention}
 
 	logWriter := log.StandardLogger().Writer()
 	defer logWriter.Close()
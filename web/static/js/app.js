@@ -11,6 +11,10 @@ blacksmithUIApp.config(['$routeProvider', '$locationProvider',
         templateUrl: 'static/partials/variables-list.html',
         controller: 'BlacksmithVariablesCtrl'
       }).
+      when('/ui/workspaces/', {
+        templateUrl: 'static/partials/workspaces-list.html',
+        controller: 'BlacksmithWorkspacesCtrl'
+      }).
       when('/ui/about/', {
         templateUrl: 'static/partials/about.html',
         controller: 'BlacksmithAboutCtrl'
@@ -144,6 +144,37 @@ blacksmithUIControllers.controller('BlacksmithVariablesCtrl', ['$scope', 'Variab
 }]);
 
 
+blacksmithUIControllers.controller('BlacksmithWorkspacesCtrl', ['$scope', 'Workspaces', function ($scope, Workspaces) {
+  $scope.errorMessage = false;
+
+  $scope.getWorkspaces = function () {
+    Workspaces.query().$promise.then(
+      function( value ){ $scope.workspaces = value; },
+      function( error ){ $scope.errorMessage = error.data; $scope.workspaces = []; }
+    );
+  };
+  $scope.getWorkspaces();
+
+  $scope.uploadedAt = function(workspace) {
+    return new Date(workspace.uploadedAt * 1000).toLocaleString();
+  };
+
+  $scope.activate = function(hash) {
+    if(!confirm("Activate workspace " + hash + "?")) return;
+    Workspaces.activate({hash: hash}).$promise.then(
+      function( value ){ $scope.errorMessage = false; $scope.getWorkspaces(); },
+      function( error ){ $scope.errorMessage = error.data; }
+    );
+  };
+
+  $scope.collect = function() {
+    Workspaces.gc().$promise.then(
+      function( value ){ $scope.errorMessage = false; $scope.getWorkspaces(); },
+      function( error ){ $scope.errorMessage = error.data; }
+    );
+  };
+}]);
+
 blacksmithUIControllers.controller('BlacksmithAboutCtrl', ['$scope', 'Version', 'Variable', function ($scope, Version, Variable) {
   Version.query().$promise.then(
     function (value) {
@@ -38,3 +38,12 @@ apiServices.factory('Version', ['$resource',
       query: {method:'GET', params:{}, isArray:false}
     });
 }]);
+
+apiServices.factory('Workspaces', ['$resource',
+  function($resource){
+    return $resource('/api/workspaces/:hash/:action', {}, {
+      query: {method:'GET', params:{}, isArray:true},
+      activate: {method:'PUT', params:{hash: '@hash', action: 'activate'}, isArray:false},
+      gc: {method:'POST', params:{hash: 'gc'}, isArray:true}
+    });
+}]);
@@ -1,11 +1,18 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"path"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/templating"
 )
 
@@ -32,6 +39,8 @@ func (ws *webServer) generateTemplateForMachine(templateName string, w http.Resp
 	cc, err := templating.ExecuteTemplateFolder(
 		path.Join(ws.ds.WorkspacePath(), "config", templateName), ws.ds, machineInterface, r.Host)
 	if err != nil {
+		log.WithField("where", "web.generateTemplateForMachine").WithError(err).Warnf(
+			"failed to render %s for %s", templateName, mac)
 		http.Error(w, fmt.Sprintf(`Error while executing the template: %q`, err), 500)
 		return ""
 	}
@@ -42,6 +51,60 @@ func (ws *webServer) generateTemplateForMachine(templateName string, w http.Resp
 	return cc
 }
 
+// recordProvisioned records a boot event for the machine specified by the mac
+// in the request url path, and moves it to the provisioned state
+func (ws *webServer) recordProvisioned(r *http.Request, eventType string) {
+	_, macStr := path.Split(r.URL.Path)
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	err = machineInterface.RecordBootEvent(eventType)
+	if err != nil {
+		log.WithField("where", "web.recordProvisioned").WithError(err).Warn(
+			"failed to record the boot event")
+	}
+	_, err = machineInterface.AdvanceState(datasource.StateProvisioned, "web",
+		eventType+" served")
+	if err != nil {
+		log.WithField("where", "web.recordProvisioned").WithError(err).Warn(
+			"failed to advance the state")
+	}
+}
+
+// completeOneShotBoot reverts the install-once boot action of the machine
+// specified by the mac in the request url path to localboot. It's called when
+// the machine fetches its config, which means it's booted successfully.
+func (ws *webServer) completeOneShotBoot(r *http.Request) {
+	_, macStr := path.Split(r.URL.Path)
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	action, err := machineInterface.GetVariable(datasource.SpecialKeyBootAction)
+	if err != nil || action != datasource.BootActionInstallOnce {
+		return
+	}
+
+	err = machineInterface.SetVariable(datasource.SpecialKeyBootAction,
+		datasource.BootActionLocalBoot)
+	if err != nil {
+		log.WithField("where", "web.completeOneShotBoot").WithError(err).Warn(
+			"failed to revert the boot action")
+		return
+	}
+	log.WithFields(log.Fields{
+		"where":   "web.completeOneShotBoot",
+		"action":  "update",
+		"object":  mac.String(),
+		"subject": datasource.SpecialKeyBootAction,
+	}).Info("install-once is done, reverted to localboot")
+}
+
 // Cloudconfig generates and writes cloudconfig for the machine specified by the
 // mac in the request url path
 func (ws *webServer) Cloudconfig(w http.ResponseWriter, r *http.Request) {
@@ -49,13 +112,45 @@ func (ws *webServer) Cloudconfig(w http.ResponseWriter, r *http.Request) {
 
 	if config != "" && r.FormValue("validate") != "" {
 		w.Write([]byte(templating.ValidateCloudConfig(config)))
+	} else if config != "" {
+		ws.recordProvisioned(r, datasource.BootEventCloudConfig)
+		ws.completeOneShotBoot(r)
 	}
 }
 
 // Ignition generates and writes ignition for the machine specified by the
 // mac in the request url path
 func (ws *webServer) Ignition(w http.ResponseWriter, r *http.Request) {
-	ws.generateTemplateForMachine("ignition", w, r)
+	if ws.generateTemplateForMachine("ignition", w, r) != "" {
+		ws.recordProvisioned(r, datasource.BootEventIgnition)
+		ws.completeOneShotBoot(r)
+	}
+}
+
+// Booted records that the machine specified by the mac in the request url
+// path is booted successfully, which ends its boot attempts. It's meant to be
+// called by the machine, i.e. by a unit of its cloudconfig or ignition, once
+// it's up.
+func (ws *webServer) Booted(w http.ResponseWriter, r *http.Request) {
+	_, macStr := path.Split(r.URL.Path)
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`Error while parsing the mac: %q`, err), 400)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, "Machine not found", 404)
+		return
+	}
+	if err := machineInterface.RecordBootEvent(datasource.BootEventBooted); err != nil {
+		log.WithField("where", "web.Booted").WithError(err).Warn(
+			"failed to record the boot event")
+		http.Error(w, fmt.Sprintf(`Error while recording the boot event: %q`, err), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Bootparams generates and writes bootparams for the machine specified by the
@@ -63,3 +158,168 @@ func (ws *webServer) Ignition(w http.ResponseWriter, r *http.Request) {
 func (ws *webServer) Bootparams(w http.ResponseWriter, r *http.Request) {
 	ws.generateTemplateForMachine("bootparams", w, r)
 }
+
+// previewMachine overlays a machine, which may not exist, with a machine
+// record and variable overrides, for the template previews. Nothing is
+// written to the datasource through it.
+type previewMachine struct {
+	datasource.MachineInterface
+	ds        datasource.DataSource
+	machine   datasource.Machine
+	exists    bool
+	overrides map[string]string
+	// variables are the variables of the machine itself, read once
+	variables map[string]string
+}
+
+// Machine returns the overlaid machine record; it's never created
+func (m *previewMachine) Machine(createIfNeeded bool, createWithIP net.IP) (datasource.Machine, error) {
+	return m.machine, nil
+}
+
+// Profiles returns the overridden profiles of the machine, if they're
+// overridden
+func (m *previewMachine) Profiles() ([]string, error) {
+	if value, ok := m.overrides[datasource.SpecialKeyProfiles]; ok {
+		return datasource.ParseProfiles(value)
+	}
+	return m.MachineInterface.Profiles()
+}
+
+// GetVariable returns the overridden value of the variable, if any, which
+// takes precedence over the variables of the machine, its profiles and the
+// cluster
+func (m *previewMachine) GetVariable(key string) (string, error) {
+	value, _, err := m.LookupVariable(key)
+	return value, err
+}
+
+// LookupVariable is like GetVariable, the overridden variables are resolved
+// from the machine. If the profiles are overridden, the variables which are
+// not set for the machine are resolved from the overridden profiles, then the
+// cluster.
+func (m *previewMachine) LookupVariable(key string) (string, string, error) {
+	if value, ok := m.overrides[key]; ok {
+		return value, datasource.VariableSourceMachine, nil
+	}
+	profilesValue, ok := m.overrides[datasource.SpecialKeyProfiles]
+	if !ok {
+		return m.MachineInterface.LookupVariable(key)
+	}
+
+	variables, err := m.machineVariables()
+	if err != nil {
+		return "", "", err
+	}
+	if value, ok := variables[key]; ok {
+		return value, datasource.VariableSourceMachine, nil
+	}
+	profiles, err := datasource.ParseProfiles(profilesValue)
+	if err != nil {
+		return "", "", err
+	}
+	return datasource.LookupProfilesVariable(m.ds, profiles, key)
+}
+
+// machineVariables returns the variables which are set for the machine
+// itself, none if it doesn't exist
+func (m *previewMachine) machineVariables() (map[string]string, error) {
+	if m.variables == nil {
+		if !m.exists {
+			m.variables = map[string]string{}
+			return m.variables, nil
+		}
+		variables, err := m.MachineInterface.ListVariables()
+		if err != nil {
+			return nil, fmt.Errorf("error while getting the variables of the machine: %s", err)
+		}
+		m.variables = variables
+	}
+	return m.variables, nil
+}
+
+// templatePreviewRequest is the body of the TemplatePreview requests
+type templatePreviewRequest struct {
+	// Mac is the machine which the template is rendered for, it doesn't need
+	// to exist
+	Mac string `json:"mac"`
+	// IP overrides the IP of the machine
+	IP string `json:"ip"`
+	// Variables override the variables of the machine
+	Variables map[string]string `json:"variables"`
+}
+
+// TemplatePreview renders the template folder of the workspace config, which
+// is named in the url path, for an existing or a synthetic machine with the
+// variable overrides of the request body. Nothing is stored or changed.
+func (ws *webServer) TemplatePreview(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == "" || name[0] == '.' || strings.ContainsAny(name, `/\`) {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, "invalid template name: "+name), http.StatusBadRequest)
+		return
+	}
+	tmplFolder := path.Join(ws.ds.WorkspacePath(), "config", name)
+	if info, err := os.Stat(tmplFolder); err != nil || !info.IsDir() {
+		http.Error(w, `{"error": "Template not found"}`, http.StatusNotFound)
+		return
+	}
+
+	var req templatePreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, "error while decoding the request: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	mac, err := net.ParseMAC(req.Mac)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, "error while parsing the mac: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	var ip net.IP
+	if req.IP != "" {
+		if ip = net.ParseIP(req.IP).To4(); ip == nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, "invalid ip: "+req.IP), http.StatusBadRequest)
+			return
+		}
+	}
+	for key, value := range req.Variables {
+		if err := datasource.ValidateVariable(key, value); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, "invalid value for "+key+": "+err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var warnings []string
+	machineInterface := ws.ds.MachineInterface(mac)
+	machine, err := machineInterface.Machine(false, nil)
+	exists := err == nil
+	if !exists {
+		warnings = append(warnings, fmt.Sprintf("machine %s is not found, it's previewed as a new machine", mac))
+		machine = datasource.Machine{}
+	}
+	if ip != nil {
+		machine.IP = ip
+	}
+	if machine.IP == nil {
+		warnings = append(warnings, "the machine has no IP")
+	}
+
+	preview, err := templating.PreviewTemplateFolder(tmplFolder, ws.ds, &previewMachine{
+		MachineInterface: machineInterface,
+		ds:               ws.ds,
+		machine:          machine,
+		exists:           exists,
+		overrides:        req.Variables,
+	}, r.Host)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, "error while executing the template: "+err.Error()), http.StatusInternalServerError)
+		return
+	}
+	preview.Warnings = append(warnings, preview.Warnings...)
+
+	previewJSON, err := json.Marshal(preview)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(previewJSON)
+}
@@ -0,0 +1,69 @@
+package web
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestPreviewMachineProfiles(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
+	if err != nil {
+		t.Fatal("error in getting a DataSource instance for our test:", err)
+	}
+	defer cleanup()
+	if err := ds.WhileMaster(); err != nil {
+		t.Fatal("failed to register as the master instance:", err)
+	}
+	defer ds.Shutdown()
+
+	mi := ds.MachineInterface(mac1)
+	machine, err := mi.Machine(true, nil)
+	if err != nil {
+		t.Fatal("error while creating machine:", err)
+	}
+	if err := mi.SetVariable(datasource.SpecialKeyProfiles, "storage"); err != nil {
+		t.Fatal("error while setting the variable:", err)
+	}
+	if err := mi.SetVariable("role", "worker"); err != nil {
+		t.Fatal("error while setting the variable:", err)
+	}
+	if err := ds.SetProfileVariable("storage", "disk", "sda"); err != nil {
+		t.Fatal("error while setting the profile variable:", err)
+	}
+	if err := ds.SetProfileVariable("compute", "disk", "nvme0n1"); err != nil {
+		t.Fatal("error while setting the profile variable:", err)
+	}
+
+	preview := &previewMachine{
+		MachineInterface: mi,
+		ds:               ds,
+		machine:          machine,
+		exists:           true,
+		overrides:        map[string]string{datasource.SpecialKeyProfiles: "compute"},
+	}
+	tests := []struct {
+		key    string
+		value  string
+		source string
+	}{
+		{"disk", "nvme0n1", datasource.VariableSourceProfile("compute")},
+		{"role", "worker", datasource.VariableSourceMachine},
+		{"coreos-version", "1068.2.0", datasource.VariableSourceCluster},
+		{"missing", "", ""},
+	}
+	for i, tt := range tests {
+		value, source, err := preview.LookupVariable(tt.key)
+		if err != nil {
+			t.Errorf("#%d: error while looking up %s: %s", i, tt.key, err)
+			continue
+		}
+		if value != tt.value || source != tt.source {
+			t.Errorf("#%d: expected %q from %q for %s, got %q from %q",
+				i, tt.value, tt.source, tt.key, value, source)
+		}
+	}
+}
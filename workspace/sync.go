@@ -0,0 +1,246 @@
+package workspace
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+const (
+	// syncRetryInterval is the interval between the attempts of a failed
+	// sync
+	syncRetryInterval = 10 * time.Second
+	// syncPollInterval is the interval which the active workspace is checked
+	// at, in case a change is missed by the watch
+	syncPollInterval = time.Minute
+	// pullTimeout is the timeout of downloading a tarball
+	pullTimeout = 10 * time.Minute
+)
+
+// syncer pulls the active workspace of the cluster from the instances which
+// have it
+type syncer struct {
+	ds     datasource.DataSource
+	client *http.Client
+	// last is the last status which is recorded, to skip the unchanged ones
+	last datasource.WorkspaceSyncStatus
+	// collected is the active workspace which the old versions are collected
+	// after
+	collected string
+}
+
+func newPullClient() *http.Client {
+	return &http.Client{Timeout: pullTimeout}
+}
+
+// Sync keeps the workspace of this instance in sync with the active
+// workspace of the cluster, until ctx is done. When the active workspace
+// hash changes, its tarball is pulled from an instance which has it, and is
+// verified and installed. The progress is recorded as the workspace sync
+// status of the instance. After each change of the active workspace, the
+// versions which are not retained are deleted, keeping the retention newest
+// ones (see Collect).
+func Sync(ctx context.Context, ds datasource.DataSource, retention int) {
+	s := &syncer{
+		ds:     ds,
+		client: newPullClient(),
+	}
+
+	log.WithFields(log.Fields{
+		"where":  "workspace.Sync",
+		"action": "announce",
+	}).Info("Syncing the workspace with the cluster")
+
+	for {
+		wait := syncRetryInterval
+		if err := s.sync(ctx); err != nil {
+			log.WithField("where", "workspace.Sync").WithError(err).Warn(
+				"failed to sync the workspace")
+		} else {
+			s.collect(retention)
+
+			waitCtx, cancel := context.WithTimeout(ctx, syncPollInterval)
+			err := ds.WaitForWorkspaceChange(waitCtx)
+			cancel()
+			if err == nil || waitCtx.Err() != nil {
+				wait = 0
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sync pulls and installs the active workspace, if it's not the current one
+func (s *syncer) sync(ctx context.Context) error {
+	workspacePath := s.ds.WorkspacePath()
+	current, err := CurrentHash(workspacePath)
+	if err != nil {
+		return fmt.Errorf("error while reading the current workspace: %s", err)
+	}
+
+	variables, err := s.ds.ListClusterVariables()
+	if err != nil {
+		return fmt.Errorf("error while getting the active workspace: %s", err)
+	}
+	target := variables[datasource.ActiveWorkspaceHashKey]
+	if target == "" || target == current {
+		s.report(datasource.WorkspaceSyncStatus{
+			Hash:   current,
+			Target: target,
+			State:  datasource.WorkspaceSynced,
+		})
+		return nil
+	}
+
+	s.report(datasource.WorkspaceSyncStatus{
+		Hash:   current,
+		Target: target,
+		State:  datasource.WorkspaceSyncing,
+	})
+	// a version which is stored on this instance, i.e. after a rollback, is
+	// not pulled again
+	if !isStored(workspacePath, target) {
+		err = s.pull(ctx, target)
+	}
+	if err == nil {
+		err = Switch(workspacePath, target)
+	}
+	if err != nil {
+		s.report(datasource.WorkspaceSyncStatus{
+			Hash:   current,
+			Target: target,
+			State:  datasource.WorkspaceSyncFailed,
+			Error:  err.Error(),
+		})
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"where":  "workspace.Sync",
+		"action": "update",
+	}).Infof("Workspace is synced to %s", target)
+	s.report(datasource.WorkspaceSyncStatus{
+		Hash:   target,
+		Target: target,
+		State:  datasource.WorkspaceSynced,
+	})
+	return nil
+}
+
+// collect deletes the old versions, once after each change of the active
+// workspace
+func (s *syncer) collect(retention int) {
+	if s.last.Target == s.collected {
+		return
+	}
+	if _, err := Collect(s.ds, retention); err != nil {
+		log.WithField("where", "workspace.Sync").WithError(err).Warn(
+			"failed to collect the old workspaces")
+		return
+	}
+	s.collected = s.last.Target
+}
+
+// report records the status, if it's changed
+func (s *syncer) report(status datasource.WorkspaceSyncStatus) {
+	if status == s.last {
+		return
+	}
+	if err := s.ds.SetWorkspaceSyncStatus(status); err != nil {
+		log.WithField("where", "workspace.Sync").WithError(err).Warn(
+			"failed to record the workspace sync status")
+		return
+	}
+	s.last = status
+}
+
+// pull tries the sources of the workspace in order, until it's stored from
+// one of them
+func (s *syncer) pull(ctx context.Context, hash string) error {
+	sources, err := s.sources(hash)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no instance has the workspace %s", hash)
+	}
+
+	workspacePath := s.ds.WorkspacePath()
+	for _, source := range sources {
+		err = s.pullFrom(ctx, source, workspacePath, hash)
+		if err == nil {
+			return nil
+		}
+		log.WithField("where", "workspace.pull").WithError(err).Warnf(
+			"failed to pull the workspace from %s", source)
+	}
+	return err
+}
+
+// sources returns the urls of the tarball of the workspace on the other
+// instances: the instance which it's uploaded to comes first, and then the
+// instances which are synced to it
+func (s *syncer) sources(hash string) ([]string, error) {
+	self := s.ds.SelfInfo()
+	selfAddr := self.WebAddr()
+	seen := map[string]bool{selfAddr: true}
+	var sources []string
+	add := func(addr, location string) {
+		if addr == "" || seen[addr] {
+			return
+		}
+		seen[addr] = true
+		sources = append(sources, "http://"+addr+location)
+	}
+
+	if file, err := s.ds.File(hash); err == nil {
+		add(file.FromInstance, file.Location)
+	}
+
+	instances, err := s.ds.Instances()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the instances: %s", err)
+	}
+	statuses, err := s.ds.WorkspaceSyncStatuses()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the workspace sync statuses: %s", err)
+	}
+	for _, instance := range instances {
+		addr := instance.WebAddr()
+		if status := statuses[addr]; status.Hash == hash {
+			add(addr, TarballLocation(hash))
+		}
+	}
+	return sources, nil
+}
+
+// pullFrom downloads the tarball from the url, and stores it if its hash
+// matches
+func (s *syncer) pullFrom(ctx context.Context, url string, workspacePath string, hash string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = ctx.Done()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	_, err = Store(workspacePath, hash, resp.Body)
+	return err
+}
@@ -0,0 +1,157 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/templating"
+	"github.com/cafebazaar/blacksmith/utils"
+)
+
+// ValidationErrors are the problems of a workspace, which stop it from being
+// activated
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	return "invalid workspace: " + strings.Join(errs.Strings(), "; ")
+}
+
+// Strings returns the messages of the errors
+func (errs ValidationErrors) Strings() []string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return messages
+}
+
+// Validate checks the extracted workspace in dir to be bootable, and returns
+// all of its problems. The values of initial.yaml should be valid variables,
+// and config/bootparams/main should exist. The templates of each folder of
+// config, and the .tmpl files of tftp, should parse and render for a
+// synthetic machine, which has the cluster variables overridden by
+// initial.yaml. The images of the image (or coreos-version) and rescue-image
+// variables should have their kernel and initrd files.
+func Validate(ds datasource.DataSource, dir string) ValidationErrors {
+	var errs ValidationErrors
+
+	clusterVariables, err := ds.ListClusterVariables()
+	if err != nil {
+		return ValidationErrors{fmt.Errorf("error while getting the cluster variables: %s", err)}
+	}
+	variables := make(map[string]string, len(clusterVariables))
+	for key, value := range clusterVariables {
+		variables[key] = value
+	}
+	initial, err := initialValues(dir)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	keys := make([]string, 0, len(initial))
+	for key := range initial {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := datasource.ValidateVariable(key, initial[key]); err != nil {
+			errs = append(errs, fmt.Errorf("initial.yaml: %s: %s", key, err))
+		}
+		variables[key] = initial[key]
+	}
+
+	configPath := filepath.Join(dir, "config")
+	if _, err := os.Stat(filepath.Join(configPath, "bootparams", "main")); err != nil {
+		errs = append(errs, errors.New("config/bootparams/main is missing"))
+	}
+	folders, err := ioutil.ReadDir(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		errs = append(errs, fmt.Errorf("error while listing the config folders: %s", err))
+	}
+	for _, folder := range folders {
+		if !folder.IsDir() || strings.HasPrefix(folder.Name(), ".") {
+			continue
+		}
+		err := templating.ValidateTemplateFolder(filepath.Join(configPath, folder.Name()), ds, variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config/%s: %s", folder.Name(), err))
+		}
+	}
+
+	tftpPath := filepath.Join(dir, "tftp")
+	filepath.Walk(tftpPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("error while listing the tftp files: %s", err))
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".tmpl") {
+			if err := templating.ValidateTemplateFile(path, ds, variables); err != nil {
+				rel, _ := filepath.Rel(dir, path)
+				errs = append(errs, fmt.Errorf("%s: %s", filepath.ToSlash(rel), err))
+			}
+		}
+		return nil
+	})
+
+	image := variables[datasource.SpecialKeyImage]
+	if image == "" {
+		image = variables[datasource.SpecialKeyCoreosVersion]
+	}
+	for _, name := range []string{image, variables[datasource.SpecialKeyRescueImage]} {
+		if name == "" {
+			continue
+		}
+		if err := pxe.ValidateImage(dir, name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// initialValues reads the initial.yaml of the workspace, which is optional
+func initialValues(dir string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "initial.yaml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading initial.yaml: %s", err)
+	}
+	values := make(map[string]string)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("error while parsing initial.yaml: %s", err)
+	}
+	return values, nil
+}
+
+// ValidateTarball extracts the tarball of r into a temporary directory, and
+// validates it without storing it. It's the dry run of the upload.
+func ValidateTarball(ds datasource.DataSource, r io.Reader) (ValidationErrors, error) {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(ds.WorkspacePath()), ".validate-")
+	if err != nil {
+		return nil, fmt.Errorf("error while creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := utils.UntarReader(r, tmpDir, utils.DefaultUntarLimits); err != nil {
+		return nil, fmt.Errorf("error while untaring the workspace: %s", err)
+	}
+	dir := filepath.Join(tmpDir, "workspace")
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() {
+		return nil, errors.New("the tarball has no workspace directory")
+	}
+	return Validate(ds, dir), nil
+}
@@ -0,0 +1,227 @@
+package workspace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// Version describes a version of the workspace, which is recorded when it's
+// uploaded
+type Version struct {
+	datasource.File
+	// Active is set for the active workspace of the cluster
+	Active bool `json:"active"`
+	// Booted is the number of the machines which last booted from it
+	Booted int `json:"booted"`
+	// Local is set if it's stored on this instance
+	Local bool `json:"local"`
+}
+
+// byUploadTime sorts the versions, the newest first
+type byUploadTime []Version
+
+func (v byUploadTime) Len() int      { return len(v) }
+func (v byUploadTime) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byUploadTime) Less(i, j int) bool {
+	if v[i].UploadedAt != v[j].UploadedAt {
+		return v[i].UploadedAt > v[j].UploadedAt
+	}
+	return v[i].ID < v[j].ID
+}
+
+// storedHashes returns the hashes of the workspaces which are stored next to
+// workspacePath, with their modification times
+func storedHashes(workspacePath string) (map[string]int64, error) {
+	infos, err := ioutil.ReadDir(Dir(workspacePath, ""))
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]int64)
+	for _, info := range infos {
+		hash := info.Name()
+		if info.IsDir() && ValidHash(hash) == nil && isStored(workspacePath, hash) {
+			hashes[hash] = info.ModTime().Unix()
+		}
+	}
+	return hashes, nil
+}
+
+// Versions returns the versions of the workspace, the newest first. The
+// versions which are stored on this instance without being recorded, like
+// the ones uploaded by the previous versions of blacksmith, are included too.
+func Versions(ds datasource.DataSource) ([]Version, error) {
+	files, err := ds.Files()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the files: %s", err)
+	}
+	stored, err := storedHashes(ds.WorkspacePath())
+	if err != nil {
+		return nil, fmt.Errorf("error while listing the stored workspaces: %s", err)
+	}
+	variables, err := ds.ListClusterVariables()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the active workspace: %s", err)
+	}
+	active := variables[datasource.ActiveWorkspaceHashKey]
+	booted, err := bootedHashes(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	recorded := make(map[string]bool)
+	for _, file := range files {
+		if file.Name != TarballName {
+			continue
+		}
+		recorded[file.ID] = true
+		_, local := stored[file.ID]
+		versions = append(versions, Version{File: file, Local: local})
+	}
+	for hash, modTime := range stored {
+		if recorded[hash] {
+			continue
+		}
+		versions = append(versions, Version{
+			File: datasource.File{
+				ID:         hash,
+				Name:       TarballName,
+				UploadedAt: modTime,
+			},
+			Local: true,
+		})
+	}
+	for i := range versions {
+		versions[i].Active = versions[i].ID == active
+		versions[i].Booted = booted[versions[i].ID]
+	}
+
+	sort.Sort(byUploadTime(versions))
+	return versions, nil
+}
+
+// bootedHashes returns the number of the machines which last booted from
+// each workspace. The hash is read from the own variables of each machine,
+// in a single read; the machines which fail are logged and skipped.
+func bootedHashes(ds datasource.DataSource) (map[string]int, error) {
+	machines, err := ds.MachineInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the machines: %s", err)
+	}
+	booted := make(map[string]int)
+	for _, machineInterface := range machines {
+		variables, err := machineInterface.ListVariables()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"where":  "workspace.bootedHashes",
+				"object": machineInterface.Mac().String(),
+			}).WithError(err).Warn("failed to get the booted workspace, skipped")
+			continue
+		}
+		if hash := variables[datasource.BootedWorkspaceHashKey]; hash != "" {
+			booted[hash]++
+		}
+	}
+	return booted, nil
+}
+
+// Activate switches the active workspace of the cluster to the version with
+// the given hash. The version is pulled from the other instances, if it's not
+// stored on this one, and it's validated before the switch; the problems are
+// returned as ValidationErrors. The other instances follow through Sync.
+func Activate(ctx context.Context, ds datasource.DataSource, hash string) error {
+	if err := ValidHash(hash); err != nil {
+		return err
+	}
+	workspacePath := ds.WorkspacePath()
+	if !isStored(workspacePath, hash) {
+		s := &syncer{ds: ds, client: newPullClient()}
+		if err := s.pull(ctx, hash); err != nil {
+			return fmt.Errorf("error while pulling the workspace: %s", err)
+		}
+	}
+	if errs := Validate(ds, filepath.Join(Dir(workspacePath, hash), "workspace")); len(errs) > 0 {
+		return errs
+	}
+	if err := Switch(workspacePath, hash); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"where":  "workspace.Activate",
+		"action": "update",
+	}).Infof("Workspace %s is activated", hash)
+	return nil
+}
+
+// Collect deletes the versions of the workspace which are not retained. The
+// active version, the versions which any machine last booted from, the
+// current version of this instance, and the keep newest versions are
+// retained. The others are deleted from this instance, and their records are
+// deleted from the datastore. The deleted hashes are returned.
+func Collect(ds datasource.DataSource, keep int) ([]string, error) {
+	versions, err := Versions(ds)
+	if err != nil {
+		return nil, err
+	}
+	workspacePath := ds.WorkspacePath()
+	current, err := CurrentHash(workspacePath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the current workspace: %s", err)
+	}
+
+	var deleted []string
+	for i, version := range versions {
+		if i < keep || version.Active || version.Booted > 0 || version.ID == current {
+			continue
+		}
+
+		if version.Local {
+			if err := remove(workspacePath, version.ID); err != nil {
+				return deleted, err
+			}
+		}
+		if version.FromInstance != "" {
+			if err := ds.DeleteFile(version.ID); err != nil {
+				return deleted, fmt.Errorf("error while deleting the record of %s: %s",
+					version.ID, err)
+			}
+		}
+		deleted = append(deleted, version.ID)
+	}
+
+	if len(deleted) > 0 {
+		log.WithFields(log.Fields{
+			"where":  "workspace.Collect",
+			"action": "delete",
+		}).Infof("Deleted the workspaces %v", deleted)
+	}
+	return deleted, nil
+}
+
+// remove deletes the stored workspace with the given hash, unless it's the
+// current one
+func remove(workspacePath, hash string) error {
+	installLock.Lock()
+	defer installLock.Unlock()
+
+	current, err := CurrentHash(workspacePath)
+	if err != nil {
+		return fmt.Errorf("error while reading the current workspace: %s", err)
+	}
+	if hash == current {
+		return nil
+	}
+	if err := os.RemoveAll(Dir(workspacePath, hash)); err != nil {
+		return fmt.Errorf("error while deleting the workspace %s: %s", hash, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Package workspace installs the workspaces of blacksmith, and keeps the
+// workspace of each instance in sync with the active workspace of the cluster
+package workspace // import "github.com/cafebazaar/blacksmith/workspace"
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cafebazaar/blacksmith/utils"
+)
+
+// TarballName is the name of the tarball of each workspace, which is kept in
+// the files directory of the workspace
+const TarballName = "workspace.tar"
+
+// installLock serializes the changes of the stored workspaces, and the
+// switches of the current workspace
+var installLock sync.Mutex
+
+// ValidHash checks the hash to be usable as the name of a directory
+func ValidHash(hash string) error {
+	if hash == "" || hash != filepath.Base(hash) || hash[0] == '.' {
+		return fmt.Errorf("invalid workspace hash: %q", hash)
+	}
+	return nil
+}
+
+// Dir returns the directory which the workspace with the given hash is
+// extracted into. workspacePath is the symlink to the current workspace.
+func Dir(workspacePath, hash string) string {
+	return filepath.Join(filepath.Dir(workspacePath), hash)
+}
+
+// TarballPath returns the path of the tarball of the workspace with the
+// given hash
+func TarballPath(workspacePath, hash string) string {
+	return filepath.Join(Dir(workspacePath, hash), "workspace", "files", TarballName)
+}
+
+// TarballLocation returns the path of the tarball of the workspace with the
+// given hash on the web server of the instances which have it
+func TarballLocation(hash string) string {
+	return "/api/workspaces/" + hash + "/tarball"
+}
+
+// CurrentHash returns the hash of the workspace which workspacePath points
+// to, empty if there's none
+func CurrentHash(workspacePath string) (string, error) {
+	target, err := os.Readlink(workspacePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// workspacePath -> <parent>/<hash>/workspace
+	return filepath.Base(filepath.Dir(target)), nil
+}
+
+// ErrHashMismatch is returned by Store if the hash of the tarball doesn't
+// match
+var ErrHashMismatch = errors.New("the hash of the tarball doesn't match")
+
+// ValidSHA256 checks the hash to be a SHA-256 in hex, which the uploaded
+// workspaces are identified by
+func ValidSHA256(hash string) error {
+	if len(hash) != 2*sha256.Size {
+		return fmt.Errorf("invalid SHA-256: %q", hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil || strings.ToLower(hash) != hash {
+		return fmt.Errorf("invalid SHA-256: %q", hash)
+	}
+	return nil
+}
+
+// newHash returns the hash function of the workspace hash: SHA-256, or MD5
+// for the versions which are uploaded by the previous versions of blacksmith
+func newHash(workspaceHash string) (hash.Hash, error) {
+	switch len(workspaceHash) {
+	case 2 * sha256.Size:
+		return sha256.New(), nil
+	case 2 * md5.Size:
+		return md5.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash function for %q", workspaceHash)
+}
+
+// Store streams the tarball of the workspace with the given hash from r into
+// a temporary file, while its hash is computed, and extracts it next to
+// workspacePath if the hash matches. The tarball may be compressed with gzip
+// or zstd. It's extracted into a temporary directory, which is renamed when
+// it's complete. The size of the tarball is returned.
+func Store(workspacePath, hash string, r io.Reader) (int64, error) {
+	if err := ValidHash(hash); err != nil {
+		return 0, err
+	}
+	h, err := newHash(hash)
+	if err != nil {
+		return 0, err
+	}
+
+	parent := filepath.Dir(workspacePath)
+	tmp, err := ioutil.TempFile(parent, ".tarball-")
+	if err != nil {
+		return 0, fmt.Errorf("error while creating the temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return size, fmt.Errorf("error while storing the tarball: %s", err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return size, ErrHashMismatch
+	}
+
+	if isStored(workspacePath, hash) {
+		return size, nil
+	}
+	tmpDir, err := ioutil.TempDir(parent, "."+hash+"-")
+	if err != nil {
+		return size, fmt.Errorf("error while creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := utils.Untar(tmp.Name(), tmpDir); err != nil {
+		return size, fmt.Errorf("error while untaring the workspace: %s", err)
+	}
+	info, err := os.Lstat(filepath.Join(tmpDir, "workspace"))
+	if err != nil || !info.IsDir() {
+		return size, errors.New("the tarball has no workspace directory")
+	}
+
+	// kept to be served to the other instances
+	tarballPath := filepath.Join(tmpDir, "workspace", "files", TarballName)
+	if err := os.MkdirAll(filepath.Dir(tarballPath), 0755); err != nil {
+		return size, fmt.Errorf("error while creating the files directory: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), tarballPath); err != nil {
+		return size, fmt.Errorf("error while moving the tarball into the workspace: %s", err)
+	}
+
+	installLock.Lock()
+	defer installLock.Unlock()
+	if isStored(workspacePath, hash) {
+		return size, nil
+	}
+	dir := Dir(workspacePath, hash)
+	// the leftovers of the previous versions of blacksmith, which extracted
+	// the workspaces in place
+	if err := os.RemoveAll(dir); err != nil {
+		return size, fmt.Errorf("error while removing the incomplete workspace: %s", err)
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return size, fmt.Errorf("error while moving the workspace into place: %s", err)
+	}
+	return size, nil
+}
+
+// Switch points workspacePath to the stored workspace with the given hash
+func Switch(workspacePath, hash string) error {
+	if err := ValidHash(hash); err != nil {
+		return err
+	}
+
+	installLock.Lock()
+	defer installLock.Unlock()
+
+	if !isStored(workspacePath, hash) {
+		return fmt.Errorf("workspace %s is not stored on this instance", hash)
+	}
+	return switchTo(workspacePath, hash)
+}
+
+// isStored reports whether the workspace with the given hash is extracted
+// next to workspacePath
+func isStored(workspacePath, hash string) bool {
+	info, err := os.Stat(filepath.Join(Dir(workspacePath, hash), "workspace"))
+	return err == nil && info.IsDir()
+}
+
+// switchTo atomically replaces the workspacePath symlink, by renaming a new
+// symlink over it, so it always points to a complete workspace
+func switchTo(workspacePath, hash string) error {
+	tmpPath := fmt.Sprintf("%s.%d.tmp", workspacePath, os.Getpid())
+	os.Remove(tmpPath)
+	err := os.Symlink(filepath.Join(Dir(workspacePath, hash), "workspace"), tmpPath)
+	if err != nil {
+		return fmt.Errorf("error while symlinking current to the untared workspace: %s", err)
+	}
+	if err := os.Rename(tmpPath, workspacePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error while switching the current workspace: %s", err)
+	}
+	return nil
+}
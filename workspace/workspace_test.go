@@ -0,0 +1,254 @@
+package workspace
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// tarballForTest returns a workspace tarball with the given files, and its
+// hash
+func tarballForTest(t *testing.T, files map[string]string) ([]byte, string) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, dir := range []string{"workspace/", "workspace/files/"} {
+		err := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), hex.EncodeToString(sum[:])
+}
+
+func install(t *testing.T, workspacePath, hash string, tarball []byte) {
+	if _, err := Store(workspacePath, hash, bytes.NewReader(tarball)); err != nil {
+		t.Fatal("failed to store:", err)
+	}
+	if err := Switch(workspacePath, hash); err != nil {
+		t.Fatal("failed to switch:", err)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workspacePath := filepath.Join(dir, "current")
+
+	if hash, err := CurrentHash(workspacePath); err != nil || hash != "" {
+		t.Errorf("expecting no current workspace, got %q, %v", hash, err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		tarball, hash := tarballForTest(t, map[string]string{
+			"workspace/initial.yaml": content,
+		})
+		install(t, workspacePath, hash, tarball)
+
+		if got, err := CurrentHash(workspacePath); err != nil || got != hash {
+			t.Errorf("expecting the current workspace to be %s, got %q, %v", hash, got, err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(workspacePath, "initial.yaml"))
+		if err != nil || string(got) != content {
+			t.Errorf("expecting initial.yaml to be %q, got %q, %v", content, got, err)
+		}
+		if _, err := os.Stat(TarballPath(workspacePath, hash)); err != nil {
+			t.Error("expecting the tarball to be kept in the workspace:", err)
+		}
+	}
+
+	if _, err := Store(workspacePath, "../escape", bytes.NewReader(nil)); err == nil {
+		t.Error("expecting an error for an invalid hash")
+	}
+	tarball, _ := tarballForTest(t, map[string]string{"workspace/initial.yaml": "x"})
+	_, err = Store(workspacePath, strings.Repeat("0", 64), bytes.NewReader(tarball))
+	if err != ErrHashMismatch {
+		t.Errorf("expecting ErrHashMismatch, got %v", err)
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workspacePath := filepath.Join(dir, "current")
+
+	var hashes []string
+	for _, content := range []string{"first", "second"} {
+		tarball, hash := tarballForTest(t, map[string]string{
+			"workspace/initial.yaml": content,
+		})
+		install(t, workspacePath, hash, tarball)
+		hashes = append(hashes, hash)
+	}
+
+	stored, err := storedHashes(workspacePath)
+	if err != nil {
+		t.Fatal("failed to list the stored workspaces:", err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("expecting 2 stored workspaces, got %v", stored)
+	}
+
+	if err := Switch(workspacePath, hashes[0]); err != nil {
+		t.Fatal("failed to switch:", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(workspacePath, "initial.yaml"))
+	if err != nil || string(got) != "first" {
+		t.Errorf("expecting to switch back to the first workspace, got %q, %v", got, err)
+	}
+
+	if err := Switch(workspacePath, "0123"); err == nil {
+		t.Error("expecting an error for a workspace which is not stored")
+	}
+	if err := remove(workspacePath, hashes[0]); err != nil {
+		t.Error("failed to remove:", err)
+	}
+	if !isStored(workspacePath, hashes[0]) {
+		t.Error("expecting the current workspace not to be removed")
+	}
+	if err := remove(workspacePath, hashes[1]); err != nil || isStored(workspacePath, hashes[1]) {
+		t.Error("expecting the old workspace to be removed:", err)
+	}
+}
+
+func TestPullFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workspacePath := filepath.Join(dir, "current")
+
+	tarball, hash := tarballForTest(t, map[string]string{
+		"workspace/initial.yaml": "pulled",
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != TarballLocation(hash) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	s := &syncer{client: http.DefaultClient}
+	ctx := context.Background()
+
+	err = s.pullFrom(ctx, server.URL+TarballLocation("0123"), workspacePath, "0123")
+	if err == nil {
+		t.Error("expecting an error for a missing workspace")
+	}
+	// the tarball of hash, which doesn't match the requested hash
+	err = s.pullFrom(ctx, server.URL+TarballLocation(hash), workspacePath, "0123")
+	if err == nil {
+		t.Error("expecting an error for a mismatching hash")
+	}
+	if got, _ := CurrentHash(workspacePath); got != "" {
+		t.Errorf("expecting no workspace to be installed, got %s", got)
+	}
+
+	err = s.pullFrom(ctx, server.URL+TarballLocation(hash), workspacePath, hash)
+	if err != nil {
+		t.Fatal("failed to pull:", err)
+	}
+	if !isStored(workspacePath, hash) {
+		t.Error("expecting the pulled workspace to be stored")
+	}
+	if got, _ := CurrentHash(workspacePath); got != "" {
+		t.Errorf("expecting the current workspace to be switched by the caller, got %s", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ds, cleanup, err := datasource.ForTest(datasource.ForTestLocal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	valid := map[string]string{
+		"initial.yaml":                                        "coreos-version: 1010.5.0\nnet-conf: '{\"netmask\": \"255.255.255.0\"}'\n",
+		"config/bootparams/main":                              "<< template \"part\" . >> mac=<< .Mac >>",
+		"config/bootparams/part":                              "<< define \"part\" >>version=<< V \"coreos-version\" >><< end >>",
+		"config/cloudconfig/main":                             "#cloud-config\nhostname: << .Hostname >>",
+		"tftp/pxelinux.cfg/menu.tmpl":                         "<< .IP >>",
+		"images/1010.5.0/coreos_production_pxe.vmlinuz":       "kernel",
+		"images/1010.5.0/coreos_production_pxe_image.cpio.gz": "initrd",
+	}
+	tests := []struct {
+		name    string
+		changes map[string]string
+		errors  int
+	}{
+		{"valid", nil, 0},
+		{"template syntax", map[string]string{"config/cloudconfig/main": "<< .Hostname"}, 1},
+		{"unknown function", map[string]string{"config/cloudconfig/main": "<< unknown >>"}, 1},
+		{"render error", map[string]string{"config/cloudconfig/main": "<< template \"missing\" >>"}, 1},
+		{"tftp template", map[string]string{"tftp/pxelinux.cfg/menu.tmpl": "<< .Missing >>"}, 1},
+		{"missing bootparams", map[string]string{"config/bootparams/main": ""}, 2},
+		{"missing initrd", map[string]string{"images/1010.5.0/coreos_production_pxe_image.cpio.gz": ""}, 1},
+		{"missing image", map[string]string{"initial.yaml": "coreos-version: 1068.0.0\n"}, 1},
+		{"invalid net-conf", map[string]string{"initial.yaml": "coreos-version: 1010.5.0\nnet-conf: '{}'\n"}, 1},
+		// the coreos-version of the cluster is checked instead, which is missing
+		{"invalid initial.yaml", map[string]string{"initial.yaml": "- a\n- b\n"}, 2},
+	}
+
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "blacksmith-workspace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		for name, content := range valid {
+			if changed, ok := tt.changes[name]; ok {
+				if changed == "" {
+					continue
+				}
+				content = changed
+			}
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		errs := Validate(ds, dir)
+		if len(errs) != tt.errors {
+			t.Errorf("%s: expecting %d errors, got %v", tt.name, tt.errors, errs.Strings())
+		}
+	}
+}